@@ -0,0 +1,131 @@
+package burst
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bioe007/synopsys/cpu"
+	"github.com/bioe007/synopsys/disk"
+	"github.com/bioe007/synopsys/status"
+)
+
+// Samples cpu and disks faster than the display interval and keeps every
+// value, so a spike that the interval average smooths away still shows up as
+// the max or p99. Sample and InfoPrint are called from different goroutines.
+type Sampler struct {
+	mu      sync.Mutex
+	cpus    *cpu.CpuInfo
+	disks   *disk.DiskInfo
+	samples int
+	series  map[string][]float64
+	order   []string // first seen, so lines don't jump around
+	err     error
+}
+
+func NewSampler() *Sampler {
+	return &Sampler{
+		cpus:   new(cpu.CpuInfo),
+		disks:  new(disk.DiskInfo),
+		series: make(map[string][]float64),
+	}
+}
+
+func (s *Sampler) add(name string, v float64) {
+	if _, ok := s.series[name]; !ok {
+		s.order = append(s.order, name)
+	}
+	s.series[name] = append(s.series[name], v)
+}
+
+// Take one sample. The first only sets up the counters to compare against.
+func (s *Sampler) Sample() {
+	// the collectors are only touched from here, so read them unlocked. Only
+	// /proc/stat for cpu, the full collector would be most of the cost.
+	ci, cpuErr := cpu.TimeStats(s.cpus)
+	if cpuErr == nil {
+		s.cpus = ci
+	}
+	di, diskErr := disk.DiskStats(s.disks)
+	if diskErr == nil {
+		s.disks = di
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = cpuErr
+	if s.err == nil {
+		s.err = diskErr
+	}
+
+	recorded := false
+	if busy, ok := s.cpus.Busy("cpu"); ok {
+		s.add("cpu busy", float64(busy))
+		softirq, _ := s.cpus.Softirq("cpu")
+		s.add("cpu softirq", float64(softirq))
+		// softirq is often all on the one cpu handling a nic's interrupts
+		var hottest float32
+		for _, name := range s.cpus.Names() {
+			if v, ok := s.cpus.Softirq(name); ok {
+				hottest = max(hottest, v)
+			}
+		}
+		s.add("max cpu softirq", float64(hottest))
+		recorded = true
+	}
+	for _, name := range s.disks.Names() {
+		util, inflight, ok := s.disks.Busy(name)
+		if !ok {
+			continue
+		}
+		s.add(name+" util", float64(util))
+		s.add(name+" queue", float64(inflight))
+		recorded = true
+	}
+	if recorded {
+		s.samples++
+	}
+}
+
+// Nearest rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// Show max/p99 of everything since the last call, then start over. Series
+// that were always zero, like idle disks, are left out. With fewer than 100
+// samples p99 is close to, or the same as, the max.
+func (s *Sampler) InfoPrint() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("x%d max/p99:", s.samples))
+	for _, name := range s.order {
+		vals := s.series[name]
+		if len(vals) == 0 {
+			continue
+		}
+		sort.Float64s(vals)
+		top := vals[len(vals)-1]
+		if top == 0 {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf(" %s: %.2f/%.2f", name, top, percentile(vals, 99)))
+	}
+	if s.err != nil {
+		sb.WriteString("\tunavailable: " + status.Reason(s.err))
+	}
+
+	s.samples = 0
+	for name := range s.series {
+		s.series[name] = s.series[name][:0]
+	}
+	return sb.String()
+}
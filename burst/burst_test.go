@@ -0,0 +1,89 @@
+package burst
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"testing"
+
+	"github.com/bioe007/synopsys/disk"
+)
+
+func TestPercentile(t *testing.T) {
+	vals := make([]float64, 200)
+	for i := range vals {
+		vals[i] = float64(i + 1)
+	}
+	tests := []struct {
+		vals []float64
+		p    float64
+		want float64
+	}{
+		{vals, 99, 198},
+		{vals, 50, 100},
+		{vals, 100, 200},
+		{[]float64{1, 2, 3}, 99, 3},
+		{[]float64{5}, 0, 5},
+		{nil, 99, 0},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.vals, tt.p); got != tt.want {
+			t.Errorf("p%.0f of %d values got %.0f want %.0f", tt.p, len(tt.vals), got, tt.want)
+		}
+	}
+}
+
+func TestInfoPrint(t *testing.T) {
+	s := NewSampler()
+	// a 200ms spike in a 1s interval sampled every 100ms
+	for i := 0; i < 10; i++ {
+		busy := 0.1
+		if i == 3 || i == 4 {
+			busy = 0.9
+		}
+		s.add("cpu busy", busy)
+		s.add("sda util", 0)
+		s.samples++
+	}
+	got := s.InfoPrint()
+	if got != "x10 max/p99: cpu busy: 0.90/0.90" {
+		t.Errorf("got %q", got)
+	}
+
+	// starts over each interval
+	s.add("cpu busy", 0.5)
+	s.samples++
+	s.err = &fs.PathError{Op: "open", Path: "/sys/block", Err: fs.ErrNotExist}
+	got = s.InfoPrint()
+	if got != "x1 max/p99: cpu busy: 0.50/0.50\tunavailable: not found /sys/block" {
+		t.Errorf("got %q", got)
+	}
+	if !errors.Is(s.err, fs.ErrNotExist) {
+		t.Error("error should stay until a sample succeeds")
+	}
+}
+
+// The main loop reads disks while the sampler does, run with -race. Either
+// can fail to read in a container, only sharing state matters here.
+func TestSampleConcurrent(t *testing.T) {
+	s := NewSampler()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			s.Sample()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		di := new(disk.DiskInfo)
+		for i := 0; i < 5; i++ {
+			if next, err := disk.DiskStats(di); err == nil {
+				di = next
+			}
+		}
+	}()
+	wg.Wait()
+	s.InfoPrint()
+}
@@ -0,0 +1,603 @@
+package cgroup
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/container"
+	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+// Hosts with the v1 and v2 hierarchies mounted together (hybrid mode) put v2
+// under 'unified'.
+var mountPoints = []string{"sys/fs/cgroup", "sys/fs/cgroup/unified"}
+
+// Limits read as 'max' mean there isn't one
+const unlimited = -1
+
+// How many child cgroups to show in each ranking
+const topCgroups = 5
+
+var ErrNoCgroupV2 = errors.New("cgroup v2 is not mounted")
+
+type ioStat struct {
+	rbytes int
+	wbytes int
+	rios   int
+	wios   int
+}
+
+// Pressure stall information, the averages are percent of time some or all
+// tasks were stalled. Totals are in microseconds.
+type psi struct {
+	someAvg10 float64
+	someTotal int
+	fullAvg10 float64
+	fullTotal int
+}
+
+// Values read from the files of a single cgroup. Files that don't exist, like
+// cpu.max in the root cgroup or when a controller isn't enabled, leave the
+// zero value or unlimited for limits.
+type cgroupStat struct {
+	path string
+
+	cpuQuota  int // microseconds per period, or unlimited
+	cpuPeriod int
+
+	// cpu.stat
+	usageUsec     int
+	nrPeriods     int
+	nrThrottled   int
+	throttledUsec int
+
+	memCurrent int // bytes
+	memMax     int // bytes, or unlimited
+	memEvents  map[string]int
+
+	io       map[string]*ioStat // keyed by major:minor
+	pressure map[string]*psi    // keyed by cpu, memory or io
+}
+
+// Per-second rates for a cgroup between two samples
+type cgroupRate struct {
+	name      string
+	cpu       float64 // cores in use
+	throttled float64 // fraction of periods throttled
+	mem       int     // bytes, not a rate
+	io        float64 // bytes read and written per second
+}
+
+// A heap of cgroups ordered by whatever less chooses
+type rateHeap struct {
+	rates []*cgroupRate
+	less  func(a, b *cgroupRate) bool
+}
+
+func (h rateHeap) Len() int           { return len(h.rates) }
+func (h rateHeap) Less(i, j int) bool { return h.less(h.rates[i], h.rates[j]) }
+func (h rateHeap) Swap(i, j int)      { h.rates[i], h.rates[j] = h.rates[j], h.rates[i] }
+func (h *rateHeap) Push(x any)        { h.rates = append(h.rates, x.(*cgroupRate)) }
+func (h *rateHeap) Pop() any {
+	old := h.rates
+	n := len(old)
+	if n == 0 {
+		return nil
+	}
+	x := old[n-1]
+	h.rates = old[0 : n-1]
+	return x
+}
+
+type CgroupInfo struct {
+	Path string // relative to the cgroup mount, e.g. /system.slice/foo.service
+	// When set, rank the children of this cgroup
+	TopParent string
+
+	mount   string
+	old     *cgroupStat
+	new     *cgroupStat
+	oldTime time.Time
+	newTime time.Time
+
+	oldChildren map[string]*cgroupStat
+	newChildren map[string]*cgroupStat
+}
+
+// Find where the v2 hierarchy is mounted
+func findMount(fsys fs.FS) (string, error) {
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		_, err := fs.Stat(fsys, path.Join(mountPoints[i], "cgroup.controllers"))
+		if err == nil {
+			return mountPoints[i], nil
+		}
+	}
+	return "", ErrNoCgroupV2
+}
+
+// The v2 cgroup of this process, from the '0::' line of /proc/self/cgroup
+func currentCgroup(fsys fs.FS) (string, error) {
+	b, err := fs.ReadFile(fsys, "proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if p, found := strings.CutPrefix(line, "0::"); found {
+			return p, nil
+		}
+	}
+	return "", ErrNoCgroupV2
+}
+
+// Read an integer, or 'max', from a single value file
+func readLimit(fsys fs.FS, p string) (int, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return unlimited, err
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "max" {
+		return unlimited, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// Parse the 'key value' lines used by cpu.stat and memory.events
+func readKeyed(fsys fs.FS, p string) (map[string]int, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]int)
+	scanner := bufio.NewScanner(strings.NewReader(string(b)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, status.Errorf(p, "%s: %w", fields[0], err)
+		}
+		m[fields[0]] = v
+	}
+	return m, scanner.Err()
+}
+
+// Parse io.stat lines like '8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0'
+func parseIoStat(s string) (map[string]*ioStat, error) {
+	stats := make(map[string]*ioStat)
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		st := new(ioStat)
+		for _, f := range fields[1:] {
+			k, v, found := strings.Cut(f, "=")
+			if !found {
+				continue
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("io.stat %s %s: %w", fields[0], k, err)
+			}
+			switch k {
+			case "rbytes":
+				st.rbytes = n
+			case "wbytes":
+				st.wbytes = n
+			case "rios":
+				st.rios = n
+			case "wios":
+				st.wios = n
+			}
+		}
+		stats[fields[0]] = st
+	}
+	return stats, scanner.Err()
+}
+
+// Parse a pressure file, 'some avg10=0.00 avg60=0.00 avg300=0.00 total=0'
+// followed by a 'full' line. cpu.pressure only has 'full' on newer kernels.
+func parsePressure(s string) (*psi, error) {
+	p := new(psi)
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var avg *float64
+		var total *int
+		switch fields[0] {
+		case "some":
+			avg, total = &p.someAvg10, &p.someTotal
+		case "full":
+			avg, total = &p.fullAvg10, &p.fullTotal
+		default:
+			continue
+		}
+		for _, f := range fields[1:] {
+			k, v, _ := strings.Cut(f, "=")
+			var err error
+			switch k {
+			case "avg10":
+				*avg, err = strconv.ParseFloat(v, 64)
+			case "total":
+				*total, err = strconv.Atoi(v)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("pressure %s %s: %w", fields[0], k, err)
+			}
+		}
+	}
+	return p, scanner.Err()
+}
+
+func readCgroup(fsys fs.FS, mount string, cg string) (*cgroupStat, error) {
+	dir := path.Join(mount, cg)
+	if _, err := fs.Stat(fsys, dir); err != nil {
+		return nil, err
+	}
+
+	st := new(cgroupStat)
+	st.path = cg
+	st.cpuQuota = unlimited
+	st.memMax = unlimited
+
+	if b, err := fs.ReadFile(fsys, path.Join(dir, "cpu.max")); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) == 2 {
+			if fields[0] != "max" {
+				st.cpuQuota, err = strconv.Atoi(fields[0])
+				if err != nil {
+					return nil, status.Errorf(path.Join(dir, "cpu.max"), "%w", err)
+				}
+			}
+			st.cpuPeriod, err = strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, status.Errorf(path.Join(dir, "cpu.max"), "%w", err)
+			}
+		}
+	}
+
+	// cpu.stat always has usage, even without the cpu controller enabled
+	if m, err := readKeyed(fsys, path.Join(dir, "cpu.stat")); err == nil {
+		st.usageUsec = m["usage_usec"]
+		st.nrPeriods = m["nr_periods"]
+		st.nrThrottled = m["nr_throttled"]
+		st.throttledUsec = m["throttled_usec"]
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	var err error
+	st.memCurrent, err = readLimit(fsys, path.Join(dir, "memory.current"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if st.memCurrent == unlimited {
+		st.memCurrent = 0
+	}
+	st.memMax, err = readLimit(fsys, path.Join(dir, "memory.max"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	st.memEvents, err = readKeyed(fsys, path.Join(dir, "memory.events"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if b, err := fs.ReadFile(fsys, path.Join(dir, "io.stat")); err == nil {
+		st.io, err = parseIoStat(string(b))
+		if err != nil {
+			return nil, status.Errorf(path.Join(dir, "io.stat"), "%w", err)
+		}
+	}
+
+	st.pressure = make(map[string]*psi)
+	for _, res := range []string{"cpu", "memory", "io"} {
+		b, err := fs.ReadFile(fsys, path.Join(dir, res+".pressure"))
+		if err != nil {
+			continue
+		}
+		st.pressure[res], err = parsePressure(string(b))
+		if err != nil {
+			return nil, status.Errorf(path.Join(dir, res+".pressure"), "%w", err)
+		}
+	}
+
+	return st, nil
+}
+
+// Read every direct child of a cgroup
+func readChildren(fsys fs.FS, mount string, parent string) (map[string]*cgroupStat, error) {
+	entries, err := fs.ReadDir(fsys, path.Join(mount, parent))
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[string]*cgroupStat)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		st, err := readCgroup(fsys, mount, path.Join(parent, e.Name()))
+		if err != nil {
+			// it may have gone away since listing the directory
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		children[e.Name()] = st
+	}
+	return children, nil
+}
+
+// The oom_kill count of every cgroup, keyed by path relative to the mount.
+// memory.events counts the kills of descendants too, so the .local version is
+// used when the kernel has it (5.9+) to avoid counting a kill once per level.
+func OomKills() (map[string]int, error) {
+	return getOomKills(rootfs.FS)
+}
+
+func getOomKills(fsys fs.FS) (map[string]int, error) {
+	mount, err := findMount(fsys)
+	if err != nil {
+		return nil, err
+	}
+	kills := make(map[string]int)
+	err = fs.WalkDir(fsys, mount, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// cgroups come and go while walking
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		m, err := readKeyed(fsys, path.Join(p, "memory.events.local"))
+		if errors.Is(err, fs.ErrNotExist) {
+			m, err = readKeyed(fsys, path.Join(p, "memory.events"))
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		kills["/"+strings.TrimPrefix(strings.TrimPrefix(p, mount), "/")] = m["oom_kill"]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kills, nil
+}
+
+// Get a CgroupInfo and update it with new stats. The first time through this
+// finds the cgroup of this process, unless Path is already set.
+func CgroupStats(ci *CgroupInfo) (*CgroupInfo, error) {
+	return getCgroupStats(ci, rootfs.FS)
+}
+
+func getCgroupStats(ci *CgroupInfo, fsys fs.FS) (*CgroupInfo, error) {
+	var err error
+	if ci.mount == "" {
+		ci.mount, err = findMount(fsys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ci.Path == "" {
+		ci.Path, err = currentCgroup(fsys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	st, err := readCgroup(fsys, ci.mount, ci.Path)
+	if err != nil {
+		return nil, err
+	}
+	var children map[string]*cgroupStat
+	if ci.TopParent != "" {
+		children, err = readChildren(fsys, ci.mount, ci.TopParent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ci.old = ci.new
+	ci.oldTime = ci.newTime
+	ci.new = st
+	ci.newTime = time.Now()
+	if ci.TopParent != "" {
+		ci.oldChildren = ci.newChildren
+		ci.newChildren = children
+	}
+	return ci, nil
+}
+
+func ioTotal(st *cgroupStat) int {
+	total := 0
+	for _, s := range st.io {
+		total += s.rbytes + s.wbytes
+	}
+	return total
+}
+
+// Deleted and created again under the same path between samples, the
+// counters started over
+func recreated(prev, cur *cgroupStat) bool {
+	return cur.usageUsec < prev.usageUsec || ioTotal(cur) < ioTotal(prev)
+}
+
+// Calculate rates between two samples of a cgroup. Without a previous sample
+// only memory is known.
+func rate(name string, prev, cur *cgroupStat, elapsed float64) *cgroupRate {
+	r := &cgroupRate{name: name, mem: cur.memCurrent}
+	if prev == nil || elapsed <= 0 || recreated(prev, cur) {
+		return r
+	}
+	r.cpu = float64(cur.usageUsec-prev.usageUsec) / 1e6 / elapsed
+	r.io = float64(ioTotal(cur)-ioTotal(prev)) / elapsed
+	if periods := cur.nrPeriods - prev.nrPeriods; periods > 0 {
+		r.throttled = float64(cur.nrThrottled-prev.nrThrottled) / float64(periods)
+	}
+	return r
+}
+
+func formatLimit(v int) string {
+	if v == unlimited {
+		return "max"
+	}
+	return strconv.Itoa(memory.Scaled(v / 1024))
+}
+
+func (ci *CgroupInfo) elapsed() float64 {
+	if ci.oldTime.IsZero() {
+		return 0
+	}
+	return ci.newTime.Sub(ci.oldTime).Seconds()
+}
+
+// Details for the cgroup this is running in
+func (ci *CgroupInfo) InfoPrint() string {
+	if ci.new == nil {
+		return ""
+	}
+	st := ci.new
+	elapsed := ci.elapsed()
+	prev := ci.old
+	if prev != nil && recreated(prev, st) {
+		prev = nil
+	}
+	r := rate(st.path, prev, st, elapsed)
+
+	var sb strings.Builder
+	sb.WriteString(st.path)
+	if c := container.FromCgroupPath(st.path); c != nil {
+		sb.WriteString(" " + c.String())
+	}
+	sb.WriteString("\n")
+
+	limit := "max"
+	if st.cpuQuota != unlimited && st.cpuPeriod > 0 {
+		limit = fmt.Sprintf("%.2f", float64(st.cpuQuota)/float64(st.cpuPeriod))
+	}
+	sb.WriteString(fmt.Sprintf("cpu: %.2f/%s cores throttled: %.0f%%", r.cpu, limit, r.throttled*100))
+	if prev != nil {
+		sb.WriteString(fmt.Sprintf(" (%dms)", (st.throttledUsec-prev.throttledUsec)/1000))
+	}
+
+	memPct := ""
+	if st.memMax != unlimited && st.memMax > 0 {
+		memPct = fmt.Sprintf(" (%.0f%%)", float64(st.memCurrent)*100/float64(st.memMax))
+	}
+	sb.WriteString(fmt.Sprintf("\tmem cur/max: %s/%s%s oom: %d oom_kill: %d\n",
+		formatLimit(st.memCurrent), formatLimit(st.memMax), memPct,
+		st.memEvents["oom"], st.memEvents["oom_kill"]))
+
+	if prev != nil && elapsed > 0 {
+		devs := make([]string, 0, len(st.io))
+		for dev := range st.io {
+			devs = append(devs, dev)
+		}
+		sort.Strings(devs)
+		for _, dev := range devs {
+			cur := st.io[dev]
+			p, ok := prev.io[dev]
+			if !ok {
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("io %s rB/s: %.0f wB/s: %.0f r/s: %.0f w/s: %.0f\n",
+				dev,
+				float64(cur.rbytes-p.rbytes)/elapsed,
+				float64(cur.wbytes-p.wbytes)/elapsed,
+				float64(cur.rios-p.rios)/elapsed,
+				float64(cur.wios-p.wios)/elapsed,
+			))
+		}
+	}
+
+	if len(st.pressure) > 0 {
+		sb.WriteString("psi some/full avg10:")
+		for _, res := range []string{"cpu", "memory", "io"} {
+			if p, ok := st.pressure[res]; ok {
+				sb.WriteString(fmt.Sprintf(" %s: %.2f/%.2f", res, p.someAvg10, p.fullAvg10))
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// Container scopes have unreadable names so show the container instead
+func displayName(name string) string {
+	if c := container.FromCgroupPath(name); c != nil {
+		return c.String()
+	}
+	return name
+}
+
+// Show the children of TopParent ranked by cpu, memory and io
+func (ci *CgroupInfo) TopPrint() string {
+	if len(ci.oldChildren) == 0 {
+		return ""
+	}
+	elapsed := ci.elapsed()
+	var rates []*cgroupRate
+	for name, cur := range ci.newChildren {
+		rates = append(rates, rate(name, ci.oldChildren[name], cur, elapsed))
+	}
+
+	rankings := []struct {
+		title  string
+		less   func(a, b *cgroupRate) bool
+		format func(r *cgroupRate) string
+	}{
+		{
+			"cpu",
+			func(a, b *cgroupRate) bool { return a.cpu > b.cpu },
+			func(r *cgroupRate) string { return fmt.Sprintf("%.2f", r.cpu) },
+		},
+		{
+			"mem",
+			func(a, b *cgroupRate) bool { return a.mem > b.mem },
+			func(r *cgroupRate) string { return formatLimit(r.mem) },
+		},
+		{
+			"io B/s",
+			func(a, b *cgroupRate) bool { return a.io > b.io },
+			func(r *cgroupRate) string { return fmt.Sprintf("%.0f", r.io) },
+		},
+	}
+
+	var sb strings.Builder
+	for _, rank := range rankings {
+		h := &rateHeap{rates: append([]*cgroupRate{}, rates...), less: rank.less}
+		heap.Init(h)
+		sb.WriteString(fmt.Sprintf("top %s by %s:", ci.TopParent, rank.title))
+		for i := 0; i < topCgroups && h.Len() > 0; i++ {
+			r := heap.Pop(h).(*cgroupRate)
+			sb.WriteString(fmt.Sprintf(" %s %s", displayName(r.name), rank.format(r)))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
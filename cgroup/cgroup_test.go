@@ -0,0 +1,188 @@
+package cgroup
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func serviceFiles(usage, rbytes string) fstest.MapFS {
+	svc := "sys/fs/cgroup/system.slice/db.service/"
+	return fstest.MapFS{
+		"proc/self/cgroup":                 {Data: []byte("0::/system.slice/db.service\n")},
+		"sys/fs/cgroup/cgroup.controllers": {Data: []byte("cpu io memory pids\n")},
+		svc + "cpu.max":                    {Data: []byte("200000 100000\n")},
+		svc + "cpu.stat": {Data: []byte("usage_usec " + usage + "\nuser_usec 1\nsystem_usec 1\n" +
+			"nr_periods 100\nnr_throttled 25\nthrottled_usec 5000\n")},
+		svc + "memory.current": {Data: []byte("536870912\n")},
+		svc + "memory.max":     {Data: []byte("1073741824\n")},
+		svc + "memory.events":  {Data: []byte("low 0\nhigh 0\nmax 3\noom 2\noom_kill 1\n")},
+		svc + "io.stat": {Data: []byte("8:0 rbytes=" + rbytes +
+			" wbytes=0 rios=10 wios=0 dbytes=0 dios=0\n")},
+		svc + "memory.pressure": {Data: []byte("some avg10=1.50 avg60=0.00 avg300=0.00 total=10\n" +
+			"full avg10=0.50 avg60=0.00 avg300=0.00 total=5\n")},
+		"sys/fs/cgroup/system.slice/cron.service/cpu.stat":       {Data: []byte("usage_usec 0\n")},
+		"sys/fs/cgroup/system.slice/cron.service/memory.current": {Data: []byte("1024\n")},
+		"sys/fs/cgroup/system.slice/cron.service/memory.max":     {Data: []byte("max\n")},
+	}
+}
+
+func TestCurrentCgroup(t *testing.T) {
+	p, err := currentCgroup(fstest.MapFS{
+		"proc/self/cgroup": {Data: []byte("4:memory:/user.slice\n0::/user.slice/session-1.scope\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != "/user.slice/session-1.scope" {
+		t.Errorf("got %q", p)
+	}
+
+	_, err = currentCgroup(fstest.MapFS{
+		"proc/self/cgroup": {Data: []byte("4:memory:/user.slice\n")},
+	})
+	if err != ErrNoCgroupV2 {
+		t.Errorf("v1 only should not be found, got %v", err)
+	}
+}
+
+func TestFindMount(t *testing.T) {
+	if _, err := findMount(fstest.MapFS{}); err != ErrNoCgroupV2 {
+		t.Errorf("expected no cgroup v2, got %v", err)
+	}
+	m, err := findMount(fstest.MapFS{
+		"sys/fs/cgroup/memory/tasks":               {Data: []byte("")},
+		"sys/fs/cgroup/unified/cgroup.controllers": {Data: []byte("")},
+	})
+	if err != nil || m != "sys/fs/cgroup/unified" {
+		t.Errorf("hybrid mount not found: %s %v", m, err)
+	}
+}
+
+func TestReadCgroup(t *testing.T) {
+	st, err := readCgroup(serviceFiles("1000000", "0"), "sys/fs/cgroup", "/system.slice/db.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.cpuQuota != 200000 || st.cpuPeriod != 100000 {
+		t.Errorf("wrong cpu.max %d %d", st.cpuQuota, st.cpuPeriod)
+	}
+	if st.usageUsec != 1000000 || st.nrThrottled != 25 || st.throttledUsec != 5000 {
+		t.Errorf("wrong cpu.stat %+v", st)
+	}
+	if st.memCurrent != 536870912 || st.memMax != 1073741824 {
+		t.Errorf("wrong memory %d/%d", st.memCurrent, st.memMax)
+	}
+	if st.memEvents["oom"] != 2 || st.memEvents["oom_kill"] != 1 {
+		t.Errorf("wrong memory.events %v", st.memEvents)
+	}
+	if st.io["8:0"].rios != 10 {
+		t.Errorf("wrong io.stat %+v", st.io["8:0"])
+	}
+	if p := st.pressure["memory"]; p.someAvg10 != 1.5 || p.fullTotal != 5 {
+		t.Errorf("wrong pressure %+v", p)
+	}
+
+	st, err = readCgroup(serviceFiles("0", "0"), "sys/fs/cgroup", "/system.slice/cron.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.memMax != unlimited || st.cpuQuota != unlimited {
+		t.Errorf("missing limits should be unlimited %+v", st)
+	}
+}
+
+func TestCgroupStats(t *testing.T) {
+	ci := &CgroupInfo{TopParent: "/system.slice"}
+	ci, err := getCgroupStats(ci, serviceFiles("1000000", "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Path != "/system.slice/db.service" {
+		t.Errorf("wrong cgroup %s", ci.Path)
+	}
+	if ci.TopPrint() != "" {
+		t.Error("nothing to rank without two samples")
+	}
+
+	ci, err = getCgroupStats(ci, serviceFiles("3000000", "4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pretend the samples are 2s apart
+	ci.oldTime = ci.newTime.Add(-2 * time.Second)
+
+	r := rate("db", ci.old, ci.new, ci.elapsed())
+	if r.cpu != 1 || r.io != 2048 {
+		t.Errorf("wrong rates %+v", r)
+	}
+
+	s := ci.InfoPrint()
+	if !strings.Contains(s, "cpu: 1.00/2.00 cores") || !strings.Contains(s, "oom: 2 oom_kill: 1") {
+		t.Errorf("wrong info %q", s)
+	}
+
+	top := strings.Split(ci.TopPrint(), "\n")
+	if !strings.HasPrefix(top[0], "top /system.slice by cpu: db.service 1.00 cron.service") {
+		t.Errorf("wrong cpu ranking %q", top[0])
+	}
+	if !strings.HasPrefix(top[1], "top /system.slice by mem: db.service") {
+		t.Errorf("wrong memory ranking %q", top[1])
+	}
+}
+
+// A cgroup deleted and created again between samples has no rates rather
+// than negative ones
+func TestCgroupRecreated(t *testing.T) {
+	tests := []struct {
+		name   string
+		usage  string
+		rbytes string
+		want   string
+	}{
+		{name: "grew", usage: "3000000", rbytes: "8192", want: "cpu: 2.00/2.00 cores throttled: 0% (0ms)"},
+		{name: "cpu reset", usage: "500", rbytes: "8192", want: "cpu: 0.00/2.00 cores throttled: 0%\t"},
+		{name: "io reset", usage: "3000000", rbytes: "0", want: "cpu: 0.00/2.00 cores throttled: 0%\t"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ci := &CgroupInfo{TopParent: "/system.slice"}
+			ci, err := getCgroupStats(ci, serviceFiles("1000000", "4096"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ci, err = getCgroupStats(ci, serviceFiles(tc.usage, tc.rbytes))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ci.oldTime = ci.newTime.Add(-time.Second)
+			s := ci.InfoPrint()
+			if !strings.Contains(s, tc.want) {
+				t.Errorf("missing %q in %q", tc.want, s)
+			}
+			if out := s + ci.TopPrint(); strings.Contains(out, " -") {
+				t.Errorf("negative rate in %q", out)
+			}
+		})
+	}
+}
+
+func TestOomKills(t *testing.T) {
+	files := serviceFiles("0", "0")
+	files["sys/fs/cgroup/system.slice/memory.events"] = &fstest.MapFile{Data: []byte("oom 5\noom_kill 4\n")}
+	files["sys/fs/cgroup/system.slice/memory.events.local"] = &fstest.MapFile{Data: []byte("oom 0\noom_kill 0\n")}
+	kills, err := getOomKills(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kills) != 2 {
+		t.Errorf("expected the cgroups with memory.events %v", kills)
+	}
+	if kills["/system.slice"] != 0 {
+		t.Errorf("local events should be used %v", kills)
+	}
+	if kills["/system.slice/db.service"] != 1 {
+		t.Errorf("wrong kills %v", kills)
+	}
+}
@@ -0,0 +1,195 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bioe007/synopsys/rootfs"
+)
+
+// How much of the id to show, same as docker ps
+const shortID = 12
+
+// Systemd cgroup driver scopes, e.g. docker-<id>.scope. The conmon scopes
+// podman and cri-o create are the monitor process, not the container, so
+// they're deliberately not matched.
+var scopeRe = regexp.MustCompile(`^(docker|cri-containerd|crio|libpod)-([0-9a-f]{64})\.scope$`)
+
+// cgroupfs driver uses the bare id, cri-o prefixes it
+var bareRe = regexp.MustCompile(`^(?:crio-)?([0-9a-f]{64})$`)
+
+// Kubernetes pod slices, either /kubepods/burstable/pod<uid> or with the
+// systemd driver kubepods-burstable-pod<uid>.slice where - in the uid is
+// replaced with _
+var podRe = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})(?:\.slice)?$`)
+
+var scopeRuntimes = map[string]string{
+	"docker":         "docker",
+	"cri-containerd": "containerd",
+	"crio":           "cri-o",
+	"libpod":         "podman",
+}
+
+// A container identified from a cgroup path
+type Container struct {
+	Runtime string // docker, containerd, cri-o or podman
+	ID      string
+	PodUID  string // only for kubernetes
+	PodName string // only when it could be found
+}
+
+func (c *Container) String() string {
+	s := fmt.Sprintf("%s:%s", c.Runtime, c.ID[:min(shortID, len(c.ID))])
+	if c.PodName != "" {
+		s += " pod:" + c.PodName
+	} else if c.PodUID != "" {
+		s += " pod:" + c.PodUID
+	}
+	return s
+}
+
+// Guess the runtime for a bare id from the cgroups above it
+func bareRuntime(parents []string, crio bool) string {
+	if crio {
+		return "cri-o"
+	}
+	for _, p := range parents {
+		switch {
+		case strings.HasPrefix(p, "docker"):
+			return "docker"
+		case p == "machine.slice" || strings.HasPrefix(p, "libpod"):
+			return "podman"
+		}
+	}
+	return "containerd"
+}
+
+// Identify the container, if any, that a cgroup path belongs to. Returns nil
+// when the path isn't a container. Nested containers resolve to the innermost.
+func FromCgroupPath(p string) *Container {
+	segs := strings.Split(strings.Trim(p, "/"), "/")
+
+	var c *Container
+	i := len(segs) - 1
+	for ; i >= 0 && c == nil; i-- {
+		if m := scopeRe.FindStringSubmatch(segs[i]); m != nil {
+			c = &Container{Runtime: scopeRuntimes[m[1]], ID: m[2]}
+		} else if m := bareRe.FindStringSubmatch(segs[i]); m != nil {
+			crio := strings.HasPrefix(segs[i], "crio-")
+			c = &Container{Runtime: bareRuntime(segs[:i], crio), ID: m[1]}
+		}
+	}
+	if c == nil {
+		return nil
+	}
+
+	// The pod is the nearest parent
+	for ; i >= 0; i-- {
+		if m := podRe.FindStringSubmatch(segs[i]); m != nil {
+			c.PodUID = strings.ReplaceAll(m[1], "_", "-")
+			break
+		}
+	}
+	return c
+}
+
+// The v2 cgroup path of a process. On v1 only hosts use the memory, then
+// cpu, hierarchy since those are where runtimes always place containers.
+func pidCgroup(fsys fs.FS, pid int) (string, error) {
+	b, err := fs.ReadFile(fsys, path.Join("proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+
+	var v1 string
+	for _, line := range strings.Split(string(b), "\n") {
+		// hierarchy-id:controllers:path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			if parts[2] != "/" {
+				return parts[2], nil
+			}
+			continue
+		}
+		for _, ctrl := range strings.Split(parts[1], ",") {
+			if ctrl == "memory" || (ctrl == "cpu" && v1 == "") {
+				v1 = parts[2]
+			}
+		}
+	}
+	return v1, nil
+}
+
+// Kubernetes sets HOSTNAME to the pod name. This needs permission to read the
+// environment of the process, which usually means root.
+func podName(fsys fs.FS, pid int) string {
+	b, err := fs.ReadFile(fsys, path.Join("proc", strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return ""
+	}
+	for _, kv := range bytes.Split(b, []byte{0}) {
+		if v, found := bytes.CutPrefix(kv, []byte("HOSTNAME=")); found {
+			return string(v)
+		}
+	}
+	return ""
+}
+
+// Maps processes to containers. Pod names are looked up once per container
+// since reading the environment of every process each tick is expensive.
+type Resolver struct {
+	fsys  fs.FS
+	names map[string]string // container id to pod name, resolved this sample
+	prev  map[string]string // the sample before, dropped by the next Expire
+}
+
+func NewResolver() *Resolver {
+	return newResolver(rootfs.FS)
+}
+
+func newResolver(fsys fs.FS) *Resolver {
+	return &Resolver{fsys: fsys, names: make(map[string]string)}
+}
+
+// Call once a sample. Pod names that weren't resolved since the last call
+// are forgotten, so short lived containers don't pile up.
+func (r *Resolver) Expire() {
+	r.prev = r.names
+	r.names = make(map[string]string)
+}
+
+// Get the container a process runs in, nil if it isn't in one or has exited
+func (r *Resolver) Resolve(pid int) *Container {
+	p, err := pidCgroup(r.fsys, pid)
+	if err != nil {
+		return nil
+	}
+	c := FromCgroupPath(p)
+	if c == nil || c.PodUID == "" {
+		return c
+	}
+
+	name, ok := r.names[c.ID]
+	if !ok {
+		name, ok = r.prev[c.ID]
+	}
+	if ok {
+		r.names[c.ID] = name
+	} else {
+		name = podName(r.fsys, pid)
+		// don't cache failures, a later process in the pod may be readable
+		if name != "" {
+			r.names[c.ID] = name
+		}
+	}
+	c.PodName = name
+	return c
+}
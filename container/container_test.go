@@ -0,0 +1,140 @@
+package container
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+const (
+	id  = "4b0c3e2f1a9d8c7b6a5f4e3d2c1b0a99887766554433221100ffeeddccbbaa99"
+	uid = "1f2e3d4c-5b6a-4798-8a7b-6c5d4e3f2a1b"
+)
+
+func TestFromCgroupPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		runtime string
+		podUID  string
+	}{
+		{"docker cgroupfs", "/docker/" + id, "docker", ""},
+		{"docker systemd", "/system.slice/docker-" + id + ".scope", "docker", ""},
+		{
+			"containerd kubepods cgroupfs",
+			"/kubepods/besteffort/pod" + uid + "/" + id,
+			"containerd", uid,
+		},
+		{
+			"containerd kubepods systemd",
+			"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1f2e3d4c_5b6a_4798_8a7b_6c5d4e3f2a1b.slice/cri-containerd-" + id + ".scope",
+			"containerd", uid,
+		},
+		{
+			"cri-o systemd",
+			"/kubepods.slice/kubepods-pod1f2e3d4c_5b6a_4798_8a7b_6c5d4e3f2a1b.slice/crio-" + id + ".scope",
+			"cri-o", uid,
+		},
+		{"cri-o cgroupfs", "/kubepods/pod" + uid + "/crio-" + id, "cri-o", uid},
+		{"podman root", "/machine.slice/libpod-" + id + ".scope", "podman", ""},
+		{
+			"podman rootless",
+			"/user.slice/user-1000.slice/user@1000.service/user.slice/libpod-" + id + ".scope/container",
+			"podman", "",
+		},
+		{"podman cgroupfs", "/machine.slice/" + id, "podman", ""},
+		{
+			"docker in kubernetes",
+			"/kubepods/burstable/pod" + uid + "/" + id + "/docker/" + id[:63] + "0",
+			"docker", uid,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := FromCgroupPath(tc.path)
+			if c == nil {
+				t.Fatalf("no container in %s", tc.path)
+			}
+			if c.Runtime != tc.runtime {
+				t.Errorf("got runtime %s, expected %s", c.Runtime, tc.runtime)
+			}
+			if c.PodUID != tc.podUID {
+				t.Errorf("got pod %q, expected %q", c.PodUID, tc.podUID)
+			}
+			if len(c.ID) != 64 {
+				t.Errorf("wrong id %s", c.ID)
+			}
+		})
+	}
+}
+
+func TestFromCgroupPathNotContainer(t *testing.T) {
+	paths := []string{
+		"/",
+		"/user.slice/user-1000.slice/session-2.scope",
+		"/system.slice/containerd.service",
+		"/machine.slice/libpod-conmon-" + id + ".scope",
+		"/kubepods/besteffort/pod" + uid,
+	}
+	for _, p := range paths {
+		if c := FromCgroupPath(p); c != nil {
+			t.Errorf("%s should not be a container, got %s", p, c)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	files := fstest.MapFS{
+		"proc/10/cgroup":  {Data: []byte("0::/kubepods/burstable/pod" + uid + "/" + id + "\n")},
+		"proc/10/environ": {Data: []byte("PATH=/bin\x00HOSTNAME=web-7d4b9c-x2x4z\x00HOME=/\x00")},
+		// v1 only host
+		"proc/20/cgroup": {Data: []byte("5:cpu,cpuacct:/docker/" + id + "\n4:memory:/docker/" + id +
+			"\n1:name=systemd:/docker/" + id + "\n")},
+		"proc/30/cgroup": {Data: []byte("0::/user.slice/user-1000.slice/session-2.scope\n")},
+	}
+	r := newResolver(files)
+
+	c := r.Resolve(10)
+	if c == nil || c.PodName != "web-7d4b9c-x2x4z" {
+		t.Fatalf("pod name not found %+v", c)
+	}
+	if c.String() != "containerd:4b0c3e2f1a9d pod:web-7d4b9c-x2x4z" {
+		t.Errorf("got %s", c)
+	}
+
+	c = r.Resolve(20)
+	if c == nil || c.Runtime != "docker" {
+		t.Errorf("v1 cgroup not resolved %+v", c)
+	}
+	if c := r.Resolve(30); c != nil {
+		t.Errorf("not a container %+v", c)
+	}
+	if c := r.Resolve(40); c != nil {
+		t.Errorf("missing process %+v", c)
+	}
+}
+
+// A pod name is kept while it's being resolved and forgotten a sample after
+// it isn't
+func TestResolverExpire(t *testing.T) {
+	files := fstest.MapFS{
+		"proc/10/cgroup":  {Data: []byte("0::/kubepods/burstable/pod" + uid + "/" + id + "\n")},
+		"proc/10/environ": {Data: []byte("HOSTNAME=web-1\x00")},
+	}
+	r := newResolver(files)
+	r.Resolve(10)
+	files["proc/10/environ"] = &fstest.MapFile{Data: []byte("HOSTNAME=web-2\x00")}
+
+	r.Expire()
+	if c := r.Resolve(10); c.PodName != "web-1" {
+		t.Errorf("expected the cached name, got %s", c.PodName)
+	}
+	r.Expire()
+	r.Expire()
+	if len(r.names) != 0 || len(r.prev) != 0 {
+		t.Errorf("unused names kept %v %v", r.names, r.prev)
+	}
+	if c := r.Resolve(10); c.PodName != "web-2" {
+		t.Errorf("expected the name read again, got %s", c.PodName)
+	}
+}
@@ -4,9 +4,15 @@ import (
 	"bufio"
 	"container/heap"
 	"fmt"
-	"os"
+	"io/fs"
+	"math"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+	"github.com/tklauser/go-sysconf"
 )
 
 // For /proc/stat field order
@@ -44,6 +50,7 @@ type CpuTime struct {
 // Used to store calculated fractional values
 type CpuStat struct {
 	nr         string // cpu number
+	ticks      int    // USER_HZ accounted between the samples
 	user       float32
 	nice       float32
 	sys        float32
@@ -56,51 +63,35 @@ type CpuStat struct {
 	guest_nice float32
 }
 
-// Lines in the /proc/cpuinfo file
-type cpuinfoidx int
-
-const (
-	cinf_processor = iota
-	cinf_vendor_id
-	cinf_cpu_family
-	cinf_model
-	cinf_model_name
-	cinf_stepping
-	cinf_microcode
-	cinf_cpu_mhz
-	cinf_cache_size
-	cinf_physical_id
-	cinf_siblings
-	cinf_core_id
-	cinf_cpu_cores
-	cinf_apicid
-	cinf_initial_apicid
-	cinf_fpu
-	cinf_fpu_exception
-	cinf_cpuid_level
-	cinf_wp
-	cinf_flags
-	cinf_bugs
-	cinf_bogomips
-	cinf_tlb_size
-	cinf_clflush_size
-	cinf_cache_alignment
-	cinf_address_sizes
-	cinf_power_management
-	cinfcinf_power_management
-)
-
 // Holds all cpu information including previous, current counts and estimated values for percent time spent in each.
 type CpuInfo struct {
-	Cores        int
+	Sockets      int
+	Cores        int // physical cores across all sockets
 	Mhz          float64
-	Siblings     int // this is threads
+	Siblings     int // this is threads, the number of logical cpus
+	ModelName    string
+	Topology     map[string]*CpuTopology // keyed like /proc/stat, 'cpuN'
 	Stats        []*CpuTime
 	OldStats     []*CpuTime
+	Freqs        map[string]*CpuFreq
 	calcstats    *calculatedstats
+	byName       map[string]*CpuStat // same stats as calcstats, but not consumed by printing
 	SummaryStats *CpuStat
+	busyCores    float64 // cpu seconds not idle per second, 0 until two samples
+	oldTime      time.Time
+	newTime      time.Time
 }
 
+// USER_HZ, the unit of the /proc/stat times. It's 100 nearly everywhere but
+// nothing promises that.
+var userHZ = func() int64 {
+	hz, err := sysconf.Sysconf(sysconf.SC_CLK_TCK)
+	if err != nil || hz <= 0 {
+		return 100
+	}
+	return hz
+}()
+
 // This will be a heap to quickly get cpu sorted by user time
 type calculatedstats []*CpuStat
 
@@ -123,63 +114,159 @@ func (h *calculatedstats) Pop() any {
 	return x
 }
 
+// guest and guest_nice aren't added, the kernel already counts them in user
+// and nice
 func (cpu *CpuTime) total() int {
-	return cpu.user + cpu.nice + cpu.sys + cpu.idle + cpu.iowait + cpu.irq + cpu.softirq + cpu.steal + cpu.guest + cpu.guest_nice
+	return cpu.user + cpu.nice + cpu.sys + cpu.idle + cpu.iowait + cpu.irq + cpu.softirq + cpu.steal
+}
+
+// The time between two samples. Counters can go backwards, iowait does on
+// tickless kernels, that's taken as no time rather than negative time.
+func (cpu *CpuTime) since(prev *CpuTime) *CpuTime {
+	d := func(cur, prev int) int { return max(cur-prev, 0) }
+	return &CpuTime{
+		nr:         cpu.nr,
+		user:       d(cpu.user, prev.user),
+		nice:       d(cpu.nice, prev.nice),
+		sys:        d(cpu.sys, prev.sys),
+		idle:       d(cpu.idle, prev.idle),
+		iowait:     d(cpu.iowait, prev.iowait),
+		irq:        d(cpu.irq, prev.irq),
+		softirq:    d(cpu.softirq, prev.softirq),
+		steal:      d(cpu.steal, prev.steal),
+		guest:      d(cpu.guest, prev.guest),
+		guest_nice: d(cpu.guest_nice, prev.guest_nice),
+	}
 }
 
 func (cpu *CpuInfo) estimate() {
 	if len(cpu.OldStats) == 0 {
 		return
 	}
-	prev := cpu.OldStats
-	cur := cpu.Stats
+	// cpus go on and offline between samples so they're matched by name,
+	// not by line
+	prevByNr := make(map[string]*CpuTime, len(cpu.OldStats))
+	for _, p := range cpu.OldStats {
+		prevByNr[p.nr] = p
+	}
 
 	cpu.calcstats = new(calculatedstats)
 	heap.Init(cpu.calcstats)
+	cpu.byName = make(map[string]*CpuStat)
 
-	for i := range cur {
+	for _, cur := range cpu.Stats {
+		prev, ok := prevByNr[cur.nr]
+		// just came online, nothing to compare against yet
+		if !ok {
+			continue
+		}
 		c := new(CpuStat)
-		denom := float32(cur[i].total() - prev[i].total())
-		c.nr = cur[i].nr
-		c.user = float32((cur[i].user - prev[i].user)) / denom
-		c.sys = float32((cur[i].sys - prev[i].sys)) / denom
-		c.idle = float32((cur[i].idle - prev[i].idle)) / denom
-		c.iowait = float32((cur[i].iowait - prev[i].iowait)) / denom
-		c.irq = float32((cur[i].irq - prev[i].irq)) / denom
-		c.softirq = float32((cur[i].softirq - prev[i].softirq)) / denom
-		c.steal = float32((cur[i].steal - prev[i].steal)) / denom
-		c.guest = float32((cur[i].guest - prev[i].guest)) / denom
-		c.guest_nice = float32((cur[i].guest_nice - prev[i].guest_nice)) / denom
-		if i == 0 {
+		d := cur.since(prev)
+		ticks := d.total()
+		// sampled faster than the kernel accounts time, everything is zero
+		denom := float32(max(ticks, 1))
+		c.nr = cur.nr
+		c.ticks = ticks
+		c.user = float32(d.user) / denom
+		c.sys = float32(d.sys) / denom
+		c.idle = float32(d.idle) / denom
+		c.iowait = float32(d.iowait) / denom
+		c.irq = float32(d.irq) / denom
+		c.softirq = float32(d.softirq) / denom
+		c.steal = float32(d.steal) / denom
+		c.guest = float32(d.guest) / denom
+		c.guest_nice = float32(d.guest_nice) / denom
+		cpu.byName[c.nr] = c
+		if c.nr == "cpu" {
 			cpu.SummaryStats = c
+			// fractions above are of the time accounted, this is of the
+			// time that actually went by
+			if elapsed := cpu.newTime.Sub(cpu.oldTime).Seconds(); elapsed > 0 {
+				busy := denom - float32(d.idle+d.iowait)
+				cpu.busyCores = float64(busy) / float64(userHZ) / elapsed
+			}
 		} else {
 			heap.Push(cpu.calcstats, c)
 		}
 	}
 }
 
+// Fraction of the last interval a cpu, named like 'cpu3', was busy. Time
+// waiting on IO counts as idle. 'cpu' is all of them.
+func (cpu *CpuInfo) Busy(nr string) (float32, bool) {
+	c, ok := cpu.byName[nr]
+	if !ok || c.ticks == 0 {
+		return 0, false
+	}
+	return 1 - c.idle - c.iowait, true
+}
+
+// Fraction of the last interval a cpu spent in softirq
+func (cpu *CpuInfo) Softirq(nr string) (float32, bool) {
+	c, ok := cpu.byName[nr]
+	if !ok || c.ticks == 0 {
+		return 0, false
+	}
+	return c.softirq, true
+}
+
+// Names of the cpus in the last sample, like 'cpu3', without the 'cpu' total
+func (cpu *CpuInfo) Names() []string {
+	var names []string
+	for _, c := range cpu.Stats {
+		if c.nr != "cpu" {
+			names = append(names, c.nr)
+		}
+	}
+	return names
+}
+
 // TODO - update this to string representation of CpuInfo
 func (cpu *CpuInfo) InfoPrint(num_cpus int) string {
-	// clktck, err := sysconf.Sysconf(sysconf.SC_CLK_TCK)
-	// if err != nil {
-	//	log.Fatal("error getting system clock", err)
-	// }
-	num_cpus = min(cpu.Siblings, num_cpus)
 	if len(cpu.OldStats) == 0 {
 		// TODO: - be smarter than just skipping it the first time through?
 		return "-mt-"
 	}
+	num_cpus = min(cpu.calcstats.Len(), num_cpus)
 
 	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("vc:%d\tf: %.2f\n", cpu.Siblings, cpu.Mhz/1000))
-	sb.WriteString(fmt.Sprintf("CPU: usr:%.2f sys:%.2f: idle:%.2f\n",
+	sb.WriteString(fmt.Sprintf("vc:%d c:%d s:%d\t", cpu.Siblings, cpu.Cores, cpu.Sockets))
+	if fsum := summarizeFreq(cpu.Freqs); fsum != nil {
+		sb.WriteString(fsum.String())
+	} else {
+		sb.WriteString(fmt.Sprintf("f: %.2f", cpu.Mhz/1000))
+	}
+	if cpu.ModelName != "" {
+		sb.WriteString("\t" + cpu.ModelName)
+	}
+	sb.WriteString("\n")
+	sb.WriteString(fmt.Sprintf("CPU: usr:%.2f sys:%.2f: idle:%.2f",
 		cpu.SummaryStats.user, cpu.SummaryStats.sys, cpu.SummaryStats.idle))
-	for i := 0; i < num_cpus; i++ {
-		c := heap.Pop(cpu.calcstats).(*CpuStat)
+	if cpu.busyCores > 0 {
+		sb.WriteString(fmt.Sprintf(" busy: %.2f cores", cpu.busyCores))
+	}
+	sb.WriteString("\n")
+
+	hot := make([]*CpuStat, num_cpus)
+	for i := range hot {
+		hot[i] = heap.Pop(cpu.calcstats).(*CpuStat)
+	}
+	cpu.groupByTopology(hot)
+
+	socket := -1
+	for _, c := range hot {
+		t, hasTopo := cpu.Topology[c.nr]
+		if hasTopo && cpu.Sockets > 1 && t.Socket != socket {
+			socket = t.Socket
+			sb.WriteString(fmt.Sprintf("socket %d:\n", socket))
+		}
+		sb.WriteString(c.nr)
+		if hasTopo {
+			sb.WriteString(fmt.Sprintf(" c%d", t.Core))
+		}
 		sb.WriteString(
 			fmt.Sprintf(
-				"%s: usr:%.2f sys:%.2f: idle:%.2f iowait:%.2f irq:%.2f softirq:%.2f steal:%.2f guest:%.2f gnice:%.2f\n",
-				c.nr,
+				": usr:%.2f sys:%.2f: idle:%.2f iowait:%.2f irq:%.2f softirq:%.2f steal:%.2f guest:%.2f gnice:%.2f",
 				c.user,
 				c.sys,
 				c.idle,
@@ -190,57 +277,72 @@ func (cpu *CpuInfo) InfoPrint(num_cpus int) string {
 				c.guest,
 				c.guest_nice,
 			))
+		if f, ok := cpu.Freqs[c.nr]; ok {
+			sb.WriteString(" " + f.String())
+		}
+		sb.WriteString("\n")
 	}
 	return sb.String()
 }
 
-func get_cpuinfo() (*CpuInfo, error) {
-	f, err := os.Open("/proc/cpuinfo")
+func get_cpuinfo(fsys fs.FS) (*CpuInfo, error) {
+	f, err := fsys.Open("proc/cpuinfo")
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	// f2, err := mmap.Open("/proc/cpuinfo")
-	// if err != nil {
-	//	return nil, err
-	// }
-	// defer f2.Close()
-
-	scanner := bufio.NewScanner(f)
+	blocks, err := parseCpuinfo(f)
+	if err != nil {
+		return nil, err
+	}
 
 	cpuinfo := new(CpuInfo)
-	var line cpuinfoidx
-	line = 0
-
-	for scanner.Scan() {
-		sp := strings.Split(scanner.Text(), ":")
-		for i := range sp {
-			sp[i] = strings.TrimSpace(sp[i])
+	cpuinfo.Topology = make(map[string]*CpuTopology)
+	var mhz float64
+	var nmhz int
+	for _, b := range blocks {
+		if cpuinfo.ModelName == "" {
+			cpuinfo.ModelName = b.model()
 		}
-		switch line {
-		case cinf_siblings:
-			cpuinfo.Siblings, err = strconv.Atoi(sp[1])
-			if err != nil {
-				return nil, err
+		// s390 calls it 'cpu MHz dynamic'
+		for _, k := range []string{"cpu MHz", "cpu MHz dynamic"} {
+			if v, ok := b[k]; ok {
+				m, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return nil, err
+				}
+				mhz += m
+				nmhz++
+				break
 			}
-		case cinf_cpu_mhz:
-			cpuinfo.Mhz, err = strconv.ParseFloat(sp[1], 64)
-			if err != nil {
-				return nil, err
+		}
+
+		for _, id := range b.processors() {
+			t := &CpuTopology{Cpu: id, Core: id}
+			// Only some architectures have these, sysfs can fix it up below
+			if v, err := strconv.Atoi(b["physical id"]); err == nil {
+				t.Socket = v
 			}
-		case cinf_cpu_cores:
-			cpuinfo.Cores, err = strconv.Atoi(sp[1])
-			if err != nil {
-				return nil, err
+			if v, err := strconv.Atoi(b["core id"]); err == nil {
+				t.Core = v
 			}
+			cpuinfo.Topology[fmt.Sprintf("cpu%d", id)] = t
 		}
-		line++
+	}
+	if nmhz > 0 {
+		cpuinfo.Mhz = mhz / float64(nmhz)
+	}
 
-		// unless there is a compelling reason, don't bother with rest of cpuinfo
-		if line > cinf_cpu_cores {
-			break
-		}
+	err = readSysTopology(fsys, cpuinfo.Topology)
+	if err != nil {
+		return nil, err
+	}
+
+	cpuinfo.Siblings = len(cpuinfo.Topology)
+	cpuinfo.Sockets, cpuinfo.Cores = countTopology(cpuinfo.Topology)
+	if cpuinfo.Siblings == 0 {
+		return nil, status.Errorf("proc/cpuinfo", "no processors found in it or sysfs")
 	}
 
 	return cpuinfo, nil
@@ -248,10 +350,10 @@ func get_cpuinfo() (*CpuInfo, error) {
 
 // Get cpunums stats. The -1 value is special and gets the overall stats
 // For every cpunum add an entry to the returned slice of cputimes
-func getCpuTime(numcpu int) ([]*CpuTime, error) {
+func getCpuTime(fsys fs.FS, numcpu int) ([]*CpuTime, error) {
 	// The first line in stat is the overall CPU stats. We should make sure that's always in cpunums
-	pathCpuTime := "/proc/stat"
-	f, err := os.Open(pathCpuTime)
+	pathCpuTime := "proc/stat"
+	f, err := fsys.Open(pathCpuTime)
 	if err != nil {
 		return nil, err
 	}
@@ -264,10 +366,19 @@ func getCpuTime(numcpu int) ([]*CpuTime, error) {
 	line := 0
 	for scanner.Scan() {
 		tsrc := strings.Fields(scanner.Text())
+		// offline cpus are missing so there may be fewer lines than expected
+		if len(tsrc) == 0 || !strings.HasPrefix(tsrc[0], "cpu") {
+			break
+		}
+		// steal came in 2.6.11, guest in 2.6.24 and guest_nice in 2.6.33,
+		// older kernels leave those zero
+		if len(tsrc) <= int(cputIdle) {
+			return nil, status.Errorf(pathCpuTime, "line %d: %d fields", line+1, len(tsrc))
+		}
 		times = append(times, new(CpuTime))
 		var i cputimeidx
 		// TODO: omg there has to be a better way
-		for i = cputNr; i < cputGuest_nice; i++ {
+		for i = cputNr; i <= cputGuest_nice && int(i) < len(tsrc); i++ {
 			switch i {
 			case cputNr:
 				times[line].nr = tsrc[i]
@@ -333,23 +444,58 @@ func getCpuTime(numcpu int) ([]*CpuTime, error) {
 }
 
 func CPUStats(ci *CpuInfo) (*CpuInfo, error) {
+	return getCPUStats(ci, rootfs.FS)
+}
+
+func getCPUStats(ci *CpuInfo, fsys fs.FS) (*CpuInfo, error) {
 	// only update info if it's empty? is it common enough for num cpu etc to
 	// change for this to be checked everytime?
 	var err error
 	// this seems like a bad idea but the norm in golang?
 	// but also it's nonsesne for a real cpuinfo to have zero cores
 	if ci.Cores == 0 {
-		ci, err = get_cpuinfo()
+		ci, err = get_cpuinfo(fsys)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	// everything is read before ci changes, so when something fails the
+	// last good sample is still there to compare the next one against
+	times, err := getCpuTime(fsys, ci.Siblings)
+	if err != nil {
+		return nil, err
+	}
+	freqs, err := getCpuFreq(fsys)
+	if err != nil {
+		return nil, err
+	}
 	ci.OldStats = ci.Stats
-	ci.Stats, err = getCpuTime(ci.Siblings)
+	ci.oldTime = ci.newTime
+	ci.Stats = times
+	ci.newTime = time.Now()
+	ci.Freqs = freqs
+	ci.estimate()
+	return ci, nil
+}
+
+// Only the /proc/stat times, cheap enough to sample many times a second.
+// /proc/cpuinfo, topology and frequencies aren't read, so only Busy, Softirq
+// and Names are any use on the result.
+func TimeStats(ci *CpuInfo) (*CpuInfo, error) {
+	return getTimeStats(ci, rootfs.FS)
+}
+
+func getTimeStats(ci *CpuInfo, fsys fs.FS) (*CpuInfo, error) {
+	// every cpu line, the count of cpus isn't known without cpuinfo
+	times, err := getCpuTime(fsys, math.MaxInt)
 	if err != nil {
 		return nil, err
 	}
+	ci.OldStats = ci.Stats
+	ci.oldTime = ci.newTime
+	ci.Stats = times
+	ci.newTime = time.Now()
 	ci.estimate()
 	return ci, nil
 }
@@ -2,27 +2,529 @@ package cpu
 
 import (
 	"container/heap"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bioe007/synopsys/status"
 )
 
 func TestEstimate(t *testing.T) {
-	t.Error("not implemented")
+	ci := new(CpuInfo)
+	ci.OldStats = []*CpuTime{
+		{nr: "cpu", user: 10, sys: 10, idle: 10},
+		{nr: "cpu0", user: 10, sys: 10, idle: 10},
+	}
+	ci.Stats = []*CpuTime{
+		{nr: "cpu", user: 20, sys: 15, idle: 35, iowait: 10},
+		{nr: "cpu0", user: 20, sys: 15, idle: 35, iowait: 10},
+	}
+	ci.estimate()
+
+	if ci.SummaryStats.nr != "cpu" {
+		t.Errorf("first line should be the summary, got %s", ci.SummaryStats.nr)
+	}
+	if ci.SummaryStats.user != 0.2 || ci.SummaryStats.sys != 0.1 ||
+		ci.SummaryStats.idle != 0.5 || ci.SummaryStats.iowait != 0.2 {
+		t.Errorf("wrong summary %+v", ci.SummaryStats)
+	}
+	if ci.calcstats.Len() != 1 {
+		t.Errorf("expected one cpu, got %d", ci.calcstats.Len())
+	}
+}
+
+// cpu1 goes offline and cpu2 comes online between the samples
+func TestEstimateHotplug(t *testing.T) {
+	ci := new(CpuInfo)
+	ci.OldStats = []*CpuTime{
+		{nr: "cpu", user: 20, idle: 20},
+		{nr: "cpu0", user: 10, idle: 10},
+		{nr: "cpu1", user: 10, idle: 10},
+	}
+	ci.Stats = []*CpuTime{
+		{nr: "cpu", user: 40, idle: 40},
+		{nr: "cpu0", user: 15, idle: 15},
+		{nr: "cpu2", user: 100, idle: 0},
+		{nr: "cpu3", user: 5, idle: 0},
+	}
+	ci.estimate()
+
+	if ci.calcstats.Len() != 1 {
+		t.Fatalf("expected only cpu0 to be estimated, got %d", ci.calcstats.Len())
+	}
+	if c := ci.byName["cpu0"]; c.user != 0.5 || c.idle != 0.5 {
+		t.Errorf("cpu0 compared against the wrong cpu %+v", c)
+	}
+	for _, nr := range []string{"cpu1", "cpu2", "cpu3"} {
+		if _, ok := ci.Busy(nr); ok {
+			t.Errorf("%s has no pair of samples but was estimated", nr)
+		}
+	}
+}
+
+// Busy cores come from the time that passed, not the time accounted
+func TestBusyCores(t *testing.T) {
+	ci := new(CpuInfo)
+	ci.OldStats = []*CpuTime{{nr: "cpu"}}
+	hz := int(userHZ)
+	// 4 cpus for 2s, 3 of them busy
+	ci.Stats = []*CpuTime{{nr: "cpu", user: 5 * hz, sys: hz, idle: 2 * hz}}
+	ci.newTime = time.Now()
+	ci.oldTime = ci.newTime.Add(-2 * time.Second)
+	ci.estimate()
+	if ci.busyCores != 3 {
+		t.Errorf("expected 3 busy cores, got %.2f", ci.busyCores)
+	}
+}
+
+// Sampling faster than USER_HZ can see no time pass at all
+func TestEstimateNoTicks(t *testing.T) {
+	ci := new(CpuInfo)
+	ci.OldStats = []*CpuTime{{nr: "cpu", user: 5, idle: 5}, {nr: "cpu0", user: 5, idle: 5}}
+	ci.Stats = []*CpuTime{{nr: "cpu", user: 5, idle: 5}, {nr: "cpu0", user: 5, idle: 5}}
+	ci.estimate()
+	if _, ok := ci.Busy("cpu0"); ok {
+		t.Error("busy should be unknown without any ticks")
+	}
+	if ci.SummaryStats.idle != 0 || ci.SummaryStats.user != 0 {
+		t.Errorf("expected zeros, got %+v", ci.SummaryStats)
+	}
 }
 
 func TestInfoPrint(t *testing.T) {
-	t.Error("not implemented")
+	ci := new(CpuInfo)
+	ci.Siblings = 2
+	ci.OldStats = []*CpuTime{
+		{nr: "cpu", user: 0, idle: 0},
+		{nr: "cpu0", user: 0, idle: 0},
+		{nr: "cpu1", user: 0, idle: 0},
+	}
+	ci.Stats = []*CpuTime{
+		{nr: "cpu", user: 10, idle: 10},
+		{nr: "cpu0", user: 8, idle: 2},
+		{nr: "cpu1", user: 2, idle: 8},
+	}
+	ci.Freqs = map[string]*CpuFreq{
+		"cpu0": {nr: "cpu0", cur: 1000000, min: 800000, max: 3000000},
+		"cpu1": {nr: "cpu1", cur: 3000000, min: 800000, max: 3000000, coreThrottle: 4},
+	}
+	ci.estimate()
+
+	s := ci.InfoPrint(1)
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected header, summary and one cpu line, got %q", s)
+	}
+	if lines[0] != "vc:2 c:0 s:0\tf: 1.00/2.00/3.00 throttled:4" {
+		t.Errorf("wrong header: %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[2], "cpu0: usr:0.80") {
+		t.Errorf("hottest cpu should be first: %q", lines[2])
+	}
+	if !strings.HasSuffix(lines[2], " f:1.00") {
+		t.Errorf("per cpu frequency missing: %q", lines[2])
+	}
+}
+
+func TestGetCpuFreq(t *testing.T) {
+	FILES := fstest.MapFS{
+		"sys/devices/system/cpu/cpu0/cpufreq/scaling_cur_freq":                {Data: []byte("2400000\n")},
+		"sys/devices/system/cpu/cpu0/cpufreq/scaling_min_freq":                {Data: []byte("800000\n")},
+		"sys/devices/system/cpu/cpu0/cpufreq/scaling_max_freq":                {Data: []byte("3600000\n")},
+		"sys/devices/system/cpu/cpu0/cpufreq/scaling_governor":                {Data: []byte("powersave\n")},
+		"sys/devices/system/cpu/cpu0/thermal_throttle/core_throttle_count":    {Data: []byte("7\n")},
+		"sys/devices/system/cpu/cpu0/thermal_throttle/package_throttle_count": {Data: []byte("9\n")},
+		// no cpufreq at all, like a VM
+		"sys/devices/system/cpu/cpu1/online":   {Data: []byte("1\n")},
+		"sys/devices/system/cpu/cpufreq/boost": {Data: []byte("1\n")},
+	}
+
+	freqs, err := getCpuFreq(FILES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(freqs) != 1 {
+		t.Fatalf("expected only cpu0 to have frequency info, got %d", len(freqs))
+	}
+	f := freqs["cpu0"]
+	if f.cur != 2400000 || f.min != 800000 || f.max != 3600000 {
+		t.Errorf("wrong frequencies %+v", f)
+	}
+	if f.governor != "powersave" {
+		t.Errorf("got governor %q", f.governor)
+	}
+	if f.coreThrottle != 7 || f.packageThrottle != 9 {
+		t.Errorf("wrong throttle counts %+v", f)
+	}
 }
 
+// Limits that can't be read don't lose the cpu or the rest of the section
+func TestGetCpuFreqNoLimits(t *testing.T) {
+	freqs, err := getCpuFreq(fstest.MapFS{
+		"sys/devices/system/cpu/cpu0/cpufreq/scaling_cur_freq": {Data: []byte("2400000\n")},
+		"sys/devices/system/cpu/cpu0/cpufreq/scaling_max_freq": {Data: []byte("3600000\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := freqs["cpu0"]; f == nil || f.cur != 2400000 || f.min != 0 || f.max != 3600000 {
+		t.Errorf("wrong frequencies %+v", f)
+	}
+}
+
+func TestSummarizeFreq(t *testing.T) {
+	tests := []struct {
+		name  string
+		freqs map[string]*CpuFreq
+		want  string
+	}{
+		{"all", map[string]*CpuFreq{
+			"cpu0": {cur: 1000000}, "cpu1": {cur: 3000000},
+		}, "f: 1.00/2.00/3.00"},
+		// a driver that doesn't know reports 0, it isn't the minimum
+		{"unknown", map[string]*CpuFreq{
+			"cpu0": {cur: 0}, "cpu1": {cur: 1000000}, "cpu2": {cur: 3000000},
+		}, "f: 1.00/2.00/3.00"},
+		{"none known", map[string]*CpuFreq{
+			"cpu0": {cur: 0, governor: "performance"},
+		}, "f: 0.00/0.00/0.00 gov:performance"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := summarizeFreq(tc.freqs).String(); got != tc.want {
+				t.Errorf("got %q, expected %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// Two sockets, two cores each with two threads. The sysfs topology doesn't
+// agree with cpuinfo for cpu7 to make sure it's preferred.
+var x86Files = fstest.MapFS{
+	"proc/cpuinfo": {Data: []byte(x86Cpuinfo)},
+	"proc/stat": {Data: []byte(
+		`cpu  40 0 40 320 0 0 0 0 0 0
+cpu0 5 0 5 40 0 0 0 0 0 0
+cpu1 5 0 5 40 0 0 0 0 0 0
+cpu2 5 0 5 40 0 0 0 0 0 0
+cpu3 5 0 5 40 0 0 0 0 0 0
+cpu4 5 0 5 40 0 0 0 0 0 0
+cpu5 5 0 5 40 0 0 0 0 0 0
+cpu6 5 0 5 40 0 0 0 0 0 0
+cpu7 5 0 5 40 0 0 0 0 0 0
+intr 1 2 3
+ctxt 100
+`)},
+	"sys/devices/system/cpu/cpu7/topology/physical_package_id":  {Data: []byte("1\n")},
+	"sys/devices/system/cpu/cpu7/topology/core_id":              {Data: []byte("1\n")},
+	"sys/devices/system/cpu/cpu7/topology/thread_siblings_list": {Data: []byte("3,7\n")},
+	"sys/devices/system/cpu/cpu7/node1/cpulist":                 {Data: []byte("2-3,6-7\n")},
+}
+
+func x86Block(proc, socket, core int) string {
+	return fmt.Sprintf(`processor	: %d
+vendor_id	: GenuineIntel
+model name	: Intel(R) Xeon(R) CPU
+cpu MHz		: 2000.000
+physical id	: %d
+siblings	: 4
+core id		: %d
+cpu cores	: 2
+flags		: fpu vme
+
+`, proc, socket, core)
+}
+
+var x86Cpuinfo = x86Block(0, 0, 0) + x86Block(1, 0, 1) + x86Block(2, 1, 0) +
+	x86Block(3, 1, 1) + x86Block(4, 0, 0) + x86Block(5, 0, 1) + x86Block(6, 1, 0) +
+	x86Block(7, 0, 0)
+
+// arm64 has no model name, socket or core
+const arm64Cpuinfo = `processor	: 0
+BogoMIPS	: 48.00
+Features	: fp asimd evtstrm aes pmull sha1 sha2 crc32 cpuid
+CPU implementer	: 0x41
+CPU architecture: 8
+CPU variant	: 0x0
+CPU part	: 0xd08
+CPU revision	: 3
+
+processor	: 1
+BogoMIPS	: 48.00
+Features	: fp asimd evtstrm aes pmull sha1 sha2 crc32 cpuid
+CPU implementer	: 0x41
+CPU architecture: 8
+CPU variant	: 0x0
+CPU part	: 0xd08
+CPU revision	: 3
+`
+
+const s390Cpuinfo = `vendor_id       : IBM/S390
+# processors    : 2
+bogomips per cpu: 3241.00
+max thread id   : 0
+features	: esan3 zarch stfle msa ldisp eimm dfp edat etf3eh highgprs te vx sie
+processor 0: version = FF,  identification = 0133E8,  machine = 2964
+processor 1: version = FF,  identification = 0133E8,  machine = 2964
+
+cpu number      : 0
+cpu MHz dynamic : 5000
+cpu MHz static  : 5000
+
+cpu number      : 1
+cpu MHz dynamic : 5000
+cpu MHz static  : 5000
+`
+
 func TestGetCPUInfo(t *testing.T) {
-	t.Error("not implemented")
+	ci, err := get_cpuinfo(x86Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Siblings != 8 {
+		t.Errorf("expected 8 threads, got %d", ci.Siblings)
+	}
+	if ci.Sockets != 2 {
+		t.Errorf("expected 2 sockets, got %d", ci.Sockets)
+	}
+	if ci.Cores != 4 {
+		t.Errorf("expected 4 cores, got %d", ci.Cores)
+	}
+	if ci.Mhz != 2000 {
+		t.Errorf("expected 2000 MHz, got %f", ci.Mhz)
+	}
+	if ci.ModelName != "Intel(R) Xeon(R) CPU" {
+		t.Errorf("wrong model name %q", ci.ModelName)
+	}
+	t7 := ci.Topology["cpu7"]
+	if t7.Socket != 1 || t7.Core != 1 || t7.Node != 1 {
+		t.Errorf("sysfs topology not used for cpu7: %+v", t7)
+	}
+	if len(t7.Threads) != 2 || t7.Threads[0] != 3 || t7.Threads[1] != 7 {
+		t.Errorf("wrong thread siblings for cpu7: %v", t7.Threads)
+	}
+	if ci.Topology["cpu6"].Socket != 1 || ci.Topology["cpu6"].Core != 0 {
+		t.Errorf("cpuinfo topology wrong for cpu6: %+v", ci.Topology["cpu6"])
+	}
+}
+
+func TestGetCPUInfoOtherArch(t *testing.T) {
+	tests := []struct {
+		name    string
+		cpuinfo string
+		threads int
+		model   string
+		mhz     float64
+	}{
+		{"arm64", arm64Cpuinfo, 2, "implementer 0x41 part 0xd08", 0},
+		{"s390", s390Cpuinfo, 2, "", 5000},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ci, err := get_cpuinfo(fstest.MapFS{
+				"proc/cpuinfo": {Data: []byte(tc.cpuinfo)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ci.Siblings != tc.threads {
+				t.Errorf("expected %d threads, got %d", tc.threads, ci.Siblings)
+			}
+			if ci.ModelName != tc.model {
+				t.Errorf("expected model %q, got %q", tc.model, ci.ModelName)
+			}
+			if ci.Mhz != tc.mhz {
+				t.Errorf("expected %f MHz, got %f", tc.mhz, ci.Mhz)
+			}
+		})
+	}
+}
+
+func TestParseCpuList(t *testing.T) {
+	cpus, err := ParseCpuList("0-2,5,8-9\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{0, 1, 2, 5, 8, 9}
+	if fmt.Sprint(cpus) != fmt.Sprint(expected) {
+		t.Errorf("got %v, expected %v", cpus, expected)
+	}
+	if _, err := ParseCpuList("0-a"); err == nil {
+		t.Error("should fail on non numeric cpu")
+	}
+}
+
+func TestGroupByTopology(t *testing.T) {
+	ci, err := get_cpuinfo(x86Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hottest first, cpu0 and cpu4 are siblings
+	hot := []*CpuStat{{nr: "cpu0"}, {nr: "cpu2"}, {nr: "cpu4"}, {nr: "cpu1"}}
+	ci.groupByTopology(hot)
+
+	order := ""
+	for _, c := range hot {
+		order += c.nr + " "
+	}
+	if order != "cpu0 cpu4 cpu1 cpu2 " {
+		t.Errorf("wrong grouping: %s", order)
+	}
 }
 
 func TestGetCPUTime(t *testing.T) {
-	t.Error("not implemented")
+	tests := []struct {
+		name   string
+		stat   string
+		numcpu int
+		cpus   int // lines returned, with the summary
+		want   CpuTime
+		bad    bool
+	}{
+		{name: "x86", stat: string(x86Files["proc/stat"].Data), numcpu: 8, cpus: 9,
+			want: CpuTime{nr: "cpu", user: 40, sys: 40, idle: 320}},
+		// more cpus than there are doesn't pick up the other lines
+		{name: "fewer online", stat: string(x86Files["proc/stat"].Data), numcpu: 16, cpus: 9,
+			want: CpuTime{nr: "cpu", user: 40, sys: 40, idle: 320}},
+		{name: "guest_nice", stat: "cpu  1 2 3 4 5 6 7 8 9 10\ncpu0 1 2 3 4 5 6 7 8 9 10\n", numcpu: 1, cpus: 2,
+			want: CpuTime{nr: "cpu", user: 1, nice: 2, sys: 3, idle: 4, iowait: 5, irq: 6, softirq: 7, steal: 8, guest: 9, guest_nice: 10}},
+		// 2.6.24 to 2.6.32 have no guest_nice
+		{name: "no guest_nice", stat: "cpu  1 2 3 4 5 6 7 8 9\n", numcpu: 1, cpus: 1,
+			want: CpuTime{nr: "cpu", user: 1, nice: 2, sys: 3, idle: 4, iowait: 5, irq: 6, softirq: 7, steal: 8, guest: 9}},
+		// 2.6.0 to 2.6.10 have no steal either
+		{name: "2.6.0", stat: "cpu  1 2 3 4 5 6 7\nintr 1\n", numcpu: 1, cpus: 1,
+			want: CpuTime{nr: "cpu", user: 1, nice: 2, sys: 3, idle: 4, iowait: 5, irq: 6, softirq: 7}},
+		{name: "short", stat: "cpu  1 2 3\n", numcpu: 1, bad: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			times, err := getCpuTime(fstest.MapFS{"proc/stat": {Data: []byte(tc.stat)}}, tc.numcpu)
+			var fe *status.FormatError
+			if tc.bad {
+				if !errors.As(err, &fe) {
+					t.Errorf("expected a format error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(times) != tc.cpus {
+				t.Fatalf("expected %d lines, got %d", tc.cpus, len(times))
+			}
+			if *times[0] != tc.want {
+				t.Errorf("got %+v, expected %+v", *times[0], tc.want)
+			}
+		})
+	}
+}
+
+// Counters that go backwards, or are already counted elsewhere, mustn't make
+// the fractions add up to more than one or go negative
+func TestEstimateCounters(t *testing.T) {
+	tests := []struct {
+		name       string
+		prev, cur  CpuTime
+		user, idle float32
+		iowait     float32
+	}{
+		{"plain", CpuTime{user: 10, idle: 10}, CpuTime{user: 20, idle: 20}, 0.5, 0.5, 0},
+		// tickless kernels can report less iowait than last time
+		{"iowait backwards", CpuTime{user: 10, idle: 10, iowait: 50}, CpuTime{user: 20, idle: 20, iowait: 40}, 0.5, 0.5, 0},
+		// guest time is in user already
+		{"guest", CpuTime{user: 10, idle: 10, guest: 5}, CpuTime{user: 20, idle: 20, guest: 15}, 0.5, 0.5, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.prev.nr, tc.cur.nr = "cpu", "cpu"
+			ci := &CpuInfo{OldStats: []*CpuTime{&tc.prev}, Stats: []*CpuTime{&tc.cur}}
+			ci.estimate()
+			c := ci.SummaryStats
+			if c.user != tc.user || c.idle != tc.idle || c.iowait != tc.iowait {
+				t.Errorf("got user %.2f idle %.2f iowait %.2f", c.user, c.idle, c.iowait)
+			}
+		})
+	}
 }
 
 func TestCPUStats(t *testing.T) {
-	t.Error("not implemented")
+	ci, err := getCPUStats(new(CpuInfo), x86Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Siblings != 8 || len(ci.Stats) != 9 {
+		t.Errorf("cpuinfo not set up %d threads %d stats", ci.Siblings, len(ci.Stats))
+	}
+	if s := ci.InfoPrint(8); s != "-mt-" {
+		t.Errorf("first sample has nothing to compare, got %q", s)
+	}
+
+	ci, err = getCPUStats(ci, x86Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ci.OldStats) != 9 || ci.SummaryStats == nil {
+		t.Error("second sample should have estimated stats")
+	}
+}
+
+// A sample that fails in the middle leaves the last good one to compare against
+func TestCPUStatsFailThenSucceed(t *testing.T) {
+	withStat := func(stat string) fstest.MapFS {
+		fsys := fstest.MapFS{}
+		for k, v := range x86Files {
+			fsys[k] = v
+		}
+		fsys["proc/stat"] = &fstest.MapFile{Data: []byte(stat)}
+		return fsys
+	}
+	ci, err := getCPUStats(new(CpuInfo), withStat("cpu  10 0 0 10 0 0 0 0 0 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noStat := withStat("")
+	delete(noStat, "proc/stat")
+	if _, err := getCPUStats(ci, noStat); err == nil {
+		t.Fatal("expected an error without /proc/stat")
+	}
+
+	ci, err = getCPUStats(ci, withStat("cpu  40 0 0 20 0 0 0 0 0 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.SummaryStats.user != 0.75 || ci.SummaryStats.idle != 0.25 {
+		t.Errorf("not compared against the last good sample %+v", ci.SummaryStats)
+	}
+}
+
+// The burst sampler only has /proc/stat to go on. cpu0 is idle and cpu1 is
+// all softirq.
+func TestTimeStats(t *testing.T) {
+	stat := func(softirq int) fstest.MapFS {
+		return fstest.MapFS{"proc/stat": {Data: []byte(fmt.Sprintf(
+			"cpu  0 0 0 %d 0 0 %d 0 0 0\ncpu0 0 0 0 %d 0 0 0 0 0 0\ncpu1 0 0 0 100 0 0 %d 0 0 0\nintr 1\n",
+			200+softirq, softirq, 100+softirq, softirq))}}
+	}
+	ci, err := getTimeStats(new(CpuInfo), stat(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, err = getTimeStats(ci, stat(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := ci.Names(); len(names) != 2 || names[0] != "cpu0" || names[1] != "cpu1" {
+		t.Errorf("wrong names %v", names)
+	}
+	if v, ok := ci.Softirq("cpu1"); !ok || v != 1 {
+		t.Errorf("expected cpu1 all softirq, got %.2f", v)
+	}
+	if v, ok := ci.Busy("cpu"); !ok || v != 0.5 {
+		t.Errorf("expected half busy, got %.2f", v)
+	}
 }
 
 func TestCPUHeapPopEmpty(t *testing.T) {
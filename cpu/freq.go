@@ -0,0 +1,137 @@
+package cpu
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sysfs is rooted at / so paths here are relative to that, fs.FS does not
+// accept a leading slash.
+const sysCpuPath = "sys/devices/system/cpu"
+
+// Frequency and throttle information for a single cpu, from
+// /sys/devices/system/cpu/cpuN/cpufreq and .../thermal_throttle
+type CpuFreq struct {
+	nr       string // cpu name, matches the /proc/stat naming e.g. 'cpu3'
+	cur      int    // current frequency in kHz
+	min      int    // minimum frequency the governor may choose in kHz
+	max      int    // maximum frequency the governor may choose in kHz
+	governor string
+
+	// Not every platform has these, they're left at zero when missing.
+	coreThrottle    int
+	packageThrottle int
+}
+
+// Aggregate of all the per-cpu frequencies
+type freqSummary struct {
+	min       int
+	avg       int
+	max       int
+	governors []string
+	throttle  int
+}
+
+// Read an integer value from a single-value sysfs file
+func readSysInt(fsys fs.FS, p string) (int, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// Get the cpufreq and thermal_throttle values for every cpu listed in sysfs.
+// Missing cpufreq (common in VMs) is not an error, the cpu just won't have an
+// entry. Some drivers, offline cpus and containers can't give the limits,
+// those are left at zero.
+func getCpuFreq(fsys fs.FS) (map[string]*CpuFreq, error) {
+	dirs, err := fs.Glob(fsys, path.Join(sysCpuPath, "cpu[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+
+	freqs := make(map[string]*CpuFreq)
+	for _, d := range dirs {
+		f := new(CpuFreq)
+		f.nr = path.Base(d)
+
+		f.cur, err = readSysInt(fsys, path.Join(d, "cpufreq/scaling_cur_freq"))
+		if err != nil {
+			continue
+		}
+		f.min, _ = readSysInt(fsys, path.Join(d, "cpufreq/scaling_min_freq"))
+		f.max, _ = readSysInt(fsys, path.Join(d, "cpufreq/scaling_max_freq"))
+		gov, err := fs.ReadFile(fsys, path.Join(d, "cpufreq/scaling_governor"))
+		if err == nil {
+			f.governor = strings.TrimSpace(string(gov))
+		}
+
+		// Only intel x86 provides these
+		f.coreThrottle, _ = readSysInt(fsys, path.Join(d, "thermal_throttle/core_throttle_count"))
+		f.packageThrottle, _ = readSysInt(fsys, path.Join(d, "thermal_throttle/package_throttle_count"))
+
+		freqs[f.nr] = f
+	}
+	return freqs, nil
+}
+
+func summarizeFreq(freqs map[string]*CpuFreq) *freqSummary {
+	if len(freqs) == 0 {
+		return nil
+	}
+
+	s := new(freqSummary)
+	govs := make(map[string]bool)
+	total, n := 0, 0
+	for _, f := range freqs {
+		// package throttles are counted on every cpu in the package so only
+		// the core count makes sense to add up.
+		s.throttle += f.coreThrottle
+		if f.governor != "" && !govs[f.governor] {
+			govs[f.governor] = true
+			s.governors = append(s.governors, f.governor)
+		}
+		// some drivers report 0 when they don't know
+		if f.cur == 0 {
+			continue
+		}
+		if n == 0 || f.cur < s.min {
+			s.min = f.cur
+		}
+		s.max = max(s.max, f.cur)
+		total += f.cur
+		n++
+	}
+	if n > 0 {
+		s.avg = total / n
+	}
+	sort.Strings(s.governors)
+	return s
+}
+
+// Header line for frequency, in GHz
+func (s *freqSummary) String() string {
+	str := fmt.Sprintf("f: %.2f/%.2f/%.2f",
+		float64(s.min)/1e6, float64(s.avg)/1e6, float64(s.max)/1e6)
+	if len(s.governors) > 0 {
+		str += " gov:" + strings.Join(s.governors, ",")
+	}
+	if s.throttle > 0 {
+		str += fmt.Sprintf(" throttled:%d", s.throttle)
+	}
+	return str
+}
+
+// Short per-cpu representation, shown alongside the hot cpu lines.
+func (f *CpuFreq) String() string {
+	str := fmt.Sprintf("f:%.2f", float64(f.cur)/1e6)
+	if f.coreThrottle > 0 || f.packageThrottle > 0 {
+		str += fmt.Sprintf(" thr:%d/%d", f.coreThrottle, f.packageThrottle)
+	}
+	return str
+}
@@ -0,0 +1,217 @@
+package cpu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Where a logical cpu sits in the machine.
+type CpuTopology struct {
+	Cpu     int   // logical cpu number, this is 'cpuN' in /proc/stat
+	Socket  int   // physical package id
+	Core    int   // core id, only unique within a socket
+	Node    int   // NUMA node
+	Threads []int // SMT siblings, including this cpu
+}
+
+// A single processor block from /proc/cpuinfo, blocks are separated by an
+// empty line and every line is a 'key : value' pair. The keys and their order
+// depend on the architecture and kernel version.
+type cpuinfoBlock map[string]string
+
+// Keys that might name the processor model, in order of preference.
+// x86, arm32, mips, ppc, s390
+var modelKeys = []string{"model name", "Processor", "cpu model", "cpu", "machine"}
+
+func parseCpuinfo(r io.Reader) ([]cpuinfoBlock, error) {
+	var blocks []cpuinfoBlock
+
+	b := make(cpuinfoBlock)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(b) > 0 {
+				blocks = append(blocks, b)
+				b = make(cpuinfoBlock)
+			}
+			continue
+		}
+		k, v, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		b[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(b) > 0 {
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// Get the logical cpu numbers described by a block. Most architectures have a
+// single 'processor' line per block. s390 instead has one summary block with
+// lines like 'processor 0', and later kernels add per-cpu blocks keyed by
+// 'cpu number'.
+func (b cpuinfoBlock) processors() []int {
+	var ids []int
+	for k, v := range b {
+		var s string
+		switch {
+		case k == "processor" || k == "cpu number":
+			s = v
+		case strings.HasPrefix(k, "processor "):
+			s = strings.TrimPrefix(k, "processor ")
+		default:
+			continue
+		}
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (b cpuinfoBlock) model() string {
+	for _, k := range modelKeys {
+		if v, ok := b[k]; ok && v != "" {
+			return v
+		}
+	}
+	// arm64 only identifies the implementer and part numbers
+	if impl, ok := b["CPU implementer"]; ok {
+		return fmt.Sprintf("implementer %s part %s", impl, b["CPU part"])
+	}
+	return ""
+}
+
+// Parse a kernel cpulist like '0-3,8,10-11' into the cpu numbers it contains.
+func ParseCpuList(s string) ([]int, error) {
+	var cpus []int
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return cpus, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(r, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(hi)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for c := first; c <= last; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
+
+// Fill in, or override, the topology with what sysfs knows. This is more
+// reliable than cpuinfo which doesn't have socket and core ids on every
+// architecture.
+func readSysTopology(fsys fs.FS, topo map[string]*CpuTopology) error {
+	dirs, err := fs.Glob(fsys, path.Join(sysCpuPath, "cpu[0-9]*"))
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		nr := path.Base(d)
+		id, err := strconv.Atoi(strings.TrimPrefix(nr, "cpu"))
+		if err != nil {
+			continue
+		}
+		t, ok := topo[nr]
+		if !ok {
+			t = &CpuTopology{Cpu: id, Core: id}
+			topo[nr] = t
+		}
+
+		if v, err := readSysInt(fsys, path.Join(d, "topology/physical_package_id")); err == nil {
+			t.Socket = v
+		}
+		if v, err := readSysInt(fsys, path.Join(d, "topology/core_id")); err == nil {
+			t.Core = v
+		}
+		if b, err := fs.ReadFile(fsys, path.Join(d, "topology/thread_siblings_list")); err == nil {
+			t.Threads, err = ParseCpuList(string(b))
+			if err != nil {
+				return err
+			}
+		}
+
+		nodes, err := fs.Glob(fsys, path.Join(d, "node[0-9]*"))
+		if err != nil {
+			return err
+		}
+		if len(nodes) > 0 {
+			t.Node, _ = strconv.Atoi(strings.TrimPrefix(path.Base(nodes[0]), "node"))
+		}
+	}
+	return nil
+}
+
+// Count distinct sockets and cores in the topology
+func countTopology(topo map[string]*CpuTopology) (sockets int, cores int) {
+	seenSockets := make(map[int]bool)
+	seenCores := make(map[[2]int]bool)
+	for _, t := range topo {
+		seenSockets[t.Socket] = true
+		seenCores[[2]int{t.Socket, t.Core}] = true
+	}
+	return len(seenSockets), len(seenCores)
+}
+
+// Reorder cpus, which are sorted hottest first, so that SMT siblings are next
+// to each other and cpus on the same socket are together. Sockets and cores
+// keep the position of their hottest cpu.
+func (cpu *CpuInfo) groupByTopology(stats []*CpuStat) {
+	socketRank := make(map[int]int)
+	coreRank := make(map[[2]int]int)
+	heat := make(map[string]int)
+	for i, c := range stats {
+		heat[c.nr] = i
+		t, ok := cpu.Topology[c.nr]
+		if !ok {
+			continue
+		}
+		if _, ok := socketRank[t.Socket]; !ok {
+			socketRank[t.Socket] = i
+		}
+		if _, ok := coreRank[[2]int{t.Socket, t.Core}]; !ok {
+			coreRank[[2]int{t.Socket, t.Core}] = i
+		}
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		ti, iok := cpu.Topology[stats[i].nr]
+		tj, jok := cpu.Topology[stats[j].nr]
+		if !iok || !jok {
+			return heat[stats[i].nr] < heat[stats[j].nr]
+		}
+		if ti.Socket != tj.Socket {
+			return socketRank[ti.Socket] < socketRank[tj.Socket]
+		}
+		if ti.Core != tj.Core {
+			return coreRank[[2]int{ti.Socket, ti.Core}] < coreRank[[2]int{tj.Socket, tj.Core}]
+		}
+		return heat[stats[i].nr] < heat[stats[j].nr]
+	})
+}
@@ -0,0 +1,193 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bioe007/synopsys/status"
+)
+
+const sysBlock = "sys/block"
+
+// Queue settings and health of a disk from sysfs. Anything the device
+// doesn't expose is left empty, or -1 for the counters.
+type detail struct {
+	scheduler  string // the one in use
+	nrRequests int
+	rotational bool
+	writeCache string
+	discard    bool
+
+	// scsi error count, not on virtio or nvme
+	ioerr      int
+	ioerrDelta int
+
+	nvme  bool
+	state string // of the scsi device or nvme controller
+	temp  int    // nvme millidegrees, -1 when not known
+
+	err error // why the rest couldn't be read
+}
+
+func readTrimmed(fsys fs.FS, p string) (string, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Read a number, in decimal or with a 0x prefix like ioerr_cnt. A missing
+// file is -1.
+func readNumber(fsys fs.FS, p string) (int, error) {
+	s, err := readTrimmed(fsys, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, status.Errorf(p, "%w", err)
+	}
+	return int(v), nil
+}
+
+// The scheduler file lists them all with the one in use in brackets, or is
+// just 'none' for devices without a choice
+func parseScheduler(s string) string {
+	for _, f := range strings.Fields(s) {
+		if strings.HasPrefix(f, "[") && strings.HasSuffix(f, "]") {
+			return strings.Trim(f, "[]")
+		}
+	}
+	return s
+}
+
+func readDetail(fsys fs.FS, name string) (*detail, error) {
+	dir := path.Join(sysBlock, name)
+	d := new(detail)
+	sched, err := readTrimmed(fsys, path.Join(dir, "queue/scheduler"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	d.scheduler = parseScheduler(sched)
+	if d.nrRequests, err = readNumber(fsys, path.Join(dir, "queue/nr_requests")); err != nil {
+		return nil, err
+	}
+	rot, err := readNumber(fsys, path.Join(dir, "queue/rotational"))
+	if err != nil {
+		return nil, err
+	}
+	d.rotational = rot == 1
+	d.writeCache, _ = readTrimmed(fsys, path.Join(dir, "queue/write_cache"))
+	discard, err := readNumber(fsys, path.Join(dir, "queue/discard_max_bytes"))
+	if err != nil {
+		return nil, err
+	}
+	d.discard = discard > 0
+
+	if d.ioerr, err = readNumber(fsys, path.Join(dir, "device/ioerr_cnt")); err != nil {
+		return nil, err
+	}
+
+	// device is the controller for nvme namespaces
+	d.state, _ = readTrimmed(fsys, path.Join(dir, "device/state"))
+	d.nvme = strings.HasPrefix(name, "nvme")
+	d.temp = -1
+	if d.nvme {
+		temps, _ := fs.Glob(fsys, path.Join(dir, "device/hwmon*/temp1_input"))
+		if len(temps) > 0 {
+			if d.temp, err = readNumber(fsys, temps[0]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// Read the detail of every disk in the last sample, error counts are compared
+// against the previous details. A disk whose detail can't be read shows why
+// next to its iostat line, the other disks aren't affected.
+func (disks *DiskInfo) readDetails(fsys fs.FS) {
+	details := make(map[string]*detail)
+	for _, name := range disks.Names() {
+		old, hasOld := disks.details[name]
+		d, err := readDetail(fsys, name)
+		if err != nil {
+			d = &detail{err: err, ioerr: -1}
+			// keep the count to compare the next good read against
+			if hasOld {
+				d.ioerr = old.ioerr
+			}
+			details[name] = d
+			continue
+		}
+		if hasOld && old.ioerr >= 0 && d.ioerr >= 0 {
+			d.ioerrDelta = d.ioerr - old.ioerr
+		}
+		details[name] = d
+	}
+	disks.details = details
+}
+
+// Devices that aren't up, or schedulers that are usually a mistake for the
+// kind of disk
+func (d *detail) warning() string {
+	switch {
+	case d.state != "" && d.state != "running" && d.state != "live":
+		return "WARNING state " + d.state
+	case d.rotational && d.scheduler == "none":
+		return "WARNING no scheduler on a rotational disk"
+	case d.nvme && d.scheduler == "bfq":
+		return "WARNING bfq on nvme"
+	}
+	return ""
+}
+
+func (d *detail) String() string {
+	if d.err != nil {
+		return "  detail unavailable: " + status.Reason(d.err)
+	}
+	var sb strings.Builder
+	if d.scheduler != "" {
+		sb.WriteString("  sched: " + d.scheduler)
+	} else {
+		sb.WriteString("  sched: -")
+	}
+	if d.nrRequests >= 0 {
+		sb.WriteString(fmt.Sprintf(" nr_requests: %d", d.nrRequests))
+	}
+	if d.rotational {
+		sb.WriteString(" rotational")
+	} else {
+		sb.WriteString(" ssd")
+	}
+	if d.writeCache != "" {
+		sb.WriteString(" cache: " + d.writeCache)
+	}
+	if d.discard {
+		sb.WriteString(" discard")
+	}
+	if d.ioerr >= 0 {
+		sb.WriteString(fmt.Sprintf(" ioerr: %d", d.ioerr))
+		if d.ioerrDelta > 0 {
+			sb.WriteString(fmt.Sprintf(" ERRORS +%d", d.ioerrDelta))
+		}
+	}
+	if d.state != "" {
+		sb.WriteString(" state: " + d.state)
+	}
+	if d.temp >= 0 {
+		sb.WriteString(fmt.Sprintf(" temp: %.0fC", float64(d.temp)/1000))
+	}
+	if w := d.warning(); w != "" {
+		sb.WriteString(" " + w)
+	}
+	return sb.String()
+}
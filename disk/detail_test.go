@@ -0,0 +1,111 @@
+package disk
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bioe007/synopsys/status"
+)
+
+func detailFiles(ioerr string) fstest.MapFS {
+	return fstest.MapFS{
+		"sys/block/sda/queue/scheduler":         {Data: []byte("[none] mq-deadline\n")},
+		"sys/block/sda/queue/nr_requests":       {Data: []byte("64\n")},
+		"sys/block/sda/queue/rotational":        {Data: []byte("1\n")},
+		"sys/block/sda/queue/write_cache":       {Data: []byte("write back\n")},
+		"sys/block/sda/queue/discard_max_bytes": {Data: []byte("0\n")},
+		"sys/block/sda/device/ioerr_cnt":        {Data: []byte(ioerr + "\n")},
+		"sys/block/sda/device/state":            {Data: []byte("running\n")},
+
+		"sys/block/nvme0n1/queue/scheduler":           {Data: []byte("none\n")},
+		"sys/block/nvme0n1/queue/nr_requests":         {Data: []byte("1023\n")},
+		"sys/block/nvme0n1/queue/rotational":          {Data: []byte("0\n")},
+		"sys/block/nvme0n1/queue/write_cache":         {Data: []byte("write through\n")},
+		"sys/block/nvme0n1/queue/discard_max_bytes":   {Data: []byte("2199023255040\n")},
+		"sys/block/nvme0n1/device/state":              {Data: []byte("live\n")},
+		"sys/block/nvme0n1/device/hwmon3/temp1_input": {Data: []byte("38850\n")},
+	}
+}
+
+func detailDisks() *DiskInfo {
+	return &DiskInfo{new: []*diskStat{{devname: "sda"}, {devname: "nvme0n1"}}}
+}
+
+func TestReadDetails(t *testing.T) {
+	di := detailDisks()
+	di.readDetails(detailFiles("0x1"))
+	sda := di.details["sda"]
+	if sda.scheduler != "none" || sda.nrRequests != 64 || !sda.rotational || sda.discard || sda.ioerr != 1 {
+		t.Errorf("wrong sda %+v", sda)
+	}
+	nvme := di.details["nvme0n1"]
+	if nvme.scheduler != "none" || nvme.rotational || !nvme.discard || nvme.ioerr != -1 || nvme.temp != 38850 {
+		t.Errorf("wrong nvme0n1 %+v", nvme)
+	}
+
+	// errors since the last look
+	di.readDetails(detailFiles("0x3"))
+	if d := di.details["sda"]; d.ioerr != 3 || d.ioerrDelta != 2 {
+		t.Errorf("expected 2 new errors, got %+v", d)
+	}
+}
+
+func TestDetailInfoPrint(t *testing.T) {
+	di := detailDisks()
+	di.old = di.new
+	di.newTime = time.Now()
+	di.oldTime = di.newTime.Add(-time.Second)
+	// one new error since a sample that had none
+	di.details = map[string]*detail{"sda": new(detail)}
+	di.readDetails(detailFiles("0x1"))
+	di.estimate()
+
+	out := di.InfoPrint(2)
+	for _, want := range []string{
+		"  sched: none nr_requests: 64 rotational cache: write back ioerr: 1 ERRORS +1 state: running WARNING no scheduler on a rotational disk\n",
+		"  sched: none nr_requests: 1023 ssd cache: write through discard state: live temp: 39C\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestParseScheduler(t *testing.T) {
+	for in, want := range map[string]string{
+		"none [mq-deadline] kyber bfq": "mq-deadline",
+		"[none] mq-deadline":           "none",
+		"none":                         "none",
+		"":                             "",
+	} {
+		if got := parseScheduler(in); got != want {
+			t.Errorf("%q: got %q, expected %q", in, got, want)
+		}
+	}
+}
+
+// A disk whose detail can't be read shows why, the others carry on
+func TestReadDetailsBadValue(t *testing.T) {
+	di := detailDisks()
+	di.readDetails(detailFiles("0x1"))
+	di.readDetails(detailFiles("lots"))
+	var fe *status.FormatError
+	if sda := di.details["sda"]; !errors.As(sda.err, &fe) {
+		t.Errorf("expected a format error, got %v", sda.err)
+	}
+	if nvme := di.details["nvme0n1"]; nvme.err != nil || nvme.temp != 38850 {
+		t.Errorf("nvme0n1 should still be read %+v", nvme)
+	}
+	if s := di.details["sda"].String(); !strings.HasPrefix(s, "  detail unavailable: unexpected format sys/block/sda/device/ioerr_cnt") {
+		t.Errorf("got %q", s)
+	}
+
+	// the count from before the bad read is still the baseline
+	di.readDetails(detailFiles("0x2"))
+	if d := di.details["sda"]; d.ioerrDelta != 1 {
+		t.Errorf("expected 1 new error, got %+v", d)
+	}
+}
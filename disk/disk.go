@@ -5,10 +5,12 @@ import (
 	"container/heap"
 	"fmt"
 	"io/fs"
-	"log"
-	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
 )
 
 // TODO Yes, this code/comment mix is fugly.. right now it's just easier to keep
@@ -95,9 +97,16 @@ func (h *diskHeap) Pop() any {
 }
 
 type DiskInfo struct {
-	old    []*diskStat
-	new    []*diskStat
-	values *diskHeap
+	// Also read queue settings and error counts from sysfs
+	Detail bool
+
+	old     []*diskStat
+	new     []*diskStat
+	oldTime time.Time
+	newTime time.Time
+	values  *diskHeap
+	byName  map[string]*statValues // same as values, but not consumed by printing
+	details map[string]*detail
 }
 
 type dsfields int
@@ -125,52 +134,66 @@ const (
 	DSFMS_SPENT_FLUSHING
 )
 
-const diskstats = "/proc/diskstats"
-
-func getDiskStatPath() string {
-	return diskstats
-}
+const diskstatsPath = "proc/diskstats"
 
+// Turn the counters into per-second rates over the time actually between the
+// samples, the ticker can be late when the box is struggling.
 func (disks *DiskInfo) estimate() {
 	if len(disks.old) == 0 {
 		return
 	}
+	elapsed := float32(disks.newTime.Sub(disks.oldTime).Seconds())
+	if elapsed <= 0 {
+		return
+	}
 
-	prev := disks.old
-	cur := disks.new
+	// a counter going backwards is a reset, nothing to compare against
+	rate := func(cur, prev int) float32 {
+		if cur < prev {
+			return 0
+		}
+		return float32(cur-prev) / elapsed
+	}
 
 	disks.values = new(diskHeap)
 	heap.Init(disks.values)
+	disks.byName = make(map[string]*statValues)
 
-	for i := range cur {
+	prevByName := make(map[string]*diskStat, len(disks.old))
+	for _, p := range disks.old {
+		prevByName[p.devname] = p
+	}
+	for _, c := range disks.new {
+		p, ok := prevByName[c.devname]
+		// added since the last sample, or reset like an nvme controller
+		// reset or a dm table reload
+		if !ok || c.num_reads_completed < p.num_reads_completed || c.num_writes_completed < p.num_writes_completed {
+			continue
+		}
 		d := new(statValues)
-		d.devname = cur[i].devname
-		d.major = float32(cur[i].major)
-		d.minor = float32(cur[i].minor)
-		d.num_reads_completed = float32(cur[i].num_reads_completed - prev[i].num_reads_completed)
-		d.num_reads_merged = float32(cur[i].num_reads_merged - prev[i].num_reads_merged)
-		d.num_sectors_read = float32(cur[i].num_sectors_read - prev[i].num_sectors_read)
-		d.ms_reading = float32(cur[i].ms_reading - prev[i].ms_reading)
-		d.num_writes_completed = float32(cur[i].num_writes_completed - prev[i].num_writes_completed)
-		d.num_writes_merged = float32(cur[i].num_writes_merged - prev[i].num_writes_merged)
-		d.num_sectors_written = float32(cur[i].num_sectors_written - prev[i].num_sectors_written)
-		d.ms_writing = float32(cur[i].ms_writing - prev[i].ms_writing)
-		d.num_io_in_progress = float32(cur[i].num_io_in_progress - prev[i].num_io_in_progress)
-		d.ms_doing_io = float32(cur[i].ms_doing_io - prev[i].ms_doing_io)
-		d.ms_doing_io_weighted = float32(cur[i].ms_doing_io_weighted - prev[i].ms_doing_io_weighted)
-		d.num_discards_completed = float32(
-			cur[i].num_discards_completed - prev[i].num_discards_completed,
-		)
-		d.num_discards_merged = float32(cur[i].num_discards_merged - prev[i].num_discards_merged)
-		d.num_sectors_discarded = float32(
-			cur[i].num_sectors_discarded - prev[i].num_sectors_discarded,
-		)
-		d.ms_spent_discarding = float32(cur[i].ms_spent_discarding - prev[i].ms_spent_discarding)
-		d.num_flush_requests_completed = float32(
-			cur[i].num_flush_requests_completed - prev[i].num_flush_requests_completed,
-		)
-		d.ms_spent_flushing = float32(cur[i].ms_spent_flushing - prev[i].ms_spent_flushing)
+		d.devname = c.devname
+		d.major = float32(c.major)
+		d.minor = float32(c.minor)
+		d.num_reads_completed = rate(c.num_reads_completed, p.num_reads_completed)
+		d.num_reads_merged = rate(c.num_reads_merged, p.num_reads_merged)
+		d.num_sectors_read = rate(c.num_sectors_read, p.num_sectors_read)
+		d.ms_reading = rate(c.ms_reading, p.ms_reading)
+		d.num_writes_completed = rate(c.num_writes_completed, p.num_writes_completed)
+		d.num_writes_merged = rate(c.num_writes_merged, p.num_writes_merged)
+		d.num_sectors_written = rate(c.num_sectors_written, p.num_sectors_written)
+		d.ms_writing = rate(c.ms_writing, p.ms_writing)
+		// a gauge, not a counter
+		d.num_io_in_progress = float32(c.num_io_in_progress)
+		d.ms_doing_io = rate(c.ms_doing_io, p.ms_doing_io)
+		d.ms_doing_io_weighted = rate(c.ms_doing_io_weighted, p.ms_doing_io_weighted)
+		d.num_discards_completed = rate(c.num_discards_completed, p.num_discards_completed)
+		d.num_discards_merged = rate(c.num_discards_merged, p.num_discards_merged)
+		d.num_sectors_discarded = rate(c.num_sectors_discarded, p.num_sectors_discarded)
+		d.ms_spent_discarding = rate(c.ms_spent_discarding, p.ms_spent_discarding)
+		d.num_flush_requests_completed = rate(c.num_flush_requests_completed, p.num_flush_requests_completed)
+		d.ms_spent_flushing = rate(c.ms_spent_flushing, p.ms_spent_flushing)
 		heap.Push(disks.values, d)
+		disks.byName[d.devname] = d
 	}
 }
 
@@ -178,10 +201,16 @@ func diskparse(s string) (*diskStat, error) {
 	ds := new(diskStat)
 
 	fields := strings.Fields(s)
+	// Discards were added in 4.18 and flushes in 5.5, older kernels leave
+	// those zero.
+	if len(fields) <= int(DSFMS_DOING_IO_WEIGHTED) {
+		return nil, fmt.Errorf("%d fields", len(fields))
+	}
+	last := min(dsfields(len(fields)-1), DSFMS_SPENT_FLUSHING)
 
 	var fieldnum dsfields
 	var err error
-	for fieldnum = DSFMAJOR; fieldnum < DSFMS_SPENT_FLUSHING+1; fieldnum++ {
+	for fieldnum = DSFMAJOR; fieldnum <= last; fieldnum++ {
 		switch fieldnum {
 		case DSFMAJOR:
 			ds.major, err = strconv.Atoi(fields[fieldnum])
@@ -286,65 +315,88 @@ func diskparse(s string) (*diskStat, error) {
 	return ds, nil
 }
 
-// Store list of disks we want to report on, it should be populated the first
-// time anything checks if a disk exists.
-var reportableDisks []string
-
+// The disks to report on, by default everything in /sys/block so partitions
+// are skipped. It's read every sample so hot plugged disks show up.
+// Containers often don't have /sys/block, that's an error rather than
+// guessing from the names.
 // TODO: Add some ability to configure the reportable disks
-func setupReportableDisks(disks []fs.DirEntry) {
-	for _, disk := range disks {
-		reportableDisks = append(reportableDisks, disk.Name())
-	}
-}
-
-// Determine if the disk is one we want to report on or not. By default skips
-// all partitions.
-func isDisk(s string) bool {
-	if len(reportableDisks) == 0 {
-		f, err := os.ReadDir("/sys/block")
-		if err != nil {
-			log.Fatal("Can't configure disks", err)
-		}
-		setupReportableDisks(f)
+func readDiskNames(fsys fs.FS) (map[string]bool, error) {
+	entries, err := fs.ReadDir(fsys, "sys/block")
+	if err != nil {
+		return nil, err
 	}
-	for _, v := range reportableDisks {
-		if s == v {
-			return true
-		}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
 	}
-	return false
+	return names, nil
 }
 
 // Get a diskinfo and update it with new stats
 func DiskStats(di *DiskInfo) (*DiskInfo, error) {
-	f, err := os.Open(getDiskStatPath())
+	di, err := getDiskStats(di, rootfs.FS)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	return getDiskStats(di, f)
+	if di.Detail {
+		di.readDetails(rootfs.FS)
+	}
+	return di, nil
 }
 
-func getDiskStats(di *DiskInfo, f fs.File) (*DiskInfo, error) {
+func getDiskStats(di *DiskInfo, fsys fs.FS) (*DiskInfo, error) {
+	f, err := fsys.Open(diskstatsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := readDiskNames(fsys)
+	if err != nil {
+		return nil, err
+	}
 	var ds []*diskStat
 
-	di.old = di.new
 	scanner := bufio.NewScanner(f)
 	for linenum := 0; scanner.Scan(); linenum++ {
 		line := scanner.Text()
 		curdisk, err := diskparse(line)
 		if err != nil {
-			return nil, err
+			return nil, status.Errorf(diskstatsPath, "line %d: %w", linenum+1, err)
 		}
-		if isDisk(curdisk.devname) {
+		if names[curdisk.devname] {
 			ds = append(ds, curdisk)
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	di.old = di.new
 	di.new = ds
+	di.oldTime = di.newTime
+	di.newTime = time.Now()
 	di.estimate()
 	return di, nil
 }
 
+// Names of the disks in the last sample
+func (disks *DiskInfo) Names() []string {
+	names := make([]string, len(disks.new))
+	for i, d := range disks.new {
+		names[i] = d.devname
+	}
+	return names
+}
+
+// Fraction of the last interval a disk was busy, and how many requests it had
+// in flight at the end of it
+func (disks *DiskInfo) Busy(name string) (util float32, inflight float32, ok bool) {
+	d, ok := disks.byName[name]
+	if !ok {
+		return 0, 0, false
+	}
+	return d.ms_doing_io / 1000, d.num_io_in_progress, true
+}
+
 func (disks *DiskInfo) InfoPrint(num_disks int) string {
 	if len(disks.old) == 0 {
 		return ""
@@ -360,7 +412,7 @@ func (disks *DiskInfo) InfoPrint(num_disks int) string {
 	for i := 0; i < disk_limit; i++ {
 		disk := heap.Pop(disks.values).(*statValues)
 		sb.WriteString(
-			fmt.Sprintf("%s wc: %.0f\t sw: %.0f\t rc: %.0f\tsr: %.0f\n",
+			fmt.Sprintf("%s w/s: %.0f\t wKB/s: %.0f\t r/s: %.0f\trKB/s: %.0f\tutil: %.0f%%\n",
 				disk.devname,
 				disk.num_writes_completed,
 				// FIXME - 'magic' number here converting sectors to KB, only
@@ -369,7 +421,12 @@ func (disks *DiskInfo) InfoPrint(num_disks int) string {
 				disk.num_reads_completed,
 				// FIXME - 'magic' number here converting sectors to KB
 				disk.num_sectors_read/2,
+				// ms busy per second
+				disk.ms_doing_io/10,
 			))
+		if d, ok := disks.details[disk.devname]; ok {
+			sb.WriteString(d.String() + "\n")
+		}
 	}
 
 	return sb.String()
@@ -1,11 +1,13 @@
 package disk
 
 import (
+	"errors"
 	"io"
 	"io/fs"
 	"os"
 	"testing"
 	"testing/fstest"
+	"time"
 )
 
 // var fs filesystem = osFS{}
@@ -50,11 +52,13 @@ func TestInfoPrint(t *testing.T) {
 	di.new[1] = &onedisk
 	di.old[0] = &zerodisk
 	di.old[1] = &zerodisk
+	di.newTime = time.Now()
+	di.oldTime = di.newTime.Add(-time.Second)
 	di.estimate()
 
 	s := di.InfoPrint(1)
 	// if s != "dev 1" {
-	if s != "dev wc: 1\t sw: 0\t rc: 1\tsr: 0\n" {
+	if s != "dev w/s: 1\t wKB/s: 0\t r/s: 1\trKB/s: 0\tutil: 0%\n" {
 		t.Errorf("infoprint failed %s != dev 1", s)
 	}
 }
@@ -71,6 +75,8 @@ func TestDiskEstimateUnity(t *testing.T) {
 	di.old = make([]*diskStat, 1)
 	di.new[0] = &onedisk
 	di.old[0] = &zerodisk
+	di.newTime = time.Now()
+	di.oldTime = di.newTime.Add(-time.Second)
 
 	di.estimate()
 	if di.values.Len() != 1 {
@@ -201,6 +207,84 @@ func TestDiskEstimateUnity(t *testing.T) {
 	}
 }
 
+// Rates are per second whatever the interval
+func TestDiskEstimateRate(t *testing.T) {
+	di := &DiskInfo{
+		old: []*diskStat{{devname: "sda", num_writes_completed: 100, num_sectors_written: 1000, ms_doing_io: 0}},
+		new: []*diskStat{{devname: "sda", num_writes_completed: 600, num_sectors_written: 5000, ms_doing_io: 1250, num_io_in_progress: 7}},
+	}
+	di.newTime = time.Now()
+	di.oldTime = di.newTime.Add(-2500 * time.Millisecond)
+	di.estimate()
+
+	v := di.values.Pop().(*statValues)
+	if v.num_writes_completed != 200 || v.num_sectors_written != 1600 || v.num_io_in_progress != 7 {
+		t.Errorf("wrong rates %+v", v)
+	}
+	if v.ms_doing_io != 500 {
+		t.Errorf("busy ms per second got %.0f", v.ms_doing_io)
+	}
+
+	di.oldTime = di.newTime
+	di.values = nil
+	di.estimate()
+	if di.values != nil {
+		t.Error("no time between samples should give no rates")
+	}
+}
+
+func TestDiskEstimateChanging(t *testing.T) {
+	disk := func(name string, reads, flushMs int) *diskStat {
+		return &diskStat{devname: name, num_reads_completed: reads, ms_spent_flushing: flushMs}
+	}
+	tests := []struct {
+		name  string
+		old   []*diskStat
+		new   []*diskStat
+		reads map[string]float32
+	}{
+		// sdc takes sdb's place in the list but not its counters
+		{name: "removed",
+			old:   []*diskStat{disk("sda", 10, 0), disk("sdb", 1000, 0), disk("sdc", 50, 0)},
+			new:   []*diskStat{disk("sda", 20, 0), disk("sdc", 60, 0)},
+			reads: map[string]float32{"sda": 10, "sdc": 10}},
+		{name: "added",
+			old:   []*diskStat{disk("sda", 10, 0)},
+			new:   []*diskStat{disk("sda", 20, 0), disk("sdb", 500, 0)},
+			reads: map[string]float32{"sda": 10}},
+		{name: "reset",
+			old:   []*diskStat{disk("sda", 10, 0), disk("nvme0n1", 9000, 0)},
+			new:   []*diskStat{disk("sda", 20, 0), disk("nvme0n1", 5, 0)},
+			reads: map[string]float32{"sda": 10}},
+		// one counter going backwards doesn't give a negative rate
+		{name: "one counter back",
+			old:   []*diskStat{disk("sda", 10, 100)},
+			new:   []*diskStat{disk("sda", 20, 50)},
+			reads: map[string]float32{"sda": 10}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			di := &DiskInfo{old: tc.old, new: tc.new}
+			di.newTime = time.Now()
+			di.oldTime = di.newTime.Add(-time.Second)
+			di.estimate()
+			if len(di.byName) != len(tc.reads) {
+				t.Errorf("got %d disks, expected %d", len(di.byName), len(tc.reads))
+			}
+			for name, want := range tc.reads {
+				v, ok := di.byName[name]
+				if !ok {
+					t.Errorf("missing %s", name)
+					continue
+				}
+				if v.num_reads_completed != want || v.ms_spent_flushing < 0 {
+					t.Errorf("%s got %.0f reads/s %.0f flush ms, expected %.0f", name, v.num_reads_completed, v.ms_spent_flushing, want)
+				}
+			}
+		})
+	}
+}
+
 // Tests a single disk can be parsed
 func TestDiskParse(t *testing.T) {
 	s := "1       2 sda 3 4 5 6 7 8 9 10 11 12  13 14 15 16 17 18 19"
@@ -278,31 +362,52 @@ func TestDiskParseFailsNonNumeric(t *testing.T) {
 	}
 }
 
-func TestIsDisk(t *testing.T) {
-	FILES := fstest.MapFS{
-		"diskstats": {
-			Data: []byte(
-				`0 0 dev0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0
-                 1 1 dev1 1 1 1 1 1 1 1 1 1 1 1 1 1 1 1 1 1`),
-		},
-		"sys/block": {
-			Mode: fs.ModeDir,
-		},
-		"sys/block/dev0": {
-			Data: []byte(""),
-		},
-		"sys/block/dev1": {
-			Data: []byte(""),
-		},
+// Kernels before 4.18 don't have the discard and flush fields
+func TestDiskParseOldKernel(t *testing.T) {
+	ds, err := diskparse("8 0 sda 3 4 5 6 7 8 9 10 11 12 13")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.ms_doing_io_weighted != 13 || ds.num_discards_completed != 0 {
+		t.Errorf("got %+v", ds)
+	}
+	if _, err := diskparse("8 0 sda 3 4 5"); err == nil {
+		t.Error("short line should fail")
+	}
+}
+
+// Partitions are skipped, and a disk plugged in after the first sample is
+// reported from the next one
+func TestGetDiskStatsHotplug(t *testing.T) {
+	fsys := fstest.MapFS{
+		"proc/diskstats": {Data: []byte("8 0 sda 1 0 0 0 0 0 0 0 0 0 0\n8 1 sda1 1 0 0 0 0 0 0 0 0 0 0\n")},
+		"sys/block/sda":  {Mode: fs.ModeDir},
+	}
+	di, err := getDiskStats(new(DiskInfo), fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := di.Names(); len(names) != 1 || names[0] != "sda" {
+		t.Errorf("expected only sda, got %v", names)
 	}
-	disks, _ := FILES.ReadDir("sys/block")
 
-	setupReportableDisks(disks)
-	if !isDisk("dev0") {
-		t.Error("disk setup not working", "dev0")
+	fsys["proc/diskstats"] = &fstest.MapFile{Data: []byte("8 0 sda 2 0 0 0 0 0 0 0 0 0 0\n8 16 sdb 1 0 0 0 0 0 0 0 0 0 0\n")}
+	fsys["sys/block/sdb"] = &fstest.MapFile{Mode: fs.ModeDir}
+	di, err = getDiskStats(di, fsys)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !isDisk("dev1") {
-		t.Error("disk setup not working", "dev1")
+	if names := di.Names(); len(names) != 2 || names[1] != "sdb" {
+		t.Errorf("expected sda and sdb, got %v", names)
+	}
+}
+
+func TestGetDiskStatsNoSysBlock(t *testing.T) {
+	_, err := getDiskStats(new(DiskInfo), fstest.MapFS{
+		"proc/diskstats": {Data: []byte("8 0 sda 1 0 0 0 0 0 0 0 0 0 0\n")},
+	})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist, got %v", err)
 	}
 }
 
@@ -310,7 +415,7 @@ func TestGetDiskStats(t *testing.T) {
 	di := new(DiskInfo)
 
 	FILES := fstest.MapFS{
-		"diskstats": {
+		"proc/diskstats": {
 			Data: []byte(
 				`0 0 dev0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0
                  1 1 dev1 1 1 1 1 1 1 1 1 1 1 1 1 1 1 1 1 1`),
@@ -326,12 +431,7 @@ func TestGetDiskStats(t *testing.T) {
 		},
 	}
 
-	disks, _ := FILES.ReadDir("sys/block")
-
-	setupReportableDisks(disks)
-
-	f, _ := FILES.Open("diskstats")
-	di2, err := getDiskStats(di, f)
+	di2, err := getDiskStats(di, FILES)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -342,3 +442,30 @@ func TestGetDiskStats(t *testing.T) {
 		t.Errorf("got di2[1].devname: %s", di2.new[1].devname) // di2.new[1].devname)
 	}
 }
+
+// A bad sample leaves the last good one to compare the next against
+func TestGetDiskStatsFailThenSucceed(t *testing.T) {
+	sample := func(line string) fs.FS {
+		return fstest.MapFS{
+			"proc/diskstats": {Data: []byte(line)},
+			"sys/block/dev0": {Mode: fs.ModeDir},
+		}
+	}
+
+	di, err := getDiskStats(new(DiskInfo), sample("8 0 dev0 100 0 0 0 0 0 0 0 0 0 0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getDiskStats(di, sample("8 0 dev0 oops")); err == nil {
+		t.Fatal("expected an error from a bad line")
+	}
+	di, err = getDiskStats(di, sample("8 0 dev0 300 0 0 0 0 0 0 0 0 0 0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	di.oldTime = di.newTime.Add(-time.Second)
+	di.estimate()
+	if r := di.byName["dev0"].num_reads_completed; r != 200 {
+		t.Errorf("expected 200 reads/s since the last good sample, got %.0f", r)
+	}
+}
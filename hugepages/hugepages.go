@@ -0,0 +1,309 @@
+package hugepages
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+const (
+	poolsPath  = "sys/kernel/mm/hugepages"
+	thpPath    = "sys/kernel/mm/transparent_hugepage"
+	vmstatPath = "proc/vmstat"
+	// RHEL 6 backported THP under its own name
+	rhelThpPath = "sys/kernel/mm/redhat_transparent_hugepage"
+)
+
+// The thp counters always shown, anything else only when it moves
+var thpCounters = []string{
+	"thp_fault_alloc",
+	"thp_fault_fallback",
+	"thp_collapse_alloc",
+	"thp_collapse_alloc_failed",
+}
+
+// A hugetlb pool of one page size
+type pool struct {
+	size    int // kB
+	total   int
+	free    int
+	resv    int // promised to a mapping but not faulted in yet
+	surplus int // over nr_hugepages from overcommit
+}
+
+type thpSettings struct {
+	enabled        string
+	defrag         string
+	khugepagedScan int // full scans khugepaged has done
+	collapsed      int
+}
+
+type sample struct {
+	pools  []*pool
+	thp    thpSettings
+	vmstat map[string]int // the thp_ counters
+}
+
+type HugeInfo struct {
+	mem     *memory.Meminfo
+	old     *sample
+	new     *sample
+	oldTime time.Time
+	newTime time.Time
+	rates   map[string]float64 // per second
+}
+
+// 'always [madvise] never', the one in use is in brackets
+func selected(s string) string {
+	for _, f := range strings.Fields(s) {
+		if strings.HasPrefix(f, "[") && strings.HasSuffix(f, "]") {
+			return strings.Trim(f, "[]")
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+// A number, -1 when the file is missing
+func readInt(fsys fs.FS, p string) (int, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, status.Errorf(p, "%w", err)
+	}
+	return v, nil
+}
+
+func readPools(fsys fs.FS) ([]*pool, error) {
+	dirs, err := fs.Glob(fsys, path.Join(poolsPath, "hugepages-*kB"))
+	if err != nil {
+		return nil, err
+	}
+	var pools []*pool
+	for _, dir := range dirs {
+		size := strings.TrimSuffix(strings.TrimPrefix(path.Base(dir), "hugepages-"), "kB")
+		p := new(pool)
+		if p.size, err = strconv.Atoi(size); err != nil {
+			return nil, status.Errorf(dir, "page size: %w", err)
+		}
+		for name, dest := range map[string]*int{
+			"nr_hugepages":      &p.total,
+			"free_hugepages":    &p.free,
+			"resv_hugepages":    &p.resv,
+			"surplus_hugepages": &p.surplus,
+		} {
+			if *dest, err = readInt(fsys, path.Join(dir, name)); err != nil {
+				return nil, err
+			}
+		}
+		pools = append(pools, p)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].size < pools[j].size })
+	return pools, nil
+}
+
+func readThp(fsys fs.FS) (thpSettings, error) {
+	var t thpSettings
+	dir := thpPath
+	if _, err := fs.Stat(fsys, dir); errors.Is(err, fs.ErrNotExist) {
+		dir = rhelThpPath
+	}
+	for name, dest := range map[string]*string{
+		"enabled": &t.enabled,
+		"defrag":  &t.defrag,
+	} {
+		b, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return t, err
+		}
+		*dest = selected(string(b))
+	}
+	var err error
+	if t.khugepagedScan, err = readInt(fsys, path.Join(dir, "khugepaged/full_scans")); err != nil {
+		return t, err
+	}
+	if t.collapsed, err = readInt(fsys, path.Join(dir, "khugepaged/pages_collapsed")); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+func readVmstat(fsys fs.FS) (map[string]int, error) {
+	f, err := fsys.Open(vmstatPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	counters := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, v, found := strings.Cut(scanner.Text(), " ")
+		if !found || !strings.HasPrefix(name, "thp_") {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, status.Errorf(vmstatPath, "%s: %w", name, err)
+		}
+		counters[name] = n
+	}
+	return counters, scanner.Err()
+}
+
+// Get a HugeInfo with the thp rates since the last one. The hugetlb and THP
+// totals come from meminfo, m can be nil when it couldn't be read.
+func HugeStats(hi *HugeInfo, m *memory.Meminfo) (*HugeInfo, error) {
+	return getHugeStats(hi, m, rootfs.FS)
+}
+
+func getHugeStats(hi *HugeInfo, m *memory.Meminfo, fsys fs.FS) (*HugeInfo, error) {
+	s := new(sample)
+	var err error
+	if s.pools, err = readPools(fsys); err != nil {
+		return nil, err
+	}
+	if s.thp, err = readThp(fsys); err != nil {
+		return nil, err
+	}
+	if s.vmstat, err = readVmstat(fsys); err != nil {
+		return nil, err
+	}
+	// without sysfs meminfo still has the default size pool
+	if len(s.pools) == 0 && m != nil && m.Has("HugePages_Total") {
+		s.pools = []*pool{{
+			size: m.Hugepagesize, total: m.HugePages_Total, free: m.HugePages_Free,
+			resv: m.HugePages_Rsvd, surplus: m.HugePages_Surp,
+		}}
+	}
+	hi.mem = m
+	hi.old = hi.new
+	hi.new = s
+	hi.oldTime = hi.newTime
+	hi.newTime = time.Now()
+	hi.estimate()
+	return hi, nil
+}
+
+func (hi *HugeInfo) estimate() {
+	hi.rates = make(map[string]float64)
+	if hi.old == nil {
+		return
+	}
+	elapsed := hi.newTime.Sub(hi.oldTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	for name, v := range hi.new.vmstat {
+		if prev, ok := hi.old.vmstat[name]; ok && v >= prev {
+			hi.rates[name] = float64(v-prev) / elapsed
+		}
+	}
+}
+
+func (p *pool) String() string {
+	s := fmt.Sprintf("%dkB: %d/%d free", p.size, p.free, p.total)
+	if p.resv > 0 {
+		s += fmt.Sprintf(" rsvd: %d", p.resv)
+	}
+	if p.surplus > 0 {
+		s += fmt.Sprintf(" surp: %d", p.surplus)
+	}
+	return s
+}
+
+// Fallbacks and failures mean THP isn't getting the huge pages asked for
+func isFailure(name string) bool {
+	return strings.Contains(name, "fallback") || strings.HasSuffix(name, "_failed")
+}
+
+// Kernels before 2.6.39 have THP but no thp_ counters in vmstat
+func (hi *HugeInfo) thpRates() string {
+	if len(hi.new.vmstat) == 0 {
+		return "thp/s: not counted"
+	}
+	var sb strings.Builder
+	sb.WriteString("thp/s:")
+	for _, name := range thpCounters {
+		if _, ok := hi.new.vmstat[name]; !ok {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf(" %s: %.1f", strings.TrimPrefix(name, "thp_"), hi.rates[name]))
+	}
+	var others []string
+	for name, r := range hi.rates {
+		if r > 0 && !slices.Contains(thpCounters, name) {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	for _, name := range others {
+		sb.WriteString(fmt.Sprintf(" %s: %.1f", strings.TrimPrefix(name, "thp_"), hi.rates[name]))
+	}
+	for name, r := range hi.rates {
+		if r > 0 && isFailure(name) {
+			sb.WriteString(" FALLING BACK")
+			break
+		}
+	}
+	return sb.String()
+}
+
+// The hugetlb pools, THP in use and its settings, then the thp rates
+func (hi *HugeInfo) InfoPrint() string {
+	var sb strings.Builder
+	sb.WriteString("hugetlb:")
+	if len(hi.new.pools) == 0 {
+		sb.WriteString(" none")
+	}
+	for _, p := range hi.new.pools {
+		sb.WriteString(" " + p.String())
+	}
+	m := hi.mem
+	if m != nil && m.Has("Hugetlb") {
+		sb.WriteString(fmt.Sprintf(" total: %d", memory.Scaled(m.Hugetlb)))
+	}
+	if m != nil && m.Has("AnonHugePages") {
+		sb.WriteString(fmt.Sprintf("\nthp in use anon: %d shmem: %d file: %d",
+			memory.Scaled(m.AnonHugePages), memory.Scaled(m.ShmemHugePages),
+			memory.Scaled(m.FileHugePages)))
+	}
+	t := hi.new.thp
+	if t.enabled == "" {
+		sb.WriteString("\nthp: not available\n")
+		return sb.String()
+	}
+	sb.WriteString(fmt.Sprintf("\nthp: enabled: %s defrag: %s", t.enabled, t.defrag))
+	if t.khugepagedScan >= 0 {
+		sb.WriteString(fmt.Sprintf(" khugepaged full_scans: %d collapsed: %d", t.khugepagedScan, t.collapsed))
+		if hi.old != nil && t.khugepagedScan > hi.old.thp.khugepagedScan {
+			collapsed := t.collapsed - hi.old.thp.collapsed
+			sb.WriteString(fmt.Sprintf(" (+%d scans +%d collapsed)",
+				t.khugepagedScan-hi.old.thp.khugepagedScan, collapsed))
+			// scanning everything and finding nothing it can collapse
+			if collapsed == 0 {
+				sb.WriteString(" NOT COLLAPSING")
+			}
+		}
+	}
+	sb.WriteString("\n" + hi.thpRates() + "\n")
+	return sb.String()
+}
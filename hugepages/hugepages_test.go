@@ -0,0 +1,140 @@
+package hugepages
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/status"
+)
+
+func hugeFiles(faultAlloc, fallback, scans int) fstest.MapFS {
+	return fstest.MapFS{
+		"sys/kernel/mm/hugepages/hugepages-2048kB/nr_hugepages":         {Data: []byte("512\n")},
+		"sys/kernel/mm/hugepages/hugepages-2048kB/free_hugepages":       {Data: []byte("100\n")},
+		"sys/kernel/mm/hugepages/hugepages-2048kB/resv_hugepages":       {Data: []byte("10\n")},
+		"sys/kernel/mm/hugepages/hugepages-2048kB/surplus_hugepages":    {Data: []byte("0\n")},
+		"sys/kernel/mm/hugepages/hugepages-1048576kB/nr_hugepages":      {Data: []byte("0\n")},
+		"sys/kernel/mm/hugepages/hugepages-1048576kB/free_hugepages":    {Data: []byte("0\n")},
+		"sys/kernel/mm/hugepages/hugepages-1048576kB/resv_hugepages":    {Data: []byte("0\n")},
+		"sys/kernel/mm/hugepages/hugepages-1048576kB/surplus_hugepages": {Data: []byte("0\n")},
+
+		"sys/kernel/mm/transparent_hugepage/enabled":                    {Data: []byte("[always] madvise never\n")},
+		"sys/kernel/mm/transparent_hugepage/defrag":                     {Data: []byte("always defer defer+madvise [madvise] never\n")},
+		"sys/kernel/mm/transparent_hugepage/khugepaged/full_scans":      {Data: []byte(fmt.Sprintf("%d\n", scans))},
+		"sys/kernel/mm/transparent_hugepage/khugepaged/pages_collapsed": {Data: []byte("40\n")},
+
+		"proc/vmstat": {Data: []byte(fmt.Sprintf(`nr_free_pages 1000
+thp_fault_alloc %d
+thp_fault_fallback %d
+thp_collapse_alloc 7
+thp_collapse_alloc_failed 0
+thp_split_page 3
+thp_swpout 0
+`, faultAlloc, fallback))},
+	}
+}
+
+func TestHugeStats(t *testing.T) {
+	memory.SetScale(1024 * 1024)
+	m := &memory.Meminfo{
+		Hugetlb:       1024 * 1024,
+		AnonHugePages: 200 * 1024,
+		Provided:      map[string]bool{"Hugetlb": true, "AnonHugePages": true},
+	}
+	hi, err := getHugeStats(new(HugeInfo), m, hugeFiles(100, 0, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hi.new.pools) != 2 || hi.new.pools[0].size != 2048 {
+		t.Fatalf("wrong pools %+v", hi.new.pools)
+	}
+
+	hi, err = getHugeStats(hi, m, hugeFiles(120, 10, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rates over two seconds
+	hi.oldTime = hi.newTime.Add(-2 * time.Second)
+	hi.estimate()
+
+	out := hi.InfoPrint()
+	for _, want := range []string{
+		"hugetlb: 2048kB: 100/512 free rsvd: 10 1048576kB: 0/0 free total: 1024\n",
+		"thp in use anon: 200 shmem: 0 file: 0\n",
+		"thp: enabled: always defrag: madvise khugepaged full_scans: 6 collapsed: 40 (+1 scans +0 collapsed) NOT COLLAPSING\n",
+		"thp/s: fault_alloc: 10.0 fault_fallback: 5.0 collapse_alloc: 0.0 collapse_alloc_failed: 0.0 FALLING BACK\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestHugeStatsMeminfoPool(t *testing.T) {
+	m := &memory.Meminfo{
+		HugePages_Total: 8, HugePages_Free: 2, Hugepagesize: 2048,
+		Provided: map[string]bool{"HugePages_Total": true},
+	}
+	hi, err := getHugeStats(new(HugeInfo), m, fstest.MapFS{
+		"proc/vmstat": {Data: []byte("nr_free_pages 1000\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := hi.InfoPrint(); out != "hugetlb: 2048kB: 2/8 free\nthp: not available\n" {
+		t.Errorf("wrong output %q", out)
+	}
+}
+
+func TestHugeStatsThpFormats(t *testing.T) {
+	rhel := fstest.MapFS{
+		"sys/kernel/mm/redhat_transparent_hugepage/enabled":                    {Data: []byte("[always] madvise never\n")},
+		"sys/kernel/mm/redhat_transparent_hugepage/defrag":                     {Data: []byte("[always] madvise never\n")},
+		"sys/kernel/mm/redhat_transparent_hugepage/khugepaged/full_scans":      {Data: []byte("3\n")},
+		"sys/kernel/mm/redhat_transparent_hugepage/khugepaged/pages_collapsed": {Data: []byte("9\n")},
+		"proc/vmstat": {Data: []byte("nr_free_pages 1000\nthp_fault_alloc 4\n")},
+	}
+	noCounters := hugeFiles(0, 0, 1)
+	noCounters["proc/vmstat"] = &fstest.MapFile{Data: []byte("nr_free_pages 1000\n")}
+	// only the counters the kernel has are shown
+	fewer := hugeFiles(0, 0, 1)
+	fewer["proc/vmstat"] = &fstest.MapFile{Data: []byte("thp_fault_alloc 2\nthp_fault_fallback 1\n")}
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+		want string
+	}{
+		{name: "rhel 6", fsys: rhel,
+			want: "thp: enabled: always defrag: always khugepaged full_scans: 3 collapsed: 9\nthp/s: fault_alloc: 0.0\n"},
+		{name: "no counters", fsys: noCounters,
+			want: "thp: enabled: always defrag: madvise khugepaged full_scans: 1 collapsed: 40\nthp/s: not counted\n"},
+		{name: "fewer counters", fsys: fewer,
+			want: "thp/s: fault_alloc: 0.0 fault_fallback: 0.0\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hi, err := getHugeStats(new(HugeInfo), nil, tc.fsys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out := hi.InfoPrint(); !strings.HasSuffix(out, tc.want) {
+				t.Errorf("got\n%s\nexpected it to end with\n%s", out, tc.want)
+			}
+		})
+	}
+}
+
+func TestHugeStatsBadCounter(t *testing.T) {
+	fsys := hugeFiles(0, 0, 0)
+	fsys["proc/vmstat"] = &fstest.MapFile{Data: []byte("thp_fault_alloc lots\n")}
+	_, err := getHugeStats(new(HugeInfo), nil, fsys)
+	var fe *status.FormatError
+	if !errors.As(err, &fe) {
+		t.Errorf("expected a format error, got %v", err)
+	}
+}
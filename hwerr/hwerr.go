@@ -0,0 +1,335 @@
+package hwerr
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+const (
+	edacPath = "sys/devices/system/edac/mc"
+	pciPath  = "sys/bus/pci/devices"
+)
+
+// Something counting errors, a memory controller, one of its dimms or a pci
+// device. Counts are since boot, or since the driver loaded.
+type source struct {
+	name   string
+	label  string // dimm location or the aer errors seen
+	kinds  []string
+	counts map[string]int
+	delta  map[string]int
+}
+
+func (s *source) total() int {
+	n := 0
+	for _, v := range s.counts {
+		n += v
+	}
+	return n
+}
+
+type HwErrInfo struct {
+	// HardwareCorrupted from meminfo, pages the kernel poisoned
+	corrupted    int
+	hasCorrupted bool
+
+	mcs     []*source
+	dimms   []*source
+	devices []*source // with aer counters
+
+	prev map[string]*source
+}
+
+func readCount(fsys fs.FS, p string) (int, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, status.Errorf(p, "%w", err)
+	}
+	return v, nil
+}
+
+func readString(fsys fs.FS, p string) string {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Read files named prefix+kind+suffix in dir into a source, a missing file
+// leaves that kind out
+func readSource(fsys fs.FS, dir, name, prefix, suffix string, kinds ...string) (*source, error) {
+	s := &source{name: name, counts: make(map[string]int)}
+	for _, k := range kinds {
+		v, err := readCount(fsys, path.Join(dir, prefix+k+suffix))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.kinds = append(s.kinds, k)
+		s.counts[k] = v
+	}
+	return s, nil
+}
+
+// Sort paths ending in a number, mc10 after mc2
+func sortNumbered(paths []string, prefix string) {
+	num := func(p string) int {
+		n, _ := strconv.Atoi(strings.TrimPrefix(path.Base(p), prefix))
+		return n
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return num(paths[i]) < num(paths[j])
+	})
+}
+
+// The ce/ue counts of each memory controller and each of its dimms. Kernels
+// before 4.10, and some drivers since, only have the older csrow layout.
+func readEdac(fsys fs.FS) ([]*source, []*source, error) {
+	mcDirs, err := fs.Glob(fsys, path.Join(edacPath, "mc[0-9]*"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sortNumbered(mcDirs, "mc")
+	var mcs, dimms []*source
+	for _, dir := range mcDirs {
+		mc, err := readSource(fsys, dir, path.Base(dir), "", "_count", "ce", "ue")
+		if err != nil {
+			return nil, nil, err
+		}
+		mcs = append(mcs, mc)
+
+		prefix, layout := "dimm_", "dimm"
+		rows, err := fs.Glob(fsys, path.Join(dir, "dimm[0-9]*"))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rows) == 0 {
+			prefix, layout = "", "csrow"
+			rows, err = fs.Glob(fsys, path.Join(dir, "csrow[0-9]*"))
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		sortNumbered(rows, layout)
+		for _, row := range rows {
+			d, err := readSource(fsys, row, mc.name+"/"+path.Base(row), prefix, "_count", "ce", "ue")
+			if err != nil {
+				return nil, nil, err
+			}
+			if layout == "dimm" {
+				d.label = readString(fsys, path.Join(row, "dimm_label"))
+			} else {
+				d.label = readString(fsys, path.Join(row, "ch0_dimm_label"))
+			}
+			dimms = append(dimms, d)
+		}
+	}
+	return mcs, dimms, nil
+}
+
+// An aer_dev_* file has a line 'Name count' for each error and a
+// TOTAL_ERR_* line. Returns the total and the names that were seen.
+func readAer(fsys fs.FS, p string) (int, []string, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return 0, nil, err
+	}
+	total, sum := -1, 0
+	var seen []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return 0, nil, status.Errorf(p, "expected 2 fields, got %q", line)
+		}
+		v, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, nil, status.Errorf(p, "%s: %w", fields[0], err)
+		}
+		if strings.HasPrefix(fields[0], "TOTAL_ERR_") {
+			total = v
+			continue
+		}
+		sum += v
+		if v > 0 {
+			seen = append(seen, fmt.Sprintf("%s:%d", fields[0], v))
+		}
+	}
+	if total < 0 {
+		total = sum
+	}
+	return total, seen, nil
+}
+
+// PCIe devices with advanced error reporting
+func readPci(fsys fs.FS) ([]*source, error) {
+	devs, err := fs.Glob(fsys, path.Join(pciPath, "*", "aer_dev_correctable"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(devs)
+	var sources []*source
+	for _, p := range devs {
+		dir := path.Dir(p)
+		s := &source{name: path.Base(dir), counts: make(map[string]int)}
+		var seen []string
+		for _, k := range []string{"correctable", "nonfatal", "fatal"} {
+			v, names, err := readAer(fsys, path.Join(dir, "aer_dev_"+k))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			s.kinds = append(s.kinds, k)
+			s.counts[k] = v
+			seen = append(seen, names...)
+		}
+		// removed since the glob
+		if len(s.kinds) == 0 {
+			continue
+		}
+		s.label = strings.Join(seen, " ")
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+// Read the error counters and work out what's new since the last call. The
+// HardwareCorrupted count comes from meminfo, m can be nil when it couldn't
+// be read.
+func HwErrStats(hi *HwErrInfo, m *memory.Meminfo) (*HwErrInfo, error) {
+	return getHwErrStats(hi, m, rootfs.FS)
+}
+
+func getHwErrStats(hi *HwErrInfo, m *memory.Meminfo, fsys fs.FS) (*HwErrInfo, error) {
+	mcs, dimms, err := readEdac(fsys)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := readPci(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	next := &HwErrInfo{mcs: mcs, dimms: dimms, devices: devices}
+	if m != nil && m.Has("HardwareCorrupted") {
+		next.corrupted = m.HardwareCorrupted
+		next.hasCorrupted = true
+	}
+	next.estimate(hi.prev)
+	return next, nil
+}
+
+// New errors for every source seen last time as well
+func (hi *HwErrInfo) estimate(prev map[string]*source) {
+	hi.prev = make(map[string]*source)
+	for _, group := range [][]*source{hi.mcs, hi.dimms, hi.devices} {
+		for _, s := range group {
+			hi.prev[s.name] = s
+			old, ok := prev[s.name]
+			if !ok {
+				continue
+			}
+			s.delta = make(map[string]int)
+			for _, k := range s.kinds {
+				s.delta[k] = s.counts[k] - old.counts[k]
+				// reset by reloading the driver or writing reset_counters,
+				// everything counted since is new
+				if s.delta[k] < 0 {
+					s.delta[k] = s.counts[k]
+				}
+			}
+		}
+	}
+}
+
+func sum(sources []*source, kind string) int {
+	n := 0
+	for _, s := range sources {
+		n += s.counts[kind]
+	}
+	return n
+}
+
+func (s *source) String() string {
+	var sb strings.Builder
+	sb.WriteString("ERRORS " + s.name)
+	if s.label != "" {
+		sb.WriteString(" (" + s.label + ")")
+	}
+	for _, k := range s.kinds {
+		sb.WriteString(fmt.Sprintf(" %s: %d", k, s.counts[k]))
+		if s.delta[k] > 0 {
+			sb.WriteString(fmt.Sprintf(" (+%d)", s.delta[k]))
+		}
+	}
+	return sb.String()
+}
+
+// A summary line, then every controller, dimm and device that has ever had
+// an error gets its own line, however many there are
+func (hi *HwErrInfo) InfoPrint() string {
+	var sb strings.Builder
+	if hi.hasCorrupted {
+		sb.WriteString(fmt.Sprintf("corrupted: %d", memory.Scaled(hi.corrupted)))
+	} else {
+		sb.WriteString("corrupted: -")
+	}
+	if len(hi.mcs) > 0 {
+		sb.WriteString(fmt.Sprintf("\tedac mcs: %d ce: %d ue: %d",
+			len(hi.mcs), sum(hi.mcs, "ce"), sum(hi.mcs, "ue")))
+	} else {
+		sb.WriteString("\tedac: none")
+	}
+	if len(hi.devices) > 0 {
+		sb.WriteString(fmt.Sprintf("\taer devices: %d correctable: %d nonfatal: %d fatal: %d",
+			len(hi.devices), sum(hi.devices, "correctable"),
+			sum(hi.devices, "nonfatal"), sum(hi.devices, "fatal")))
+	} else {
+		sb.WriteString("\taer: none")
+	}
+	sb.WriteString("\n")
+
+	if hi.corrupted > 0 {
+		sb.WriteString(fmt.Sprintf("ERRORS memory HardwareCorrupted: %dkB poisoned\n", hi.corrupted))
+	}
+	for _, group := range [][]*source{hi.mcs, hi.dimms, hi.devices} {
+		for _, s := range group {
+			if s.total() > 0 {
+				sb.WriteString(s.String() + "\n")
+			}
+		}
+	}
+	return sb.String()
+}
+
+// Whether anything has ever reported an error
+func (hi *HwErrInfo) HasErrors() bool {
+	if hi.corrupted > 0 {
+		return true
+	}
+	for _, group := range [][]*source{hi.mcs, hi.dimms, hi.devices} {
+		for _, s := range group {
+			if s.total() > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package hwerr
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/status"
+)
+
+const aerCorrectable = `RxErr 0
+BadTLP %s
+BadDLLP 0
+Rollover 0
+Timeout 0
+NonFatalErr 0
+CorrIntErr 0
+HeaderOF 0
+TOTAL_ERR_COR %s
+`
+
+func hwFiles(dimm1ce, badTLP string) fstest.MapFS {
+	return fstest.MapFS{
+		"sys/devices/system/edac/mc/mc0/ce_count":            {Data: []byte(dimm1ce + "\n")},
+		"sys/devices/system/edac/mc/mc0/ue_count":            {Data: []byte("0\n")},
+		"sys/devices/system/edac/mc/mc0/dimm0/dimm_ce_count": {Data: []byte("0\n")},
+		"sys/devices/system/edac/mc/mc0/dimm0/dimm_ue_count": {Data: []byte("0\n")},
+		"sys/devices/system/edac/mc/mc0/dimm0/dimm_label":    {Data: []byte("CPU_SrcID#0_MC#0_Chan#0_DIMM#0\n")},
+		"sys/devices/system/edac/mc/mc0/dimm1/dimm_ce_count": {Data: []byte(dimm1ce + "\n")},
+		"sys/devices/system/edac/mc/mc0/dimm1/dimm_ue_count": {Data: []byte("0\n")},
+		"sys/devices/system/edac/mc/mc0/dimm1/dimm_label":    {Data: []byte("CPU_SrcID#0_MC#0_Chan#1_DIMM#0\n")},
+		// older layout
+		"sys/devices/system/edac/mc/mc1/ce_count":              {Data: []byte("0\n")},
+		"sys/devices/system/edac/mc/mc1/ue_count":              {Data: []byte("1\n")},
+		"sys/devices/system/edac/mc/mc1/csrow0/ce_count":       {Data: []byte("0\n")},
+		"sys/devices/system/edac/mc/mc1/csrow0/ue_count":       {Data: []byte("1\n")},
+		"sys/devices/system/edac/mc/mc1/csrow0/ch0_dimm_label": {Data: []byte("DIMM_B1\n")},
+		"sys/bus/pci/devices/0000:00:1c.0/aer_dev_correctable": {Data: []byte(
+			strings.ReplaceAll(aerCorrectable, "%s", badTLP))},
+		"sys/bus/pci/devices/0000:00:1c.0/aer_dev_fatal":    {Data: []byte("Undefined 0\nDLP 0\nTOTAL_ERR_FATAL 0\n")},
+		"sys/bus/pci/devices/0000:00:1c.0/aer_dev_nonfatal": {Data: []byte("Undefined 0\nDLP 0\nTOTAL_ERR_NONFATAL 0\n")},
+		"sys/bus/pci/devices/0000:00:1d.0/aer_dev_correctable": {Data: []byte(
+			strings.ReplaceAll(aerCorrectable, "%s", "0"))},
+		// no aer
+		"sys/bus/pci/devices/0000:00:00.0/vendor": {Data: []byte("0x8086\n")},
+	}
+}
+
+func TestHwErrStats(t *testing.T) {
+	m := &memory.Meminfo{HardwareCorrupted: 4, Provided: map[string]bool{"HardwareCorrupted": true}}
+	hi, err := getHwErrStats(new(HwErrInfo), m, hwFiles("3", "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hi.mcs) != 2 || len(hi.dimms) != 3 || len(hi.devices) != 2 {
+		t.Fatalf("wrong sources: %d mcs %d dimms %d devices", len(hi.mcs), len(hi.dimms), len(hi.devices))
+	}
+	if hi.dimms[2].name != "mc1/csrow0" || hi.dimms[2].label != "DIMM_B1" || hi.dimms[2].counts["ue"] != 1 {
+		t.Errorf("wrong csrow %+v", hi.dimms[2])
+	}
+
+	hi, err = getHwErrStats(hi, m, hwFiles("5", "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hi.HasErrors() {
+		t.Error("expected errors")
+	}
+	out := hi.InfoPrint()
+	for _, want := range []string{
+		"\tedac mcs: 2 ce: 5 ue: 1\taer devices: 2 correctable: 2 nonfatal: 0 fatal: 0\n",
+		"ERRORS memory HardwareCorrupted: 4kB poisoned\n",
+		"ERRORS mc0 ce: 5 (+2) ue: 0\n",
+		"ERRORS mc0/dimm1 (CPU_SrcID#0_MC#0_Chan#1_DIMM#0) ce: 5 (+2) ue: 0\n",
+		"ERRORS mc1/csrow0 (DIMM_B1) ce: 0 ue: 1\n",
+		"ERRORS 0000:00:1c.0 (BadTLP:2) correctable: 2 (+2) nonfatal: 0 fatal: 0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	// healthy ones aren't listed
+	for _, unwanted := range []string{"dimm0", "0000:00:1d.0"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("unexpected %q in\n%s", unwanted, out)
+		}
+	}
+}
+
+// Removes name from the files, like a device hot unplugged between listing
+// and reading it
+type goneFS struct {
+	fstest.MapFS
+	gone string
+}
+
+func (g goneFS) Open(name string) (fs.File, error) {
+	if name == g.gone {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return g.MapFS.Open(name)
+}
+
+func (g goneFS) ReadFile(name string) ([]byte, error) {
+	if name == g.gone {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return g.MapFS.ReadFile(name)
+}
+
+func TestHwErrStatsChanging(t *testing.T) {
+	// before 5.x some kernels had no TOTAL_ERR_ lines
+	noTotal := hwFiles("0", "0")
+	noTotal["sys/bus/pci/devices/0000:00:1c.0/aer_dev_correctable"] = &fstest.MapFile{Data: []byte("RxErr 1\nBadTLP 2\n")}
+	tests := []struct {
+		name   string
+		first  fs.FS
+		second fs.FS
+		want   string
+	}{
+		{name: "none", first: fstest.MapFS{}, second: fstest.MapFS{},
+			want: "corrupted: -\tedac: none\taer: none\n"},
+		// 5 errors, the counters reset then one more
+		{name: "reset", first: hwFiles("5", "0"), second: hwFiles("1", "0"),
+			want: "ERRORS mc0 ce: 1 (+1) ue: 0\n"},
+		{name: "device gone", first: hwFiles("0", "0"),
+			second: goneFS{hwFiles("0", "0"), "sys/bus/pci/devices/0000:00:1d.0/aer_dev_correctable"},
+			want:   "\taer devices: 1 correctable: 0 nonfatal: 0 fatal: 0\n"},
+		{name: "no totals", first: hwFiles("0", "0"), second: noTotal,
+			want: "ERRORS 0000:00:1c.0 (RxErr:1 BadTLP:2) correctable: 3 (+3) nonfatal: 0 fatal: 0\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hi, err := getHwErrStats(new(HwErrInfo), nil, tc.first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hi, err = getHwErrStats(hi, nil, tc.second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out := hi.InfoPrint(); !strings.Contains(out, tc.want) {
+				t.Errorf("missing %q in\n%s", tc.want, out)
+			}
+		})
+	}
+}
+
+func TestHwErrStatsBadCount(t *testing.T) {
+	fsys := hwFiles("0", "0")
+	fsys["sys/devices/system/edac/mc/mc0/ue_count"] = &fstest.MapFile{Data: []byte("lots\n")}
+	_, err := getHwErrStats(new(HwErrInfo), nil, fsys)
+	var fe *status.FormatError
+	if !errors.As(err, &fe) {
+		t.Errorf("expected a format error, got %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package limits
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bioe007/synopsys/container"
+	"github.com/bioe007/synopsys/load"
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+const (
+	fileNrPath     = "proc/sys/fs/file-nr"
+	inodeNrPath    = "proc/sys/fs/inode-nr"
+	pidMaxPath     = "proc/sys/kernel/pid_max"
+	threadsMaxPath = "proc/sys/kernel/threads-max"
+)
+
+// A limit read as 'unlimited'
+const unlimited = -1
+
+type process struct {
+	pid       int
+	comm      string
+	fds       int
+	maxFds    int // soft RLIMIT_NOFILE, or unlimited
+	container *container.Container
+}
+
+type fdHeap []*process
+
+func (h fdHeap) Len() int { return len(h) }
+func (h fdHeap) Less(i, j int) bool {
+	return h[i].fds > h[j].fds
+}
+func (h fdHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *fdHeap) Push(x any)   { *h = append(*h, x.(*process)) }
+func (h *fdHeap) Pop() any {
+	old := *h
+	n := len(old)
+	if n == 0 {
+		return nil
+	}
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+type LimitsInfo struct {
+	// Percent of a limit to warn at
+	WarnPercent int
+	// Labels processes with their container, nil to skip
+	Resolver *container.Resolver
+
+	fsys fs.FS
+
+	files      int // allocated file handles
+	filesMax   int
+	inodes     int
+	inodesFree int
+	tasks      int // every thread uses a pid
+	lastPid    int
+	pidMax     int
+	threadsMax int
+
+	procs *fdHeap
+	// processes whose fds couldn't be read, usually from not being root
+	unreadable int
+}
+
+func readInts(fsys fs.FS, p string) ([]int, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	var vals []int
+	for _, f := range strings.Fields(string(b)) {
+		v, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, status.Errorf(p, "%w", err)
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+// The soft 'Max open files' from /proc/[pid]/limits
+func maxOpenFiles(fsys fs.FS, pid int) int {
+	b, err := fs.ReadFile(fsys, path.Join("proc", strconv.Itoa(pid), "limits"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		rest, found := strings.CutPrefix(line, "Max open files")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return 0
+		}
+		if fields[0] == "unlimited" {
+			return unlimited
+		}
+		v, _ := strconv.Atoi(fields[0])
+		return v
+	}
+	return 0
+}
+
+// Count the open fds of every process. Threads share the fd table so only
+// the thread group leaders listed in /proc are counted.
+func (li *LimitsInfo) readProcesses(fsys fs.FS) error {
+	entries, err := fs.ReadDir(fsys, "proc")
+	if err != nil {
+		return err
+	}
+	li.procs = new(fdHeap)
+	heap.Init(li.procs)
+	li.unreadable = 0
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		dir := path.Join("proc", e.Name())
+		fds, err := fs.ReadDir(fsys, path.Join(dir, "fd"))
+		// isn't ours, only root can read it
+		if errors.Is(err, fs.ErrPermission) {
+			li.unreadable++
+			continue
+		}
+		// exited since listing /proc, that's ENOENT or ESRCH
+		if err != nil {
+			continue
+		}
+		comm, _ := fs.ReadFile(fsys, path.Join(dir, "comm"))
+		heap.Push(li.procs, &process{
+			pid:  pid,
+			comm: strings.TrimSpace(string(comm)),
+			fds:  len(fds),
+		})
+	}
+	return nil
+}
+
+// Get a LimitsInfo and update it. The task count and last pid come from the
+// load average so they aren't read twice.
+func LimitStats(li *LimitsInfo, ld *load.Load) (*LimitsInfo, error) {
+	return getLimitStats(li, ld.Tasks(), ld.LastPid(), rootfs.FS)
+}
+
+func getLimitStats(li *LimitsInfo, tasks, lastPid int, fsys fs.FS) (*LimitsInfo, error) {
+	// allocated, unused (always 0 since 2.6) and max
+	fileNr, err := readInts(fsys, fileNrPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(fileNr) < 3 {
+		return nil, status.Errorf(fileNrPath, "%d fields", len(fileNr))
+	}
+	li.files, li.filesMax = fileNr[0]-fileNr[1], fileNr[2]
+
+	// inodes allocated and free, there hasn't been a max since 2.4
+	inodeNr, err := readInts(fsys, inodeNrPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(inodeNr) < 2 {
+		return nil, status.Errorf(inodeNrPath, "%d fields", len(inodeNr))
+	}
+	li.inodes, li.inodesFree = inodeNr[0], inodeNr[1]
+
+	pidMax, err := readInts(fsys, pidMaxPath)
+	if err != nil {
+		return nil, err
+	}
+	threadsMax, err := readInts(fsys, threadsMaxPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(pidMax) != 1 {
+		return nil, status.Errorf(pidMaxPath, "%d fields", len(pidMax))
+	}
+	if len(threadsMax) != 1 {
+		return nil, status.Errorf(threadsMaxPath, "%d fields", len(threadsMax))
+	}
+	li.pidMax, li.threadsMax = pidMax[0], threadsMax[0]
+	li.tasks, li.lastPid = tasks, lastPid
+	li.fsys = fsys
+
+	if err := li.readProcesses(fsys); err != nil {
+		return nil, err
+	}
+	return li, nil
+}
+
+func percent(used, max int) float64 {
+	if max <= 0 {
+		return 0
+	}
+	return float64(used) * 100 / float64(max)
+}
+
+func (p *process) String() string {
+	s := fmt.Sprintf(" %s[%d] %d", p.comm, p.pid, p.fds)
+	switch {
+	case p.maxFds == unlimited:
+		s += "/unlimited"
+	case p.maxFds > 0:
+		s += fmt.Sprintf("/%d", p.maxFds)
+	}
+	if p.container != nil {
+		s += " (" + p.container.String() + ")"
+	}
+	return s
+}
+
+// Show the system wide limits and the num_procs processes with the most open
+// files, with a warning for anything over WarnPercent of its limit.
+func (li *LimitsInfo) InfoPrint(num_procs int) string {
+	var sb strings.Builder
+	var warn []string
+	check := func(name string, pct float64) {
+		if li.WarnPercent > 0 && pct >= float64(li.WarnPercent) {
+			warn = append(warn, fmt.Sprintf("%s %.1f%%", name, pct))
+		}
+	}
+
+	filesPct := percent(li.files, li.filesMax)
+	pidsPct := percent(li.tasks, li.pidMax)
+	threadsPct := percent(li.tasks, li.threadsMax)
+	check("files", filesPct)
+	check("pids", pidsPct)
+	check("threads", threadsPct)
+	sb.WriteString(fmt.Sprintf(
+		"files: %d/%d (%.1f%%) inodes: %d free: %d\tpids: %d/%d (%.1f%%) last:%d\tthreads: %d/%d (%.1f%%)\n",
+		li.files, li.filesMax, filesPct,
+		li.inodes, li.inodesFree,
+		li.tasks, li.pidMax, pidsPct, li.lastPid,
+		li.tasks, li.threadsMax, threadsPct,
+	))
+
+	limit := min(li.procs.Len(), num_procs)
+	if limit > 0 || li.unreadable > 0 {
+		sb.WriteString("top fds:")
+		for i := 0; i < limit; i++ {
+			p := heap.Pop(li.procs).(*process)
+			// only the ones shown are worth the extra reads
+			p.maxFds = maxOpenFiles(li.fsys, p.pid)
+			if li.Resolver != nil {
+				p.container = li.Resolver.Resolve(p.pid)
+			}
+			if p.maxFds > 0 {
+				check(fmt.Sprintf("%s[%d] fds", p.comm, p.pid), percent(p.fds, p.maxFds))
+			}
+			sb.WriteString(p.String())
+		}
+		if li.unreadable > 0 {
+			sb.WriteString(fmt.Sprintf("\t(%d processes not readable, run as root)", li.unreadable))
+		}
+		sb.WriteString("\n")
+	}
+
+	if len(warn) > 0 {
+		sb.WriteString(fmt.Sprintf("WARNING over %d%% of limit: %s\n",
+			li.WarnPercent, strings.Join(warn, ", ")))
+	}
+	return sb.String()
+}
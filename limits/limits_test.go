@@ -0,0 +1,137 @@
+package limits
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+const limitsFile = `Limit                     Soft Limit           Hard Limit           Units
+Max cpu time              unlimited            unlimited            seconds
+Max processes             63455                63455                processes
+Max open files            %s                 524288               files
+Max locked memory         8388608              8388608              bytes
+`
+
+func limitFiles() fstest.MapFS {
+	files := fstest.MapFS{
+		"proc/sys/fs/file-nr":         {Data: []byte("9000\t0\t10000\n")},
+		"proc/sys/fs/inode-nr":        {Data: []byte("120000\t3000\n")},
+		"proc/sys/kernel/pid_max":     {Data: []byte("32768\n")},
+		"proc/sys/kernel/threads-max": {Data: []byte("126000\n")},
+		"proc/1/comm":                 {Data: []byte("systemd\n")},
+		"proc/1/limits":               {Data: []byte(fmt.Sprintf(limitsFile, "unlimited"))},
+		"proc/42/comm":                {Data: []byte("nginx\n")},
+		"proc/42/limits":              {Data: []byte(fmt.Sprintf(limitsFile, "10"))},
+		"proc/self/comm":              {Data: []byte("synopsys\n")},
+		"proc/7/comm":                 {Data: []byte("kthreadd\n")},
+	}
+	for fd := 0; fd < 3; fd++ {
+		files[fmt.Sprintf("proc/1/fd/%d", fd)] = &fstest.MapFile{}
+	}
+	for fd := 0; fd < 9; fd++ {
+		files[fmt.Sprintf("proc/42/fd/%d", fd)] = &fstest.MapFile{}
+	}
+	return files
+}
+
+// Other users' fd directories can't be listed when not root, listing one of
+// a process that has just exited gives ESRCH
+type deniedFS struct {
+	fstest.MapFS
+	denied string
+	exited string
+}
+
+func (d deniedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	switch name {
+	case d.denied:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	case d.exited:
+		return nil, &fs.PathError{Op: "readdirent", Path: name, Err: syscall.ESRCH}
+	}
+	return d.MapFS.ReadDir(name)
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	files := limitFiles()
+	tests := []struct {
+		pid  int
+		want int
+	}{
+		{1, unlimited},
+		{42, 10},
+		{7, 0},
+	}
+	for _, tt := range tests {
+		if got := maxOpenFiles(files, tt.pid); got != tt.want {
+			t.Errorf("pid %d got %d want %d", tt.pid, got, tt.want)
+		}
+	}
+}
+
+func TestLimitStats(t *testing.T) {
+	li := &LimitsInfo{WarnPercent: 80}
+	li, err := getLimitStats(li, 1000, 31000, limitFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li.files != 9000 || li.filesMax != 10000 || li.inodes != 120000 || li.pidMax != 32768 {
+		t.Errorf("wrong limits %+v", li)
+	}
+	// kthreadd has no fd directory, self isn't a pid
+	if li.procs.Len() != 2 {
+		t.Errorf("expected 2 processes got %d", li.procs.Len())
+	}
+
+	lines := strings.Split(li.InfoPrint(5), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected limits, top fds and a warning %q", lines)
+	}
+	want := "files: 9000/10000 (90.0%) inodes: 120000 free: 3000\tpids: 1000/32768 (3.1%) last:31000\tthreads: 1000/126000 (0.8%)"
+	if lines[0] != want {
+		t.Errorf("got %q\nwant %q", lines[0], want)
+	}
+	if lines[1] != "top fds: nginx[42] 9/10 systemd[1] 3/unlimited" {
+		t.Errorf("got %q", lines[1])
+	}
+	if lines[2] != "WARNING over 80% of limit: files 90.0%, nginx[42] fds 90.0%" {
+		t.Errorf("got %q", lines[2])
+	}
+}
+
+func TestLimitStatsMissing(t *testing.T) {
+	files := limitFiles()
+	delete(files, "proc/sys/kernel/threads-max")
+	if _, err := getLimitStats(new(LimitsInfo), 1, 1, files); err == nil {
+		t.Error("expected an error without threads-max")
+	}
+}
+
+func TestLimitStatsProcesses(t *testing.T) {
+	tests := []struct {
+		name       string
+		fsys       fs.FS
+		procs      int
+		unreadable int
+	}{
+		{"all readable", limitFiles(), 2, 0},
+		{"not ours", deniedFS{MapFS: limitFiles(), denied: "proc/42/fd"}, 1, 1},
+		{"exited", deniedFS{MapFS: limitFiles(), exited: "proc/42/fd"}, 1, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			li, err := getLimitStats(new(LimitsInfo), 1, 1, tc.fsys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if li.procs.Len() != tc.procs || li.unreadable != tc.unreadable {
+				t.Errorf("got %d processes %d unreadable, expected %d and %d",
+					li.procs.Len(), li.unreadable, tc.procs, tc.unreadable)
+			}
+		})
+	}
+}
@@ -2,12 +2,16 @@ package load
 
 import (
 	"fmt"
-	"log"
-	"os"
+	"io/fs"
 	"strconv"
 	"strings"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
 )
 
+const loadavgPath = "proc/loadavg"
+
 type Load struct {
 	one          float64
 	five         float64
@@ -40,13 +44,30 @@ func (ld *Load) InfoPrint() string {
 	return s
 }
 
+// Number of tasks, threads included, which is also the number of pids in use
+func (ld *Load) Tasks() int {
+	return ld.proc_total
+}
+
+// The most recently allocated pid
+func (ld *Load) LastPid() int {
+	return ld.lastpid
+}
+
 func LoadAvg() (*Load, error) {
-	f, err := os.ReadFile("/proc/loadavg")
+	return getLoadAvg(rootfs.FS)
+}
+
+func getLoadAvg(fsys fs.FS) (*Load, error) {
+	f, err := fs.ReadFile(fsys, loadavgPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	loadinfo := new(Load)
 	sp := strings.Split(strings.TrimSuffix(string(f), "\n"), " ")
+	if len(sp) <= int(LA_LASTPID) {
+		return nil, status.Errorf(loadavgPath, "%d fields", len(sp))
+	}
 
 	// The running/total process entries are not space-delimited so parse those
 	// a little different
@@ -71,6 +92,9 @@ func LoadAvg() (*Load, error) {
 		case LA_PROC_RUN:
 			// These are not space delimited but shown like X/Y in the loadavg file
 			procs := strings.Split(sp[i], "/")
+			if len(procs) != 2 {
+				return nil, status.Errorf(loadavgPath, "bad running/total %q", sp[i])
+			}
 			loadinfo.proc_running, err = strconv.Atoi(procs[0])
 			if err != nil {
 				return nil, err
@@ -0,0 +1,48 @@
+package load
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bioe007/synopsys/status"
+)
+
+func TestLoadAvg(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		tasks   int
+		lastPid int
+	}{
+		{name: "busy", data: "1.50 0.75 0.25 3/812 31000\n",
+			want: "r/t: 3/812\tla: 1.50,0.75,0.25", tasks: 812, lastPid: 31000},
+		{name: "no newline", data: "0.00 0.01 0.05 1/90 42",
+			want: "r/t: 1/90\tla: 0.00,0.01,0.05", tasks: 90, lastPid: 42},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ld, err := getLoadAvg(fstest.MapFS{"proc/loadavg": {Data: []byte(tc.data)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := ld.InfoPrint(); s != tc.want {
+				t.Errorf("got %q, expected %q", s, tc.want)
+			}
+			if ld.Tasks() != tc.tasks || ld.LastPid() != tc.lastPid {
+				t.Errorf("got %d tasks last pid %d", ld.Tasks(), ld.LastPid())
+			}
+		})
+	}
+}
+
+func TestLoadAvgBadFormat(t *testing.T) {
+	for _, bad := range []string{"1.50 0.75\n", "1.50 0.75 0.25 3-812 31000\n"} {
+		_, err := getLoadAvg(fstest.MapFS{"proc/loadavg": {Data: []byte(bad)}})
+		var fe *status.FormatError
+		if !errors.As(err, &fe) {
+			t.Errorf("%q: expected a format error, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package memory
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseMeminfo(t *testing.T) {
+	tests := []struct {
+		file         string
+		memTotal     int
+		memAvailable int
+		hugePages    int
+		provided     []string
+		missing      []string
+		other        map[string]int
+	}{
+		{
+			file:         "meminfo_test.txt",
+			memTotal:     0,
+			memAvailable: 2,
+			hugePages:    47,
+			provided:     []string{"Zswap", "SecPageTables", "Unaccepted", "DirectMap1G"},
+			other:        map[string]int{},
+		},
+		{
+			// RHEL 6, no MemAvailable, KReclaimable, Percpu or Zswap
+			file:      "meminfo_2.6.32_test.txt",
+			memTotal:  8060904,
+			hugePages: 0,
+			provided:  []string{"HardwareCorrupted", "AnonHugePages"},
+			missing:   []string{"MemAvailable", "KReclaimable", "Zswap", "Percpu", "DirectMap1G"},
+			other:     map[string]int{},
+		},
+		{
+			// 32bit arm has highmem and no hugepages
+			file:         "meminfo_armv7_test.txt",
+			memTotal:     949448,
+			memAvailable: 804964,
+			provided:     []string{"CmaTotal", "CmaFree"},
+			missing:      []string{"HugePages_Total", "DirectMap4k", "HardwareCorrupted"},
+			other: map[string]int{
+				"HighTotal": 204800,
+				"HighFree":  10264,
+				"LowTotal":  744648,
+				"LowFree":   578668,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			f, err := os.Open(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			m, err := parseMeminfo(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.MemTotal != tc.memTotal {
+				t.Errorf("MemTotal: got %d, expected %d", m.MemTotal, tc.memTotal)
+			}
+			if m.MemAvailable != tc.memAvailable {
+				t.Errorf("MemAvailable: got %d, expected %d", m.MemAvailable, tc.memAvailable)
+			}
+			if m.HugePages_Total != tc.hugePages {
+				t.Errorf("HugePages_Total: got %d, expected %d", m.HugePages_Total, tc.hugePages)
+			}
+			for _, k := range tc.provided {
+				if !m.Has(k) {
+					t.Errorf("%s should be provided", k)
+				}
+			}
+			for _, k := range tc.missing {
+				if m.Has(k) {
+					t.Errorf("%s should not be provided", k)
+				}
+			}
+			if len(m.Other) != len(tc.other) {
+				t.Errorf("unknown keys: got %v, expected %v", m.Other, tc.other)
+			}
+			for k, v := range tc.other {
+				if m.Other[k] != v {
+					t.Errorf("unknown key %s: got %d, expected %d", k, m.Other[k], v)
+				}
+			}
+		})
+	}
+}
+
+// Every field should land in the right place, meminfo_test.txt has
+// (nearly) every value set to its line number counting from zero.
+func TestParseMeminfoFields(t *testing.T) {
+	f, err := os.Open("meminfo_test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	m, err := parseMeminfo(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SwapFree != 15 || m.Dirty != 18 || m.SUnreclaim != 26 ||
+		m.Committed_AS != 34 || m.HardwareCorrupted != 39 || m.DirectMap1G != 55 {
+		t.Errorf("fields are out of place: %+v", m)
+	}
+	if m.Active_anon != 8 || m.Inactive_file != 11 {
+		t.Errorf("parenthesized keys are wrong: %+v", m)
+	}
+}
+
+func TestParseMeminfoErrors(t *testing.T) {
+	tests := map[string]string{
+		"non numeric":  "MemTotal: lots kB\n",
+		"no value":     "MemTotal:\n",
+		"no key":       "MemTotal 100 kB\n",
+		"no mem total": "MemFree: 100 kB\n",
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := parseMeminfo(strings.NewReader(data))
+			if err == nil {
+				t.Errorf("expected an error, got %+v", m)
+			}
+		})
+	}
+}
+
+func TestInfoPrintScale(t *testing.T) {
+	m := &Meminfo{
+		MemTotal:        4 * 1024 * 1024,
+		MemFree:         1024 * 1024,
+		MemAvailable:    3 * 1024 * 1024,
+		Dirty:           2048,
+		SUnreclaim:      10 * 1024,
+		Committed_AS:    6 * 1024 * 1024,
+		CommitLimit:     4 * 1024 * 1024,
+		HugePages_Total: 10,
+		HugePages_Free:  5,
+		Hugepagesize:    2048,
+		Provided:        map[string]bool{"MemAvailable": true},
+	}
+	defer SetScale(1024 * 1024)
+
+	SetScale(1024 * 1024)
+	s := m.InfoPrint()
+	expected := "free/tot: 1024/4096 avail: 3072 used: 25.0%\tbuff/cache:0/0\n" +
+		"dirty/wb: 2/0\tslab unrecl: 10\tpgtbl: 0\tcommit/limit: 6144/4096 (150%)" +
+		"\thuge used/tot: 10/20"
+	if s != expected {
+		t.Errorf("got\n%q\nexpected\n%q", s, expected)
+	}
+
+	SetScale(1024 * 1024 * 1024)
+	s = m.InfoPrint()
+	if !strings.HasPrefix(s, "free/tot: 1/4 avail: 3 ") {
+		t.Errorf("scale not applied: %q", s)
+	}
+}
+
+func TestAvailableOldKernel(t *testing.T) {
+	m := &Meminfo{MemTotal: 100, MemFree: 10, Buffers: 5, Cached: 20, SReclaimable: 5}
+	if m.Available() != 40 {
+		t.Errorf("expected estimated available 40, got %d", m.Available())
+	}
+	if m.UsedPercent() != 60 {
+		t.Errorf("expected 60%% used, got %f", m.UsedPercent())
+	}
+}
+
+func TestGetMeminfo(t *testing.T) {
+	m, err := getMeminfo(fstest.MapFS{
+		"proc/meminfo": {Data: []byte("MemTotal: 4096 kB\nMemFree: 1024 kB\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MemTotal != 4096 || m.MemFree != 1024 {
+		t.Errorf("wrong values %+v", m)
+	}
+	if _, err := getMeminfo(fstest.MapFS{}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist, got %v", err)
+	}
+}
@@ -1,18 +1,20 @@
 package memory
 
 import (
-	"encoding/csv"
+	"bufio"
 	"fmt"
 	"io"
-	"log"
-	"os"
+	"io/fs"
 	"strconv"
 	"strings"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
 )
 
-const MEMINFO_MAX = 57
+const meminfoPath = "proc/meminfo"
 
-// something in a comment
+// Values from /proc/meminfo, all in kB except the HugePages_ counts
 type Meminfo struct {
 	MemTotal          int
 	MemFree           int
@@ -71,409 +73,215 @@ type Meminfo struct {
 	DirectMap4k       int
 	DirectMap2M       int
 	DirectMap1G       int
-}
-
-type MemInfoFileLine int
 
-const (
-	MEMMemTotal MemInfoFileLine = iota
-	MEMMemFree
-	MEMMemAvailable
-	MEMBuffers
-	MEMCached
-	MEMSwapCached
-	MEMActive
-	MEMInactive
-	MEMActive_anon
-	MEMInactive_anon
-	MEMActive_file
-	MEMInactive_file
-	MEMUnevictable
-	MEMMlocked
-	MEMSwapTotal
-	MEMSwapFree
-	MEMZswap
-	MEMZswapped
-	MEMDirty
-	MEMWriteback
-	MEMAnonPages
-	MEMMapped
-	MEMShmem
-	MEMKReclaimable
-	MEMSlab
-	MEMSReclaimable
-	MEMSUnreclaim
-	MEMKernelStack
-	MEMPageTables
-	MEMSecPageTables
-	MEMNFS_Unstable
-	MEMBounce
-	MEMWritebackTmp
-	MEMCommitLimit
-	MEMCommitted_AS
-	MEMVmallocTotal
-	MEMVmallocUsed
-	MEMVmallocChunk
-	MEMPercpu
-	MEMHardwareCorrupted
-	MEMAnonHugePages
-	MEMShmemHugePages
-	MEMShmemPmdMapped
-	MEMFileHugePages
-	MEMFilePmdMapped
-	MEMCmaTotal
-	MEMCmaFree
-	MEMUnaccepted
-	MEMHugePages_Total
-	MEMHugePages_Free
-	MEMHugePages_Rsvd
-	MEMHugePages_Surp
-	MEMHugepagesize
-	MEMHugetlb
-	MEMDirectMap4k
-	MEMDirectMap2M
-	MEMDirectMap1G
-)
+	// Keys this version of Meminfo doesn't know about
+	Other map[string]int
+	// Every key the kernel reported
+	Provided map[string]bool
+}
 
+// The number of bytes in the display unit, meminfo itself is in kB
 var scale int
 
 func init() {
-	scale = 1024
+	scale = 1024 * 1024
 }
 
 func SetScale(v int) {
 	scale = v
 }
 
+// Convert a kB value from meminfo to the display unit
+func Scaled(kb int) int {
+	return kb * 1024 / scale
+}
+
+func percent(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(whole)
+}
+
+// Memory that can be given to new allocations without swapping. Kernels
+// before 3.14 don't report MemAvailable so make the same rough guess
+// free(1) used to.
+func (m *Meminfo) Available() int {
+	if m.Has("MemAvailable") {
+		return m.MemAvailable
+	}
+	return m.MemFree + m.Buffers + m.Cached + m.SReclaimable
+}
+
+// Percent of memory really in use, i.e. not available
+func (m *Meminfo) UsedPercent() float64 {
+	return percent(m.MemTotal-m.Available(), m.MemTotal)
+}
+
+// Percent of the commit limit that has been promised to processes, over 100
+// means the system is relying on overcommit.
+func (m *Meminfo) CommitPercent() float64 {
+	return percent(m.Committed_AS, m.CommitLimit)
+}
+
 func (m *Meminfo) InfoPrint() string {
 	// free/total cache buff
-	scale := 1024
 	s := fmt.Sprintf(
-		"free/tot: %d/%d\t\tbuff/cache:%d/%d",
-		m.MemFree/scale,
-		m.MemTotal/scale,
-		m.Buffers/scale,
-		m.Cached/scale,
+		"free/tot: %d/%d avail: %d used: %.1f%%\tbuff/cache:%d/%d\n",
+		Scaled(m.MemFree),
+		Scaled(m.MemTotal),
+		Scaled(m.Available()),
+		m.UsedPercent(),
+		Scaled(m.Buffers),
+		Scaled(m.Cached),
+	)
+
+	// These are the ones that point at leaks or writeback stalls
+	s += fmt.Sprintf(
+		"dirty/wb: %d/%d\tslab unrecl: %d\tpgtbl: %d\tcommit/limit: %d/%d (%.0f%%)",
+		Scaled(m.Dirty),
+		Scaled(m.Writeback),
+		Scaled(m.SUnreclaim),
+		Scaled(m.PageTables),
+		Scaled(m.Committed_AS),
+		Scaled(m.CommitLimit),
+		m.CommitPercent(),
 	)
+	if m.HugePages_Total > 0 {
+		used := m.HugePages_Total - m.HugePages_Free
+		s += fmt.Sprintf(
+			"\thuge used/tot: %d/%d",
+			Scaled(used*m.Hugepagesize),
+			Scaled(m.HugePages_Total*m.Hugepagesize),
+		)
+	}
 	return s
 }
 
+// Map the /proc/meminfo key names to where they're stored
+func (m *Meminfo) fields() map[string]*int {
+	return map[string]*int{
+		"MemTotal":          &m.MemTotal,
+		"MemFree":           &m.MemFree,
+		"MemAvailable":      &m.MemAvailable,
+		"Buffers":           &m.Buffers,
+		"Cached":            &m.Cached,
+		"SwapCached":        &m.SwapCached,
+		"Active":            &m.Active,
+		"Inactive":          &m.Inactive,
+		"Active(anon)":      &m.Active_anon,
+		"Inactive(anon)":    &m.Inactive_anon,
+		"Active(file)":      &m.Active_file,
+		"Inactive(file)":    &m.Inactive_file,
+		"Unevictable":       &m.Unevictable,
+		"Mlocked":           &m.Mlocked,
+		"SwapTotal":         &m.SwapTotal,
+		"SwapFree":          &m.SwapFree,
+		"Zswap":             &m.Zswap,
+		"Zswapped":          &m.Zswapped,
+		"Dirty":             &m.Dirty,
+		"Writeback":         &m.Writeback,
+		"AnonPages":         &m.AnonPages,
+		"Mapped":            &m.Mapped,
+		"Shmem":             &m.Shmem,
+		"KReclaimable":      &m.KReclaimable,
+		"Slab":              &m.Slab,
+		"SReclaimable":      &m.SReclaimable,
+		"SUnreclaim":        &m.SUnreclaim,
+		"KernelStack":       &m.KernelStack,
+		"PageTables":        &m.PageTables,
+		"SecPageTables":     &m.SecPageTables,
+		"NFS_Unstable":      &m.NFS_Unstable,
+		"Bounce":            &m.Bounce,
+		"WritebackTmp":      &m.WritebackTmp,
+		"CommitLimit":       &m.CommitLimit,
+		"Committed_AS":      &m.Committed_AS,
+		"VmallocTotal":      &m.VmallocTotal,
+		"VmallocUsed":       &m.VmallocUsed,
+		"VmallocChunk":      &m.VmallocChunk,
+		"Percpu":            &m.Percpu,
+		"HardwareCorrupted": &m.HardwareCorrupted,
+		"AnonHugePages":     &m.AnonHugePages,
+		"ShmemHugePages":    &m.ShmemHugePages,
+		"ShmemPmdMapped":    &m.ShmemPmdMapped,
+		"FileHugePages":     &m.FileHugePages,
+		"FilePmdMapped":     &m.FilePmdMapped,
+		"CmaTotal":          &m.CmaTotal,
+		"CmaFree":           &m.CmaFree,
+		"Unaccepted":        &m.Unaccepted,
+		"HugePages_Total":   &m.HugePages_Total,
+		"HugePages_Free":    &m.HugePages_Free,
+		"HugePages_Rsvd":    &m.HugePages_Rsvd,
+		"HugePages_Surp":    &m.HugePages_Surp,
+		"Hugepagesize":      &m.Hugepagesize,
+		"Hugetlb":           &m.Hugetlb,
+		"DirectMap4k":       &m.DirectMap4k,
+		"DirectMap2M":       &m.DirectMap2M,
+		"DirectMap1G":       &m.DirectMap1G,
+	}
+}
+
+// Check if the kernel reported a field, a zero value alone can't tell a
+// missing field from an empty one.
+func (m *Meminfo) Has(key string) bool {
+	return m.Provided[key]
+}
+
 func Getmeminfo() (*Meminfo, error) {
-	memfile, err := os.Open("/proc/meminfo")
-	// memfile, err := os.Open("./meminfo_test.txt")
+	return getMeminfo(rootfs.FS)
+}
+
+func getMeminfo(fsys fs.FS) (*Meminfo, error) {
+	memfile, err := fsys.Open(meminfoPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer memfile.Close()
 
-	c := csv.NewReader(memfile)
-	c.Comma = ':'
+	return parseMeminfo(memfile)
+}
+
+// Parse lines of 'Key:   value [kB]'. Fields differ between kernel versions
+// and architectures so nothing about the order or presence of a key is
+// assumed.
+func parseMeminfo(r io.Reader) (*Meminfo, error) {
 	m := new(Meminfo)
-	var i MemInfoFileLine
-	for i = MEMMemTotal; i < MEMINFO_MAX; i++ {
-		rec, err := c.Read()
-		if err == io.EOF {
-			break
+	m.Other = make(map[string]int)
+	m.Provided = make(map[string]bool)
+	fields := m.fields()
+
+	scanner := bufio.NewScanner(r)
+	for linenum := 1; scanner.Scan(); linenum++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
 		}
-		if err != nil {
-			log.Fatal("error from csv read", err)
+		key, rest, found := strings.Cut(line, ":")
+		if !found {
+			return nil, status.Errorf(meminfoPath, "line %d has no key: %q", linenum, line)
 		}
-
-		vw := strings.TrimSpace(strings.Fields(rec[1])[0])
-		value, err := strconv.Atoi(vw)
+		vals := strings.Fields(rest)
+		if len(vals) == 0 {
+			return nil, status.Errorf(meminfoPath, "line %d has no value: %q", linenum, line)
+		}
+		value, err := strconv.Atoi(vals[0])
 		if err != nil {
-			log.Fatal("can't convert value", err)
+			return nil, status.Errorf(meminfoPath, "unable to parse %s: %w", key, err)
 		}
-		switch i {
-		case MEMMemTotal:
-			m.MemTotal = value
-			if err != nil {
-				log.Fatal("Unable to parse MemTotal", err)
-			}
-		case MEMMemFree:
-			m.MemFree = value
-			if err != nil {
-				log.Fatal("Unable to parse MemFree", err)
-			}
-		case MEMMemAvailable:
-			m.MemAvailable = value
-			if err != nil {
-				log.Fatal("Unable to parse MemAvailable", err)
-			}
-		case MEMBuffers:
-			m.Buffers = value
-			if err != nil {
-				log.Fatal("Unable to parse Buffers", err)
-			}
-		case MEMCached:
-			m.Cached = value
-			if err != nil {
-				log.Fatal("Unable to parse Cached", err)
-			}
-		case MEMSwapCached:
-			m.SwapCached = value
-			if err != nil {
-				log.Fatal("Unable to parse SwapCached", err)
-			}
-		case MEMActive:
-			m.Active = value
-			if err != nil {
-				log.Fatal("Unable to parse Active", err)
-			}
-		case MEMInactive:
-			m.Inactive = value
-			if err != nil {
-				log.Fatal("Unable to parse Inactive", err)
-			}
-		case MEMActive_anon:
-			m.Active_anon = value
-			if err != nil {
-				log.Fatal("Unable to parse Active_anon", err)
-			}
-		case MEMInactive_anon:
-			m.Inactive_anon = value
-			if err != nil {
-				log.Fatal("Unable to parse Inactive_anon", err)
-			}
-		case MEMActive_file:
-			m.Active_file = value
-			if err != nil {
-				log.Fatal("Unable to parse Active_file", err)
-			}
-		case MEMInactive_file:
-			m.Inactive_file = value
-			if err != nil {
-				log.Fatal("Unable to parse Inactive_file", err)
-			}
-		case MEMUnevictable:
-			m.Unevictable = value
-			if err != nil {
-				log.Fatal("Unable to parse Unevictable", err)
-			}
-		case MEMMlocked:
-			m.Mlocked = value
-			if err != nil {
-				log.Fatal("Unable to parse Mlocked", err)
-			}
-		case MEMSwapTotal:
-			m.SwapTotal = value
-			if err != nil {
-				log.Fatal("Unable to parse SwapTotal", err)
-			}
-		case MEMSwapFree:
-			m.SwapFree = value
-			if err != nil {
-				log.Fatal("Unable to parse SwapFree", err)
-			}
-		case MEMZswap:
-			m.Zswap = value
-			if err != nil {
-				log.Fatal("Unable to parse Zswap", err)
-			}
-		case MEMZswapped:
-			m.Zswapped = value
-			if err != nil {
-				log.Fatal("Unable to parse Zswapped", err)
-			}
-		case MEMDirty:
-			m.Dirty = value
-			if err != nil {
-				log.Fatal("Unable to parse Dirty", err)
-			}
-		case MEMWriteback:
-			m.Writeback = value
-			if err != nil {
-				log.Fatal("Unable to parse Writeback", err)
-			}
-		case MEMAnonPages:
-			m.AnonPages = value
-			if err != nil {
-				log.Fatal("Unable to parse AnonPages", err)
-			}
-		case MEMMapped:
-			m.Mapped = value
-			if err != nil {
-				log.Fatal("Unable to parse Mapped", err)
-			}
-		case MEMShmem:
-			m.Shmem = value
-			if err != nil {
-				log.Fatal("Unable to parse Shmem", err)
-			}
-		case MEMKReclaimable:
-			m.KReclaimable = value
-			if err != nil {
-				log.Fatal("Unable to parse KReclaimable", err)
-			}
-		case MEMSlab:
-			m.Slab = value
-			if err != nil {
-				log.Fatal("Unable to parse Slab", err)
-			}
-		case MEMSReclaimable:
-			m.SReclaimable = value
-			if err != nil {
-				log.Fatal("Unable to parse SReclaimable", err)
-			}
-		case MEMSUnreclaim:
-			m.SUnreclaim = value
-			if err != nil {
-				log.Fatal("Unable to parse SUnreclaim", err)
-			}
-		case MEMKernelStack:
-			m.KernelStack = value
-			if err != nil {
-				log.Fatal("Unable to parse KernelStack", err)
-			}
-		case MEMPageTables:
-			m.PageTables = value
-			if err != nil {
-				log.Fatal("Unable to parse PageTables", err)
-			}
-		case MEMSecPageTables:
-			m.SecPageTables = value
-			if err != nil {
-				log.Fatal("Unable to parse SecPageTables", err)
-			}
-		case MEMNFS_Unstable:
-			m.NFS_Unstable = value
-			if err != nil {
-				log.Fatal("Unable to parse NFS_Unstable", err)
-			}
-		case MEMBounce:
-			m.Bounce = value
-			if err != nil {
-				log.Fatal("Unable to parse Bounce", err)
-			}
-		case MEMWritebackTmp:
-			m.WritebackTmp = value
-			if err != nil {
-				log.Fatal("Unable to parse WritebackTemp", err)
-			}
-		case MEMCommitLimit:
-			m.CommitLimit = value
-			if err != nil {
-				log.Fatal("Unable to parse CommitLimit", err)
-			}
-		case MEMCommitted_AS:
-			m.Committed_AS = value
-			if err != nil {
-				log.Fatal("Unable to parse CommitLimit_AS", err)
-			}
-		case MEMVmallocTotal:
-			m.VmallocTotal = value
-			if err != nil {
-				log.Fatal("Unable to parse VmallocTotal", err)
-			}
-		case MEMVmallocUsed:
-			m.VmallocUsed = value
-			if err != nil {
-				log.Fatal("Unable to parse VmallocUsed", err)
-			}
-		case MEMVmallocChunk:
-			m.VmallocChunk = value
-			if err != nil {
-				log.Fatal("Unable to parse VmallocChunk", err)
-			}
-		case MEMPercpu:
-			m.Percpu = value
-			if err != nil {
-				log.Fatal("Unable to parse Percpu", err)
-			}
-		case MEMHardwareCorrupted:
-			m.HardwareCorrupted = value
-			if err != nil {
-				log.Fatal("Unable to parse HardwareCorrupted", err)
-			}
-		case MEMAnonHugePages:
-			m.AnonHugePages = value
-			if err != nil {
-				log.Fatal("Unable to parse AnonHugePages", err)
-			}
-		case MEMShmemHugePages:
-			m.ShmemHugePages = value
-			if err != nil {
-				log.Fatal("Unable to parse ShmemHugePages", err)
-			}
-		case MEMShmemPmdMapped:
-			m.ShmemPmdMapped = value
-			if err != nil {
-				log.Fatal("Unable to parse ShmemPmdMapped", err)
-			}
-		case MEMFileHugePages:
-			m.FileHugePages = value
-			if err != nil {
-				log.Fatal("Unable to parse FileHugePages", err)
-			}
-		case MEMFilePmdMapped:
-			m.FilePmdMapped = value
-			if err != nil {
-				log.Fatal("Unable to parse FilePmdMapped", err)
-			}
-		case MEMCmaTotal:
-			m.CmaTotal = value
-			if err != nil {
-				log.Fatal("Unable to parse CmaTotal", err)
-			}
-		case MEMCmaFree:
-			m.CmaFree = value
-			if err != nil {
-				log.Fatal("Unable to parse CmaFree", err)
-			}
-		case MEMUnaccepted:
-			m.Unaccepted = value
-			if err != nil {
-				log.Fatal("Unable to parse Unaccepted", err)
-			}
-		case MEMHugePages_Total:
-			m.HugePages_Total = value
-			if err != nil {
-				log.Fatal("Unable to parse HugePages_Total", err)
-			}
-		case MEMHugePages_Free:
-			m.HugePages_Free = value
-			if err != nil {
-				log.Fatal("Unable to parse HugePages_Free", err)
-			}
-		case MEMHugePages_Rsvd:
-			m.HugePages_Rsvd = value
-			if err != nil {
-				log.Fatal("Unable to parse HugePages_Rsvd", err)
-			}
-		case MEMHugePages_Surp:
-			m.HugePages_Surp = value
-			if err != nil {
-				log.Fatal("Unable to parse HugePages_Surp", err)
-			}
-		case MEMHugepagesize:
-			m.Hugepagesize = value
-			if err != nil {
-				log.Fatal("Unable to parse Hugepagesize", err)
-			}
-		case MEMHugetlb:
-			m.Hugetlb = value
-			if err != nil {
-				log.Fatal("Unable to parse Hugetlb", err)
-			}
-		case MEMDirectMap4k:
-			m.DirectMap4k = value
-			if err != nil {
-				log.Fatal("Unable to parse DirectMap4k", err)
-			}
-		case MEMDirectMap2M:
-			m.DirectMap2M = value
-			if err != nil {
-				log.Fatal("Unable to parse DirectMap2M", err)
-			}
-		case MEMDirectMap1G:
-			m.DirectMap1G = value
-			if err != nil {
-				log.Fatal("Unable to parse DirectMap1G", err)
-			}
-		default:
-			log.Println("Unkown field, not parsing ", rec)
+
+		m.Provided[key] = true
+		if f, ok := fields[key]; ok {
+			*f = value
+		} else {
+			m.Other[key] = value
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !m.Has("MemTotal") {
+		return nil, status.Errorf(meminfoPath, "missing MemTotal")
+	}
 
 	return m, nil
 }
@@ -0,0 +1,166 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+const (
+	conntrackCountPath = "proc/sys/net/netfilter/nf_conntrack_count"
+	conntrackMaxPath   = "proc/sys/net/netfilter/nf_conntrack_max"
+	conntrackStatPath  = "proc/net/stat/nf_conntrack"
+)
+
+type conntrackSample struct {
+	count int
+	max   int
+	// Summed over all cpus, keyed by the column names in the header since
+	// those have changed between kernel versions.
+	stats map[string]int
+}
+
+type ConntrackInfo struct {
+	// Percent of the table in use to warn at
+	WarnPercent int
+
+	loaded  bool
+	old     *conntrackSample
+	new     *conntrackSample
+	oldTime time.Time
+	newTime time.Time
+}
+
+func readProcInt(fsys fs.FS, p string) (int, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, status.Errorf(p, "%w", err)
+	}
+	return v, nil
+}
+
+// The first line names the columns, then there is a line of hex per cpu
+func parseConntrackStat(r io.Reader) (map[string]int, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("nf_conntrack stat is empty")
+	}
+	names := strings.Fields(scanner.Text())
+	stats := make(map[string]int)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for i, f := range fields {
+			if i >= len(names) {
+				break
+			}
+			v, err := strconv.ParseUint(f, 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("nf_conntrack %s: %w", names[i], err)
+			}
+			// entries is the global count repeated on every line
+			if names[i] == "entries" {
+				stats[names[i]] = int(v)
+				continue
+			}
+			stats[names[i]] += int(v)
+		}
+	}
+	return stats, scanner.Err()
+}
+
+func getConntrackSample(fsys fs.FS) (*conntrackSample, error) {
+	cs := new(conntrackSample)
+	var err error
+	cs.count, err = readProcInt(fsys, conntrackCountPath)
+	if err != nil {
+		return nil, err
+	}
+	cs.max, err = readProcInt(fsys, conntrackMaxPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The per cpu stats can be missing, e.g. in a network namespace
+	f, err := fsys.Open(conntrackStatPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cs.stats, err = parseConntrackStat(f)
+	if err != nil {
+		return nil, status.Errorf(conntrackStatPath, "%w", err)
+	}
+	return cs, nil
+}
+
+// Get a ConntrackInfo and update it with new stats. When the nf_conntrack
+// module isn't loaded this isn't an error, the info just says so.
+func ConntrackStats(ci *ConntrackInfo) (*ConntrackInfo, error) {
+	return getConntrackStats(ci, rootfs.FS)
+}
+
+func getConntrackStats(ci *ConntrackInfo, fsys fs.FS) (*ConntrackInfo, error) {
+	cs, err := getConntrackSample(fsys)
+	if errors.Is(err, fs.ErrNotExist) {
+		ci.loaded = false
+		ci.old, ci.new = nil, nil
+		return ci, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ci.loaded = true
+	ci.old = ci.new
+	ci.oldTime = ci.newTime
+	ci.new = cs
+	ci.newTime = time.Now()
+	return ci, nil
+}
+
+func (ci *ConntrackInfo) usedPercent() float64 {
+	if ci.new.max == 0 {
+		return 0
+	}
+	return float64(ci.new.count) * 100 / float64(ci.new.max)
+}
+
+func (ci *ConntrackInfo) InfoPrint() string {
+	if !ci.loaded {
+		return "not loaded"
+	}
+
+	pct := ci.usedPercent()
+	s := fmt.Sprintf("%d/%d (%.1f%%)", ci.new.count, ci.new.max, pct)
+
+	elapsed := ci.newTime.Sub(ci.oldTime).Seconds()
+	if ci.old != nil && ci.old.stats != nil && ci.new.stats != nil && elapsed > 0 {
+		// each cpu's counter is 32 bit, the sums differ by the same amount
+		// modulo 2^32 when one wraps
+		rate := func(name string) float64 {
+			return float64(delta32(ci.new.stats[name], ci.old.stats[name])) / elapsed
+		}
+		s += fmt.Sprintf("\tinsert_failed/s: %.0f drop/s: %.0f early_drop/s: %.0f",
+			rate("insert_failed"), rate("drop"), rate("early_drop"))
+	}
+
+	if ci.WarnPercent > 0 && pct >= float64(ci.WarnPercent) {
+		s += fmt.Sprintf("\tWARNING table over %d%% full, new connections will be dropped when full",
+			ci.WarnPercent)
+	}
+	return s
+}
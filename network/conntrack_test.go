@@ -0,0 +1,99 @@
+package network
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func conntrackFiles(count, drop string) fstest.MapFS {
+	return fstest.MapFS{
+		"proc/sys/net/netfilter/nf_conntrack_count": {Data: []byte(count + "\n")},
+		"proc/sys/net/netfilter/nf_conntrack_max":   {Data: []byte("1000\n")},
+		"proc/net/stat/nf_conntrack": {Data: []byte(
+			"entries  clashres found new invalid ignore delete chainlength insert insert_failed drop early_drop icmp_error  expect_new expect_create expect_delete search_restart\n" +
+				"000003e8  00000000 00000000 00000000 00000010 00000000 00000000 00000000 00000000 00000001 " + drop + " 00000000 00000000  00000000 00000000 00000000 00000000\n" +
+				"000003e8  00000000 00000000 00000000 00000010 00000000 00000000 00000000 00000000 00000001 " + drop + " 00000002 00000000  00000000 00000000 00000000 00000000\n")},
+	}
+}
+
+func TestConntrackStats(t *testing.T) {
+	ci := &ConntrackInfo{WarnPercent: 80}
+	ci, err := getConntrackStats(ci, conntrackFiles("500", "00000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.new.stats["entries"] != 1000 || ci.new.stats["insert_failed"] != 2 || ci.new.stats["early_drop"] != 2 {
+		t.Errorf("wrong stats %v", ci.new.stats)
+	}
+	if s := ci.InfoPrint(); s != "500/1000 (50.0%)" {
+		t.Errorf("got %q", s)
+	}
+
+	ci, err = getConntrackStats(ci, conntrackFiles("900", "00000005"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci.oldTime = ci.newTime.Add(-time.Second)
+	s := ci.InfoPrint()
+	if !strings.HasPrefix(s, "900/1000 (90.0%)\tinsert_failed/s: 0 drop/s: 10 early_drop/s: 0") {
+		t.Errorf("wrong rates %q", s)
+	}
+	if !strings.Contains(s, "WARNING") {
+		t.Errorf("should warn over 80%% %q", s)
+	}
+}
+
+func TestConntrackChanging(t *testing.T) {
+	// 4.x had searched and delete_list where 5.x has clashres and chainlength
+	const oldHeader = "entries  searched found new invalid ignore delete delete_list insert insert_failed drop early_drop icmp_error  expect_new expect_create expect_delete search_restart\n"
+	cpuLine := func(drop string) string {
+		return "000003e8  00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 " + drop + " 00000000 00000000  00000000 00000000 00000000 00000000\n"
+	}
+	tests := []struct {
+		name   string
+		first  fstest.MapFS
+		second fstest.MapFS
+		want   string
+	}{
+		{name: "not loaded", first: fstest.MapFS{}, second: fstest.MapFS{}, want: "not loaded"},
+		// loaded, but no per cpu stats like in a network namespace
+		{name: "no stats", first: conntrackFiles("1", "0"), second: func() fstest.MapFS {
+			f := conntrackFiles("1", "0")
+			delete(f, "proc/net/stat/nf_conntrack")
+			return f
+		}(), want: "1/1000 (0.1%)"},
+		{name: "older columns",
+			first: fstest.MapFS{
+				"proc/sys/net/netfilter/nf_conntrack_count": {Data: []byte("10\n")},
+				"proc/sys/net/netfilter/nf_conntrack_max":   {Data: []byte("1000\n")},
+				"proc/net/stat/nf_conntrack":                {Data: []byte(oldHeader + cpuLine("00000001"))},
+			},
+			second: fstest.MapFS{
+				"proc/sys/net/netfilter/nf_conntrack_count": {Data: []byte("10\n")},
+				"proc/sys/net/netfilter/nf_conntrack_max":   {Data: []byte("1000\n")},
+				"proc/net/stat/nf_conntrack":                {Data: []byte(oldHeader + cpuLine("00000004"))},
+			},
+			want: "10/1000 (1.0%)\tinsert_failed/s: 0 drop/s: 3 early_drop/s: 0"},
+		// one cpu's 32 bit drop counter went round
+		{name: "wrapped", first: conntrackFiles("1", "fffffffe"), second: conntrackFiles("1", "00000001"),
+			want: "1/1000 (0.1%)\tinsert_failed/s: 0 drop/s: 6 early_drop/s: 0"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ci, err := getConntrackStats(new(ConntrackInfo), tc.first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ci, err = getConntrackStats(ci, tc.second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ci.oldTime = ci.newTime.Add(-time.Second)
+			if s := ci.InfoPrint(); s != tc.want {
+				t.Errorf("got %q, expected %q", s, tc.want)
+			}
+		})
+	}
+}
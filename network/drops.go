@@ -0,0 +1,257 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+// How many sockets with drops to show
+const numDropSockets = 5
+
+// The Udp: counters from /proc/net/snmp
+type udpCounters struct {
+	inDatagrams  int
+	noPorts      int // received for a port nothing is listening on
+	inErrors     int
+	rcvbufErrors int // receive buffer was full
+	sndbufErrors int // send buffer was full
+}
+
+// One cpu's line of /proc/net/softnet_stat
+type softnet struct {
+	cpu         int
+	processed   int
+	dropped     int // the backlog queue was full
+	timeSqueeze int // ran out of budget with work left to do
+}
+
+type dropSample struct {
+	udp     udpCounters
+	sockets map[int]*socket // udp sockets by inode
+	softnet []*softnet
+}
+
+type DropInfo struct {
+	old     *dropSample
+	new     *dropSample
+	oldTime time.Time
+	newTime time.Time
+}
+
+// /proc/net/snmp is pairs of lines, one with names and the next with values
+func parseSnmpUdp(r io.Reader) (udpCounters, error) {
+	var c udpCounters
+	var names []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "Udp:" {
+			continue
+		}
+		if names == nil {
+			names = fields[1:]
+			continue
+		}
+		dest := map[string]*int{
+			"InDatagrams":  &c.inDatagrams,
+			"NoPorts":      &c.noPorts,
+			"InErrors":     &c.inErrors,
+			"RcvbufErrors": &c.rcvbufErrors,
+			"SndbufErrors": &c.sndbufErrors,
+		}
+		for i, v := range fields[1:] {
+			if i >= len(names) {
+				break
+			}
+			if d, ok := dest[names[i]]; ok {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return c, fmt.Errorf("snmp Udp %s: %w", names[i], err)
+				}
+				*d = n
+			}
+		}
+		return c, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return c, err
+	}
+	return c, fmt.Errorf("no Udp counters in snmp")
+}
+
+// The columns are hex, the cpu number was added as the 13th column in 5.10.
+// Before that the line number is the cpu, which is wrong when some are
+// offline.
+func parseSoftnet(r io.Reader) ([]*softnet, error) {
+	var stats []*softnet
+	scanner := bufio.NewScanner(r)
+	for line := 0; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		vals := make([]int, len(fields))
+		for i, f := range fields {
+			v, err := strconv.ParseUint(f, 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("softnet_stat line %d: %w", line, err)
+			}
+			vals[i] = int(v)
+		}
+		sn := &softnet{cpu: line, processed: vals[0], dropped: vals[1], timeSqueeze: vals[2]}
+		if len(vals) > 12 {
+			sn.cpu = vals[12]
+		}
+		stats = append(stats, sn)
+	}
+	return stats, scanner.Err()
+}
+
+func getDropSample(fsys fs.FS) (*dropSample, error) {
+	ds := new(dropSample)
+
+	f, err := fsys.Open("proc/net/snmp")
+	if err != nil {
+		return nil, err
+	}
+	ds.udp, err = parseSnmpUdp(f)
+	f.Close()
+	if err != nil {
+		return nil, status.Errorf("proc/net/snmp", "%w", err)
+	}
+
+	udp, err := readInetSockets(fsys, "udp", "udp6")
+	if err != nil {
+		return nil, err
+	}
+	ds.sockets = make(map[int]*socket)
+	for _, s := range udp {
+		ds.sockets[s.inode] = s
+	}
+
+	f, err = fsys.Open("proc/net/softnet_stat")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ds.softnet, err = parseSoftnet(f)
+	if err != nil {
+		return nil, status.Errorf("proc/net/softnet_stat", "%w", err)
+	}
+	return ds, nil
+}
+
+// softnet_stat counters are 32 bit and wrap on busy hosts, the difference
+// modulo 2^32 is right as long as they didn't go all the way round
+func delta32(cur, prev int) int {
+	return int(uint32(cur - prev))
+}
+
+// Get a DropInfo and update it with new counters
+func DropStats(di *DropInfo) (*DropInfo, error) {
+	return getDropStats(di, rootfs.FS)
+}
+
+func getDropStats(di *DropInfo, fsys fs.FS) (*DropInfo, error) {
+	ds, err := getDropSample(fsys)
+	if err != nil {
+		return nil, err
+	}
+	di.old = di.new
+	di.oldTime = di.newTime
+	di.new = ds
+	di.newTime = time.Now()
+	return di, nil
+}
+
+type socketDrops struct {
+	s     *socket
+	delta int
+}
+
+func (di *DropInfo) InfoPrint() string {
+	if di.old == nil {
+		return ""
+	}
+	elapsed := di.newTime.Sub(di.oldTime).Seconds()
+	if elapsed <= 0 {
+		return ""
+	}
+	perSec := func(cur, prev int) float64 {
+		return float64(cur-prev) / elapsed
+	}
+
+	var sb strings.Builder
+	cur, prev := di.new.udp, di.old.udp
+	sb.WriteString(fmt.Sprintf(
+		"udp/s in: %.0f inerr: %.0f rcvbuf: %.0f sndbuf: %.0f noports: %.0f\n",
+		perSec(cur.inDatagrams, prev.inDatagrams),
+		perSec(cur.inErrors, prev.inErrors),
+		perSec(cur.rcvbufErrors, prev.rcvbufErrors),
+		perSec(cur.sndbufErrors, prev.sndbufErrors),
+		perSec(cur.noPorts, prev.noPorts),
+	))
+
+	// Sockets that are dropping now first, then the ones that dropped before
+	var dropping []*socketDrops
+	for inode, s := range di.new.sockets {
+		if s.drops == 0 {
+			continue
+		}
+		d := &socketDrops{s: s, delta: s.drops}
+		// a new socket can get a closed one's inode, it starts from zero
+		if old, ok := di.old.sockets[inode]; ok && s.drops >= old.drops {
+			d.delta = s.drops - old.drops
+		}
+		dropping = append(dropping, d)
+	}
+	if len(dropping) > 0 {
+		sort.Slice(dropping, func(i, j int) bool {
+			if dropping[i].delta != dropping[j].delta {
+				return dropping[i].delta > dropping[j].delta
+			}
+			return dropping[i].s.drops > dropping[j].s.drops
+		})
+		sb.WriteString("udp socket drops +new/total:")
+		for _, d := range dropping[:min(len(dropping), numDropSockets)] {
+			sb.WriteString(fmt.Sprintf(" %s +%d/%d", d.s.local, d.delta, d.s.drops))
+		}
+		sb.WriteString("\n")
+	}
+
+	// Only show cpus that are dropping or squeezed, there can be hundreds
+	var total, squeezed float64
+	var busy strings.Builder
+	prevSoftnet := make(map[int]*softnet)
+	for _, sn := range di.old.softnet {
+		prevSoftnet[sn.cpu] = sn
+	}
+	for _, sn := range di.new.softnet {
+		p, ok := prevSoftnet[sn.cpu]
+		if !ok {
+			continue
+		}
+		dropped := float64(delta32(sn.dropped, p.dropped)) / elapsed
+		squeeze := float64(delta32(sn.timeSqueeze, p.timeSqueeze)) / elapsed
+		total += dropped
+		squeezed += squeeze
+		if dropped > 0 || squeeze > 0 {
+			busy.WriteString(fmt.Sprintf(" cpu%d %.0f/%.0f", sn.cpu, dropped, squeeze))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("softnet/s drop: %.0f squeeze: %.0f", total, squeezed))
+	if busy.Len() > 0 {
+		sb.WriteString("\tdrop/squeeze:" + busy.String())
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
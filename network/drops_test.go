@@ -0,0 +1,126 @@
+package network
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func dropFiles(errs, drops, softnetDropped string) fstest.MapFS {
+	return fstest.MapFS{
+		"proc/net/snmp": {Data: []byte(
+			"Ip: Forwarding DefaultTTL\nIp: 1 64\n" +
+				"Udp: InDatagrams NoPorts InErrors OutDatagrams RcvbufErrors SndbufErrors InCsumErrors IgnoredMulti MemErrors\n" +
+				"Udp: 1000 2 " + errs + " 900 " + errs + " 0 0 0 0\n" +
+				"UdpLite: InDatagrams NoPorts InErrors OutDatagrams RcvbufErrors SndbufErrors InCsumErrors IgnoredMulti MemErrors\n" +
+				"UdpLite: 0 0 0 0 0 0 0 0 0\n")},
+		"proc/net/udp": {Data: []byte("   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops\n" +
+			"  10: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 200 2 0000000000000000 " + drops + "\n" +
+			"  11: 00000000:0044 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 201 2 0000000000000000 0\n")},
+		"proc/net/softnet_stat": {Data: []byte(
+			"00000793 00000000 00000001 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000\n" +
+				"00000100 " + softnetDropped + " 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000003 00000000 00000000\n")},
+	}
+}
+
+func TestParseSoftnet(t *testing.T) {
+	f, _ := dropFiles("0", "0", "0000000a").Open("proc/net/softnet_stat")
+	stats, err := parseSoftnet(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 cpus, got %d", len(stats))
+	}
+	if stats[0].cpu != 0 || stats[0].processed != 0x793 || stats[0].timeSqueeze != 1 {
+		t.Errorf("wrong cpu0 %+v", stats[0])
+	}
+	// cpus 1 and 2 are offline
+	if stats[1].cpu != 3 || stats[1].dropped != 10 {
+		t.Errorf("wrong cpu3 %+v", stats[1])
+	}
+
+	// older kernels don't have the cpu column
+	stats, err = parseSoftnet(strings.NewReader("00000001 00000002 00000003 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000\n" +
+		"00000001 00000002 00000003 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[1].cpu != 1 {
+		t.Errorf("expected line number as cpu, got %d", stats[1].cpu)
+	}
+}
+
+func TestDropStats(t *testing.T) {
+	di := new(DropInfo)
+	di, err := getDropStats(di, dropFiles("5", "40", "00000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if di.new.udp.inErrors != 5 || di.new.udp.noPorts != 2 || di.new.udp.inDatagrams != 1000 {
+		t.Errorf("wrong udp counters %+v", di.new.udp)
+	}
+	if di.new.sockets[200].drops != 40 {
+		t.Errorf("wrong socket drops %+v", di.new.sockets[200])
+	}
+	if di.InfoPrint() != "" {
+		t.Error("nothing to show without two samples")
+	}
+
+	di, err = getDropStats(di, dropFiles("15", "60", "00000014"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	di.oldTime = di.newTime.Add(-2 * time.Second)
+
+	lines := strings.Split(di.InfoPrint(), "\n")
+	if lines[0] != "udp/s in: 0 inerr: 5 rcvbuf: 5 sndbuf: 0 noports: 0" {
+		t.Errorf("wrong udp rates %q", lines[0])
+	}
+	if lines[1] != "udp socket drops +new/total: 0.0.0.0:53 +20/60" {
+		t.Errorf("wrong socket drops %q", lines[1])
+	}
+	if lines[2] != "softnet/s drop: 10 squeeze: 0\tdrop/squeeze: cpu3 10/0" {
+		t.Errorf("wrong softnet %q", lines[2])
+	}
+}
+
+func TestDropRatesCounters(t *testing.T) {
+	tests := []struct {
+		name       string
+		old, new   *dropSample
+		socketLine string
+		softLine   string
+	}{
+		// the 32 bit softnet counters went round
+		{name: "softnet wrap",
+			old:      &dropSample{softnet: []*softnet{{cpu: 0, dropped: 0xfffffff0}}},
+			new:      &dropSample{softnet: []*softnet{{cpu: 0, dropped: 0x10}}},
+			softLine: "softnet/s drop: 32 squeeze: 0\tdrop/squeeze: cpu0 32/0"},
+		// cpu1 went offline, cpu2 came online
+		{name: "cpu hotplug",
+			old:      &dropSample{softnet: []*softnet{{cpu: 1, dropped: 100}}},
+			new:      &dropSample{softnet: []*softnet{{cpu: 2, dropped: 5}}},
+			softLine: "softnet/s drop: 0 squeeze: 0"},
+		// a new socket got the closed one's inode
+		{name: "inode reused",
+			old:        &dropSample{sockets: map[int]*socket{7: {local: netip.MustParseAddrPort("0.0.0.0:53"), drops: 500}}},
+			new:        &dropSample{sockets: map[int]*socket{7: {local: netip.MustParseAddrPort("0.0.0.0:123"), drops: 3}}},
+			socketLine: "udp socket drops +new/total: 0.0.0.0:123 +3/3"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			di := &DropInfo{old: tc.old, new: tc.new}
+			di.newTime = time.Now()
+			di.oldTime = di.newTime.Add(-time.Second)
+			out := di.InfoPrint()
+			for _, want := range []string{tc.socketLine, tc.softLine} {
+				if want != "" && !strings.Contains(out, want+"\n") {
+					t.Errorf("missing %q in\n%s", want, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package network
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+const (
+	netdevPath   = "proc/net/dev"
+	sysNetPath   = "sys/class/net"
+	bondingPath  = "proc/net/bonding"
+	speedUnknown = -1
+)
+
+// Counters from /proc/net/dev along with the link details from
+// /sys/class/net/<if>
+type ifaceStat struct {
+	name      string
+	rxBytes   int
+	rxPackets int
+	rxErrs    int
+	rxDrop    int
+	txBytes   int
+	txPackets int
+	txErrs    int
+	txDrop    int
+
+	speed          int // Mb/s, or speedUnknown for virtual devices
+	duplex         string
+	operstate      string
+	mtu            int
+	carrierChanges int
+}
+
+// Per-second values between two samples
+type ifaceValues struct {
+	name    string
+	rxBps   float64 // bytes
+	txBps   float64
+	rxPps   float64 // packets
+	txPps   float64
+	errs    float64
+	drops   float64
+	util    float64 // percent of link speed, of the busier direction
+	flapped int     // carrier changes since the last sample
+	link    *ifaceStat
+}
+
+type ifaceHeap []*ifaceValues
+
+func (h ifaceHeap) Len() int { return len(h) }
+func (h ifaceHeap) Less(i, j int) bool {
+	return h[i].rxBps+h[i].txBps > h[j].rxBps+h[j].txBps
+}
+func (h ifaceHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *ifaceHeap) Push(x any)   { *h = append(*h, x.(*ifaceValues)) }
+func (h *ifaceHeap) Pop() any {
+	old := *h
+	n := len(old)
+	if n == 0 {
+		return nil
+	}
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+type bondSlave struct {
+	name         string
+	mii          string
+	linkFailures int
+}
+
+// Status of a bonding or team master from /proc/net/bonding/<bond>
+type bond struct {
+	name   string
+	mode   string
+	mii    string
+	active string // only for active-backup
+	slaves []*bondSlave
+}
+
+type NetInfo struct {
+	old     map[string]*ifaceStat
+	new     map[string]*ifaceStat
+	oldTime time.Time
+	newTime time.Time
+	values  *ifaceHeap
+	bonds   []*bond
+}
+
+// Parse /proc/net/dev, two header lines then 'name: rx counters tx counters'
+func parseNetdev(r io.Reader) (map[string]*ifaceStat, error) {
+	ifaces := make(map[string]*ifaceStat)
+	scanner := bufio.NewScanner(r)
+	for linenum := 0; scanner.Scan(); linenum++ {
+		if linenum < 2 {
+			continue
+		}
+		name, counters, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("net/dev line %d too short", linenum)
+		}
+		vals := make([]int, 16)
+		for i := range vals {
+			v, err := strconv.Atoi(fields[i])
+			if err != nil {
+				return nil, fmt.Errorf("net/dev %s: %w", name, err)
+			}
+			vals[i] = v
+		}
+		is := &ifaceStat{
+			name:      strings.TrimSpace(name),
+			rxBytes:   vals[0],
+			rxPackets: vals[1],
+			rxErrs:    vals[2],
+			rxDrop:    vals[3],
+			txBytes:   vals[8],
+			txPackets: vals[9],
+			txErrs:    vals[10],
+			txDrop:    vals[11],
+			speed:     speedUnknown,
+		}
+		ifaces[is.name] = is
+	}
+	return ifaces, scanner.Err()
+}
+
+func readSysString(fsys fs.FS, p string) string {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Add the sysfs link details. Reading speed of a down link is EINVAL and
+// virtual devices report -1, either way it's unknown.
+func readLink(fsys fs.FS, is *ifaceStat) {
+	dir := path.Join(sysNetPath, is.name)
+	if v, err := strconv.Atoi(readSysString(fsys, path.Join(dir, "speed"))); err == nil && v > 0 {
+		is.speed = v
+	}
+	is.duplex = readSysString(fsys, path.Join(dir, "duplex"))
+	is.operstate = readSysString(fsys, path.Join(dir, "operstate"))
+	is.mtu, _ = strconv.Atoi(readSysString(fsys, path.Join(dir, "mtu")))
+	is.carrierChanges, _ = strconv.Atoi(readSysString(fsys, path.Join(dir, "carrier_changes")))
+}
+
+func parseBond(name string, r io.Reader) (*bond, error) {
+	b := &bond{name: name}
+	var slave *bondSlave
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		k, v, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		switch strings.TrimSpace(k) {
+		case "Bonding Mode":
+			b.mode = v
+		case "Currently Active Slave":
+			b.active = v
+		case "Slave Interface":
+			slave = &bondSlave{name: v}
+			b.slaves = append(b.slaves, slave)
+		case "MII Status":
+			// the first one is for the bond itself
+			if slave == nil {
+				b.mii = v
+			} else {
+				slave.mii = v
+			}
+		case "Link Failure Count":
+			if slave != nil {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, fmt.Errorf("bond %s: %w", name, err)
+				}
+				slave.linkFailures = n
+			}
+		}
+	}
+	return b, scanner.Err()
+}
+
+func readBonds(fsys fs.FS) ([]*bond, error) {
+	entries, err := fs.ReadDir(fsys, bondingPath)
+	// no bonding module
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bonds []*bond
+	for _, e := range entries {
+		f, err := fsys.Open(path.Join(bondingPath, e.Name()))
+		// removed since listing them
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := parseBond(e.Name(), f)
+		f.Close()
+		if err != nil {
+			return nil, status.Errorf(path.Join(bondingPath, e.Name()), "%w", err)
+		}
+		bonds = append(bonds, b)
+	}
+	return bonds, nil
+}
+
+func (ni *NetInfo) estimate() {
+	if len(ni.old) == 0 {
+		return
+	}
+	elapsed := ni.newTime.Sub(ni.oldTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	ni.values = new(ifaceHeap)
+	heap.Init(ni.values)
+	for name, cur := range ni.new {
+		prev, ok := ni.old[name]
+		// interfaces can come and go, or be made again with the same name
+		// and counters starting over
+		if !ok || cur.rxBytes < prev.rxBytes || cur.txBytes < prev.txBytes {
+			continue
+		}
+		v := &ifaceValues{name: name, link: cur}
+		v.rxBps = float64(cur.rxBytes-prev.rxBytes) / elapsed
+		v.txBps = float64(cur.txBytes-prev.txBytes) / elapsed
+		v.rxPps = float64(cur.rxPackets-prev.rxPackets) / elapsed
+		v.txPps = float64(cur.txPackets-prev.txPackets) / elapsed
+		v.errs = float64(cur.rxErrs+cur.txErrs-prev.rxErrs-prev.txErrs) / elapsed
+		v.drops = float64(cur.rxDrop+cur.txDrop-prev.rxDrop-prev.txDrop) / elapsed
+		v.flapped = cur.carrierChanges - prev.carrierChanges
+		if cur.speed != speedUnknown {
+			// speed is Mb/s, full duplex means each direction gets all of it
+			v.util = max(v.rxBps, v.txBps) * 8 / (float64(cur.speed) * 1e6) * 100
+		}
+		heap.Push(ni.values, v)
+	}
+}
+
+// Get a NetInfo and update it with new stats
+func NetStats(ni *NetInfo) (*NetInfo, error) {
+	return getNetStats(ni, rootfs.FS)
+}
+
+func getNetStats(ni *NetInfo, fsys fs.FS) (*NetInfo, error) {
+	f, err := fsys.Open(netdevPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ifaces, err := parseNetdev(f)
+	if err != nil {
+		return nil, status.Errorf(netdevPath, "%w", err)
+	}
+	for _, is := range ifaces {
+		readLink(fsys, is)
+	}
+	bonds, err := readBonds(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	ni.old = ni.new
+	ni.oldTime = ni.newTime
+	ni.new = ifaces
+	ni.newTime = time.Now()
+	ni.bonds = bonds
+	ni.estimate()
+	return ni, nil
+}
+
+func (v *ifaceValues) String() string {
+	s := fmt.Sprintf("%s rx: %.0fKB/s %.0fp/s tx: %.0fKB/s %.0fp/s",
+		v.name, v.rxBps/1024, v.rxPps, v.txBps/1024, v.txPps)
+	if v.errs > 0 || v.drops > 0 {
+		s += fmt.Sprintf(" err/s: %.0f drop/s: %.0f", v.errs, v.drops)
+	}
+	if v.link.speed != speedUnknown {
+		s += fmt.Sprintf(" util: %.1f%% %dMb/s %s", v.util, v.link.speed, v.link.duplex)
+	}
+	s += fmt.Sprintf(" %s mtu:%d", v.link.operstate, v.link.mtu)
+	if v.flapped > 0 {
+		s += fmt.Sprintf(" FLAPPED x%d", v.flapped)
+	}
+	return s
+}
+
+func (b *bond) String() string {
+	s := fmt.Sprintf("%s %s %s", b.name, b.mode, b.mii)
+	if b.active != "" {
+		s += " active:" + b.active
+	}
+	for _, sl := range b.slaves {
+		s += fmt.Sprintf(" %s:%s", sl.name, sl.mii)
+		if sl.linkFailures > 0 {
+			s += fmt.Sprintf("(fail %d)", sl.linkFailures)
+		}
+	}
+	return s
+}
+
+// Show the num_ifaces busiest interfaces. Interfaces that flapped are always
+// shown, even if they wouldn't make the cut.
+func (ni *NetInfo) InfoPrint(num_ifaces int) string {
+	if ni.values == nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	var rest []*ifaceValues
+	for shown := 0; ni.values.Len() > 0; {
+		v := heap.Pop(ni.values).(*ifaceValues)
+		if shown < num_ifaces {
+			sb.WriteString(v.String() + "\n")
+			shown++
+		} else if v.flapped > 0 {
+			rest = append(rest, v)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].name < rest[j].name })
+	for _, v := range rest {
+		sb.WriteString(v.String() + "\n")
+	}
+
+	for _, b := range ni.bonds {
+		sb.WriteString(b.String() + "\n")
+	}
+	return sb.String()
+}
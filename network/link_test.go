@@ -0,0 +1,147 @@
+package network
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+const netdevHeader = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+`
+
+func linkFiles(eth0rx, eth1rx, carrier string) fstest.MapFS {
+	return fstest.MapFS{
+		"proc/net/dev": {Data: []byte(netdevHeader +
+			"    lo: 1000 10 0 0 0 0 0 0 1000 10 0 0 0 0 0 0\n" +
+			"  eth0: " + eth0rx + " 100 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n" +
+			"  eth1: " + eth1rx + " 100 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n" +
+			" bond0: 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n")},
+		"sys/class/net/eth0/speed":           {Data: []byte("1000\n")},
+		"sys/class/net/eth0/duplex":          {Data: []byte("full\n")},
+		"sys/class/net/eth0/operstate":       {Data: []byte("up\n")},
+		"sys/class/net/eth0/mtu":             {Data: []byte("9000\n")},
+		"sys/class/net/eth0/carrier_changes": {Data: []byte("2\n")},
+		"sys/class/net/eth1/speed":           {Data: []byte("-1\n")},
+		"sys/class/net/eth1/operstate":       {Data: []byte("up\n")},
+		"sys/class/net/eth1/mtu":             {Data: []byte("1500\n")},
+		"sys/class/net/eth1/carrier_changes": {Data: []byte(carrier + "\n")},
+		"proc/net/bonding/bond0": {Data: []byte(`Ethernet Channel Bonding Driver: v5.15.0
+
+Bonding Mode: fault-tolerance (active-backup)
+Primary Slave: None
+Currently Active Slave: eth0
+MII Status: up
+MII Polling Interval (ms): 100
+
+Slave Interface: eth0
+MII Status: up
+Speed: 1000 Mbps
+Link Failure Count: 0
+
+Slave Interface: eth1
+MII Status: down
+Speed: Unknown
+Link Failure Count: 3
+`)},
+	}
+}
+
+func TestNetStats(t *testing.T) {
+	ni := new(NetInfo)
+	ni, err := getNetStats(ni, linkFiles("0", "0", "4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth0 := ni.new["eth0"]
+	if eth0.speed != 1000 || eth0.duplex != "full" || eth0.mtu != 9000 || eth0.carrierChanges != 2 {
+		t.Errorf("wrong link %+v", eth0)
+	}
+	if ni.new["eth1"].speed != speedUnknown {
+		t.Errorf("negative speed should be unknown %d", ni.new["eth1"].speed)
+	}
+	if len(ni.bonds) != 1 || len(ni.bonds[0].slaves) != 2 {
+		t.Fatalf("wrong bonds %+v", ni.bonds)
+	}
+	if ni.InfoPrint(4) != "" {
+		t.Error("nothing to show without two samples")
+	}
+
+	// 2s later eth0 received 250MB, eth1 10MB and flapped
+	ni, err = getNetStats(ni, linkFiles("250000000", "10000000", "6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni.oldTime = ni.newTime.Add(-2 * time.Second)
+	ni.estimate()
+
+	lines := strings.Split(ni.InfoPrint(1), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected top interface, the flapped one and the bond %q", lines)
+	}
+	if !strings.HasPrefix(lines[0], "eth0 rx: 122070KB/s") || !strings.Contains(lines[0], "util: 100.0% 1000Mb/s full up mtu:9000") {
+		t.Errorf("wrong eth0 %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "eth1 ") || !strings.HasSuffix(lines[1], "FLAPPED x2") {
+		t.Errorf("eth1 flapped and should be shown %q", lines[1])
+	}
+	if lines[2] != "bond0 fault-tolerance (active-backup) up active:eth0 eth0:up eth1:down(fail 3)" {
+		t.Errorf("wrong bond %q", lines[2])
+	}
+}
+
+// Like sysfs and procfs when something is removed between listing and
+// reading it
+type goneFS struct {
+	fstest.MapFS
+	gone string
+}
+
+func (g goneFS) Open(name string) (fs.File, error) {
+	if name == g.gone {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return g.MapFS.Open(name)
+}
+
+func TestNetStatsChanging(t *testing.T) {
+	tests := []struct {
+		name   string
+		second fs.FS
+		shown  []string
+		hidden []string
+	}{
+		// eth1 was removed and made again, its counters started over
+		{name: "recreated", second: linkFiles("250000000", "5", "4"),
+			shown: []string{"eth0 "}, hidden: []string{"eth1 "}},
+		{name: "bond removed", second: goneFS{linkFiles("250000000", "10000000", "4"), "proc/net/bonding/bond0"},
+			shown: []string{"eth0 ", "eth1 "}, hidden: []string{"bond0 fault-tolerance"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ni, err := getNetStats(new(NetInfo), linkFiles("1000", "10000", "4"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ni, err = getNetStats(ni, tc.second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ni.oldTime = ni.newTime.Add(-time.Second)
+			ni.estimate()
+			out := ni.InfoPrint(4)
+			for _, want := range tc.shown {
+				if !strings.Contains(out, want) {
+					t.Errorf("missing %q in\n%s", want, out)
+				}
+			}
+			for _, unwanted := range tc.hidden {
+				if strings.Contains(out, unwanted) {
+					t.Errorf("unexpected %q in\n%s", unwanted, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package network
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+// TCP states as numbered in include/net/tcp_states.h
+var tcpStates = []string{
+	1:  "ESTABLISHED",
+	2:  "SYN_SENT",
+	3:  "SYN_RECV",
+	4:  "FIN_WAIT1",
+	5:  "FIN_WAIT2",
+	6:  "TIME_WAIT",
+	7:  "CLOSE",
+	8:  "CLOSE_WAIT",
+	9:  "LAST_ACK",
+	10: "LISTEN",
+	11: "CLOSING",
+	12: "NEW_SYN_RECV",
+}
+
+const tcpListen = 10
+
+// Unix socket states from include/uapi/linux/net.h
+var unixStates = []string{
+	0: "FREE",
+	1: "UNCONNECTED",
+	2: "CONNECTING",
+	3: "CONNECTED",
+	4: "DISCONNECTING",
+}
+
+// One line of /proc/net/{tcp,tcp6,udp,udp6}
+type socket struct {
+	local   netip.AddrPort
+	remote  netip.AddrPort
+	state   int
+	txQueue int
+	// For listening sockets this is the accept queue
+	rxQueue int
+	inode   int
+	// Only udp has this column, zero for tcp
+	drops int
+}
+
+type endpoint struct {
+	addr  netip.Addr
+	count int
+}
+
+type endpointHeap []*endpoint
+
+func (h endpointHeap) Len() int { return len(h) }
+func (h endpointHeap) Less(i, j int) bool {
+	return h[i].count > h[j].count
+}
+func (h endpointHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *endpointHeap) Push(x any)   { *h = append(*h, x.(*endpoint)) }
+func (h *endpointHeap) Pop() any {
+	old := *h
+	n := len(old)
+	if n == 0 {
+		return nil
+	}
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+type SocketInfo struct {
+	tcp  map[int]int // count by state
+	udp  map[int]int
+	unix map[int]int
+
+	// listening sockets with connections waiting to be accepted
+	queued  []*socket
+	remotes *endpointHeap
+}
+
+// Decode the hex address the kernel prints. It's the raw in_addr or in6_addr
+// printed as 32 bit words in host byte order.
+func parseAddr(s string) (netip.AddrPort, error) {
+	a, p, found := strings.Cut(s, ":")
+	if !found {
+		return netip.AddrPort{}, fmt.Errorf("bad socket address %q", s)
+	}
+	port, err := strconv.ParseUint(p, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	raw, err := hex.DecodeString(a)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if len(raw) != 4 && len(raw) != 16 {
+		return netip.AddrPort{}, fmt.Errorf("bad socket address %q", s)
+	}
+	// The hex is each 32 bit word printed as a host integer, so put the words
+	// back in memory order to get network byte order.
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(raw[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(raw)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
+
+// Parse /proc/net/{tcp,udp} and their v6 versions, the format is the same
+func parseInetSockets(r io.Reader) ([]*socket, error) {
+	var socks []*socket
+	scanner := bufio.NewScanner(r)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		s := new(socket)
+		var err error
+		s.local, err = parseAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		s.remote, err = parseAddr(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		st, err := strconv.ParseUint(fields[3], 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		s.state = int(st)
+		tx, rx, _ := strings.Cut(fields[4], ":")
+		txq, err := strconv.ParseUint(tx, 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		rxq, err := strconv.ParseUint(rx, 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		s.txQueue, s.rxQueue = int(txq), int(rxq)
+		s.inode, err = strconv.Atoi(fields[9])
+		if err != nil {
+			return nil, err
+		}
+		// udp has 'ref pointer drops' after the inode
+		if len(fields) == 13 {
+			s.drops, err = strconv.Atoi(fields[12])
+			if err != nil {
+				return nil, err
+			}
+		}
+		socks = append(socks, s)
+	}
+	return socks, scanner.Err()
+}
+
+// Count /proc/net/unix sockets by state
+func parseUnixSockets(r io.Reader) (map[int]int, error) {
+	states := make(map[int]int)
+	scanner := bufio.NewScanner(r)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		st, err := strconv.ParseUint(fields[5], 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		states[int(st)]++
+	}
+	return states, scanner.Err()
+}
+
+// Read all the sockets in the named /proc/net files, skipping ones that don't
+// exist e.g. tcp6 when ipv6 is disabled.
+func readInetSockets(fsys fs.FS, names ...string) ([]*socket, error) {
+	var all []*socket
+	for _, name := range names {
+		f, err := fsys.Open("proc/net/" + name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		socks, err := parseInetSockets(f)
+		f.Close()
+		if err != nil {
+			return nil, status.Errorf("proc/net/"+name, "%w", err)
+		}
+		all = append(all, socks...)
+	}
+	return all, nil
+}
+
+func getSocketStats(fsys fs.FS) (*SocketInfo, error) {
+	si := new(SocketInfo)
+	si.tcp = make(map[int]int)
+	si.udp = make(map[int]int)
+
+	tcp, err := readInetSockets(fsys, "tcp", "tcp6")
+	if err != nil {
+		return nil, err
+	}
+	remotes := make(map[netip.Addr]int)
+	for _, s := range tcp {
+		si.tcp[s.state]++
+		if s.state == tcpListen {
+			if s.rxQueue > 0 {
+				si.queued = append(si.queued, s)
+			}
+			continue
+		}
+		if !s.remote.Addr().IsUnspecified() {
+			remotes[s.remote.Addr()]++
+		}
+	}
+
+	si.remotes = new(endpointHeap)
+	heap.Init(si.remotes)
+	for addr, count := range remotes {
+		heap.Push(si.remotes, &endpoint{addr, count})
+	}
+
+	udp, err := readInetSockets(fsys, "udp", "udp6")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range udp {
+		si.udp[s.state]++
+	}
+
+	f, err := fsys.Open("proc/net/unix")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	si.unix, err = parseUnixSockets(f)
+	if err != nil {
+		return nil, status.Errorf("proc/net/unix", "%w", err)
+	}
+	return si, nil
+}
+
+// Get the current socket summary. Nothing here is a counter so there is no
+// previous sample to compare against.
+func SocketStats() (*SocketInfo, error) {
+	return getSocketStats(rootfs.FS)
+}
+
+func stateCounts(counts map[int]int, names []string) string {
+	var sb strings.Builder
+	for st, name := range names {
+		if counts[st] > 0 {
+			sb.WriteString(fmt.Sprintf(" %s:%d", name, counts[st]))
+		}
+	}
+	return sb.String()
+}
+
+// Show socket counts by state, listeners with a backlog and up to
+// num_remotes of the hosts with the most tcp connections.
+func (si *SocketInfo) InfoPrint(num_remotes int) string {
+	var sb strings.Builder
+	sb.WriteString("tcp:" + stateCounts(si.tcp, tcpStates) + "\n")
+	// udp reuses the tcp states, unconnected sockets are CLOSE
+	sb.WriteString("udp:" + stateCounts(si.udp, tcpStates) + "\n")
+	sb.WriteString("unix:" + stateCounts(si.unix, unixStates) + "\n")
+
+	if len(si.queued) > 0 {
+		sb.WriteString("accept queue:")
+		for _, s := range si.queued {
+			// for listeners tx_queue is the backlog limit
+			sb.WriteString(fmt.Sprintf(" %s %d/%d", s.local, s.rxQueue, s.txQueue))
+		}
+		sb.WriteString("\n")
+	}
+
+	limit := min(si.remotes.Len(), num_remotes)
+	if limit > 0 {
+		sb.WriteString("top remotes:")
+		for i := 0; i < limit; i++ {
+			e := heap.Pop(si.remotes).(*endpoint)
+			sb.WriteString(fmt.Sprintf(" %s(%d)", e.addr, e.count))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+const tcpHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+var socketFiles = fstest.MapFS{
+	"proc/net/tcp": {Data: []byte(tcpHeader +
+		// 127.0.0.1:22 listening with 3 of 128 waiting
+		"   0: 0100007F:0016 00000000:0000 0A 00000080:00000003 00:00000000 00000000     0        0 100 1 0000000000000000 100 0 0 10 0\n" +
+		// 0.0.0.0:80 listening, nothing waiting
+		"   1: 00000000:0050 00000000:0000 0A 00000080:00000000 00:00000000 00000000     0        0 101 1 0000000000000000 100 0 0 10 0\n" +
+		// 10.0.0.2:80 <- 10.0.0.1
+		"   2: 0200000A:0050 0100000A:D431 01 00000000:00000000 00:00000000 00000000     0        0 102 1 0000000000000000 20 4 30 10 -1\n" +
+		"   3: 0200000A:0050 0100000A:D432 08 00000000:00000000 00:00000000 00000000     0        0 103 1 0000000000000000 20 4 30 10 -1\n" +
+		"   4: 0200000A:0050 0300000A:D433 06 00000000:00000000 00:00000000 00000000     0        0 0 1 0000000000000000 20 4 30 10 -1\n")},
+	"proc/net/tcp6": {Data: []byte(tcpHeader +
+		// 2001:db8::1 -> 2001:db8::2:443
+		"   0: B80D0120000000000000000001000000:C350 B80D0120000000000000000002000000:01BB 01 00000000:00000000 00:00000000 00000000  1000        0 104 1 0000000000000000 20 4 30 10 -1\n" +
+		// v4 mapped 10.0.0.1
+		"   1: 0000000000000000FFFF00000200000A:0050 0000000000000000FFFF00000100000A:D434 03 00000000:00000000 00:00000000 00000000     0        0 0 1 0000000000000000 20 4 30 10 -1\n")},
+	"proc/net/udp": {Data: []byte("   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops\n" +
+		"  10: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 200 2 0000000000000000 12\n")},
+	// no udp6, like ipv6 disabled
+	"proc/net/unix": {Data: []byte("Num       RefCount Protocol Flags    Type St Inode Path\n" +
+		"0000000000000000: 00000002 00000000 00010000 0001 01 300 /run/systemd/notify\n" +
+		"0000000000000000: 00000003 00000000 00000000 0001 03 301\n" +
+		"0000000000000000: 00000003 00000000 00000000 0001 03 302 /run/dbus/system_bus_socket\n")},
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := map[string]string{
+		"0100007F:0016":                         "127.0.0.1:22",
+		"B80D0120000000000000000001000000:C350": "[2001:db8::1]:50000",
+		"0000000000000000FFFF00000200000A:0050": "10.0.0.2:80",
+	}
+	for in, expected := range tests {
+		a, err := parseAddr(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.String() != expected {
+			t.Errorf("got %s, expected %s", a, expected)
+		}
+	}
+	if _, err := parseAddr("0100007F"); err == nil {
+		t.Error("address without a port should fail")
+	}
+}
+
+func TestSocketStats(t *testing.T) {
+	si, err := getSocketStats(socketFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.tcp[tcpListen] != 2 || si.tcp[1] != 2 || si.tcp[8] != 1 || si.tcp[3] != 1 {
+		t.Errorf("wrong tcp states %v", si.tcp)
+	}
+	if si.udp[7] != 1 {
+		t.Errorf("wrong udp states %v", si.udp)
+	}
+	if si.unix[3] != 2 || si.unix[1] != 1 {
+		t.Errorf("wrong unix states %v", si.unix)
+	}
+	if len(si.queued) != 1 || si.queued[0].local.Port() != 22 {
+		t.Errorf("only port 22 has a backlog %v", si.queued)
+	}
+
+	s := si.InfoPrint(1)
+	lines := strings.Split(s, "\n")
+	if lines[0] != "tcp: ESTABLISHED:2 SYN_RECV:1 TIME_WAIT:1 CLOSE_WAIT:1 LISTEN:2" {
+		t.Errorf("wrong tcp line %q", lines[0])
+	}
+	if lines[3] != "accept queue: 127.0.0.1:22 3/128" {
+		t.Errorf("wrong accept queue %q", lines[3])
+	}
+	// 10.0.0.1 shows up in tcp and as a v4 mapped tcp6 address
+	if lines[4] != "top remotes: 10.0.0.1(3)" {
+		t.Errorf("wrong remotes %q", lines[4])
+	}
+}
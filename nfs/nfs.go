@@ -0,0 +1,289 @@
+package nfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+const mountstatsPath = "proc/self/mountstats"
+
+// How many operations to show for each mount, busiest first
+const numOps = 5
+
+// The per-op statistics of a mount, the times are cumulative milliseconds
+type opStat struct {
+	ops       int
+	trans     int // transmissions, more than ops when retransmitting
+	timeouts  int // major timeouts
+	bytesSent int
+	bytesRecv int
+	queueMs   int // waiting to be sent
+	rttMs     int // sent until the reply
+	executeMs int // everything, queued until done
+	errors    int // since statvers 1.1, 0 before
+}
+
+// A dir can have more than one mount stacked on it, and even the same export
+// more than once, n counts those in the order they're listed
+type mountKey struct {
+	device string
+	dir    string
+	n      int
+}
+
+type mount struct {
+	device string
+	dir    string
+	age    int // seconds since mounted, 0 if not listed
+	ops    map[string]*opStat
+	order  []string // as listed, READ and WRITE aren't first
+}
+
+// An operation over the last interval
+type opRate struct {
+	name      string
+	opsPerSec float64
+	kbPerSec  float64
+	retrans   int
+	timeouts  int
+	errors    int
+	rtt       float64 // average ms per op
+	execute   float64
+	queue     float64
+	executeMs int // total for ranking
+}
+
+type mountRate struct {
+	device    string
+	dir       string
+	opsPerSec float64
+	rtt       float64
+	execute   float64
+	retrans   int
+	timeouts  int
+	ops       []*opRate
+}
+
+type NfsInfo struct {
+	old     map[mountKey]*mount
+	new     map[mountKey]*mount
+	oldTime time.Time
+	newTime time.Time
+	rates   []*mountRate // worst first
+}
+
+// Parse the nfs mounts from mountstats, others only have the device line
+func parseMountstats(r io.Reader) (map[mountKey]*mount, error) {
+	mounts := make(map[mountKey]*mount)
+	var cur *mount
+	perOp := false
+	scanner := bufio.NewScanner(r)
+	for linenum := 1; scanner.Scan(); linenum++ {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// 'device srv:/export mounted on /mnt with fstype nfs4 statvers=1.1'
+		if fields[0] == "device" {
+			cur, perOp = nil, false
+			if len(fields) < 8 {
+				return nil, status.Errorf(mountstatsPath, "line %d: short device line", linenum)
+			}
+			if fields[7] == "nfs" || fields[7] == "nfs4" {
+				cur = &mount{device: fields[1], dir: fields[4], ops: make(map[string]*opStat)}
+				key := mountKey{device: cur.device, dir: cur.dir}
+				for mounts[key] != nil {
+					key.n++
+				}
+				mounts[key] = cur
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if fields[0] == "age:" && len(fields) == 2 {
+			age, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, status.Errorf(mountstatsPath, "line %d: %w", linenum, err)
+			}
+			cur.age = age
+			continue
+		}
+		if strings.TrimSpace(line) == "per-op statistics" {
+			perOp = true
+			continue
+		}
+		if !perOp || !strings.HasSuffix(fields[0], ":") {
+			continue
+		}
+		// 'READ: ops trans timeouts sent recv queue rtt execute [errors]'
+		if len(fields) < 9 {
+			return nil, status.Errorf(mountstatsPath, "line %d: expected at least 9 fields, got %d", linenum, len(fields))
+		}
+		vals := make([]int, 9)
+		for i, f := range fields[1:min(len(fields), 10)] {
+			v, err := strconv.Atoi(f)
+			if err != nil {
+				return nil, status.Errorf(mountstatsPath, "line %d: %w", linenum, err)
+			}
+			vals[i] = v
+		}
+		name := strings.TrimSuffix(fields[0], ":")
+		cur.ops[name] = &opStat{
+			ops: vals[0], trans: vals[1], timeouts: vals[2],
+			bytesSent: vals[3], bytesRecv: vals[4],
+			queueMs: vals[5], rttMs: vals[6], executeMs: vals[7],
+			errors: vals[8],
+		}
+		cur.order = append(cur.order, name)
+	}
+	return mounts, scanner.Err()
+}
+
+// Get an NfsInfo with the rates since the last one
+func NfsStats(ni *NfsInfo) (*NfsInfo, error) {
+	return getNfsStats(ni, rootfs.FS)
+}
+
+func getNfsStats(ni *NfsInfo, fsys fs.FS) (*NfsInfo, error) {
+	f, err := fsys.Open(mountstatsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mounts, err := parseMountstats(f)
+	if err != nil {
+		return nil, err
+	}
+	ni.old = ni.new
+	ni.new = mounts
+	ni.oldTime = ni.newTime
+	ni.newTime = time.Now()
+	ni.estimate()
+	return ni, nil
+}
+
+func average(ms, ops int) float64 {
+	if ops <= 0 {
+		return 0
+	}
+	return float64(ms) / float64(ops)
+}
+
+func (ni *NfsInfo) estimate() {
+	ni.rates = nil
+	if ni.old == nil {
+		return
+	}
+	elapsed := ni.newTime.Sub(ni.oldTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	for key, cur := range ni.new {
+		prev, ok := ni.old[key]
+		// remounted, the counters started over
+		if !ok || cur.age < prev.age {
+			continue
+		}
+		mr := &mountRate{device: cur.device, dir: cur.dir}
+		var ops, rttMs, executeMs int
+		for _, name := range cur.order {
+			c, p := cur.ops[name], prev.ops[name]
+			if p == nil || c.ops < p.ops {
+				continue
+			}
+			n := c.ops - p.ops
+			or := &opRate{
+				name:      name,
+				opsPerSec: float64(n) / elapsed,
+				kbPerSec:  float64(c.bytesSent+c.bytesRecv-p.bytesSent-p.bytesRecv) / 1024 / elapsed,
+				retrans:   c.trans - p.trans - n,
+				timeouts:  c.timeouts - p.timeouts,
+				errors:    c.errors - p.errors,
+				rtt:       average(c.rttMs-p.rttMs, n),
+				execute:   average(c.executeMs-p.executeMs, n),
+				queue:     average(c.queueMs-p.queueMs, n),
+				executeMs: c.executeMs - p.executeMs,
+			}
+			ops += n
+			rttMs += c.rttMs - p.rttMs
+			executeMs += or.executeMs
+			mr.retrans += max(or.retrans, 0)
+			mr.timeouts += or.timeouts
+			if n > 0 || or.timeouts > 0 {
+				mr.ops = append(mr.ops, or)
+			}
+		}
+		mr.opsPerSec = float64(ops) / elapsed
+		mr.rtt = average(rttMs, ops)
+		mr.execute = average(executeMs, ops)
+		sort.SliceStable(mr.ops, func(i, j int) bool {
+			return mr.ops[i].executeMs > mr.ops[j].executeMs
+		})
+		ni.rates = append(ni.rates, mr)
+	}
+	// timeouts mean the server isn't answering at all, then slowest
+	sort.Slice(ni.rates, func(i, j int) bool {
+		a, b := ni.rates[i], ni.rates[j]
+		if a.timeouts != b.timeouts {
+			return a.timeouts > b.timeouts
+		}
+		if a.execute != b.execute {
+			return a.execute > b.execute
+		}
+		if a.dir != b.dir {
+			return a.dir < b.dir
+		}
+		return a.device < b.device
+	})
+}
+
+func (or *opRate) String() string {
+	s := fmt.Sprintf("  %s ops/s: %.1f kB/s: %.1f rtt: %.1fms exe: %.1fms queue: %.1fms retrans: %d",
+		or.name, or.opsPerSec, or.kbPerSec, or.rtt, or.execute, or.queue, or.retrans)
+	if or.timeouts > 0 {
+		s += fmt.Sprintf(" TIMEOUTS: %d", or.timeouts)
+	}
+	if or.errors > 0 {
+		s += fmt.Sprintf(" errors: %d", or.errors)
+	}
+	return s
+}
+
+// Like nfsiostat, the worst num_mounts mounts with their busiest operations
+func (ni *NfsInfo) InfoPrint(num_mounts int) string {
+	if len(ni.new) == 0 {
+		return "no nfs mounts\n"
+	}
+	var sb strings.Builder
+	for i, mr := range ni.rates {
+		if i >= num_mounts {
+			sb.WriteString(fmt.Sprintf("%d more mounts\n", len(ni.rates)-i))
+			break
+		}
+		sb.WriteString(fmt.Sprintf("%s on %s ops/s: %.1f rtt: %.1fms exe: %.1fms retrans: %d",
+			mr.device, mr.dir, mr.opsPerSec, mr.rtt, mr.execute, mr.retrans))
+		if mr.timeouts > 0 {
+			sb.WriteString(fmt.Sprintf(" TIMEOUTS: %d", mr.timeouts))
+		}
+		sb.WriteString("\n")
+		for j, or := range mr.ops {
+			if j >= numOps {
+				break
+			}
+			sb.WriteString(or.String() + "\n")
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,210 @@
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bioe007/synopsys/status"
+)
+
+// Two nfs mounts between other filesystems. slow gets reads and writes
+// taking longer, fast only reads.
+func mountstats(slowReads, slowTrans, slowTimeouts, fastReads int) string {
+	return fmt.Sprintf(`device rootfs mounted on / with fstype rootfs
+device proc mounted on /proc with fstype proc
+device filer1:/export/home mounted on /home with fstype nfs4 statvers=1.1
+	opts:	rw,vers=4.2,rsize=1048576,wsize=1048576,hard,proto=tcp,timeo=600,retrans=2
+	age:	1000
+	events:	0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0
+	bytes:	0 0 0 0 0 0 0 0
+	RPC iostats version: 1.1  p/v: 100003/4 (nfs)
+	xprt:	tcp 0 1 1 0 0 5 5 0 5 0 2 0 0
+	per-op statistics
+	        NULL: 0 0 0 0 0 0 0 0 0
+	        READ: %d %d %d 10000 4096000 100 %d %d 0
+	       WRITE: 100 100 0 4096000 10000 50 1000 2000 1
+	      GETATTR: 10 10 0 1000 1000 0 10 10 0
+
+device filer2:/export/data mounted on /data with fstype nfs statvers=1.1
+	opts:	rw,vers=3
+	per-op statistics
+	        NULL: 0 0 0 0 0 0 0 0
+	        READ: %d %d 0 10000 4096000 0 %d %d
+`, slowReads, slowTrans, slowTimeouts, slowReads*10, slowReads*20,
+		fastReads, fastReads, fastReads, fastReads)
+}
+
+func TestParseMountstats(t *testing.T) {
+	mounts, err := parseMountstats(strings.NewReader(mountstats(100, 110, 1, 50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 2 {
+		t.Fatalf("expected 2 nfs mounts, got %d", len(mounts))
+	}
+	home := mounts[mountKey{device: "filer1:/export/home", dir: "/home"}]
+	if home.device != "filer1:/export/home" || len(home.order) != 4 || home.order[1] != "READ" {
+		t.Errorf("wrong mount %+v", home)
+	}
+	write := home.ops["WRITE"]
+	if write.ops != 100 || write.bytesSent != 4096000 || write.executeMs != 2000 || write.errors != 1 {
+		t.Errorf("wrong WRITE %+v", write)
+	}
+	// no errors field before statvers 1.1
+	if read := mounts[mountKey{device: "filer2:/export/data", dir: "/data"}].ops["READ"]; read.ops != 50 || read.executeMs != 50 || read.errors != 0 {
+		t.Errorf("wrong READ %+v", read)
+	}
+}
+
+func TestNfsStats(t *testing.T) {
+	ni := new(NfsInfo)
+	ni, err := getNfsStats(ni, fstest.MapFS{
+		"proc/self/mountstats": {Data: []byte(mountstats(100, 100, 0, 100))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ni.InfoPrint(5) != "" {
+		t.Errorf("expected nothing before there are two samples, got %q", ni.InfoPrint(5))
+	}
+
+	ni.old = ni.new
+	ni.new, err = parseMountstats(strings.NewReader(mountstats(200, 205, 2, 300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni.oldTime = ni.newTime.Add(-time.Second)
+	ni.estimate()
+
+	// /home is worse, it had timeouts
+	if len(ni.rates) != 2 || ni.rates[0].dir != "/home" {
+		t.Fatalf("wrong order %+v", ni.rates)
+	}
+	out := ni.InfoPrint(5)
+	for _, want := range []string{
+		"filer1:/export/home on /home ops/s: 100.0 rtt: 10.0ms exe: 20.0ms retrans: 5 TIMEOUTS: 2\n",
+		"  READ ops/s: 100.0 kB/s: 0.0 rtt: 10.0ms exe: 20.0ms queue: 0.0ms retrans: 5 TIMEOUTS: 2\n",
+		"filer2:/export/data on /data ops/s: 200.0 rtt: 1.0ms exe: 1.0ms retrans: 0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	// idle operations aren't listed
+	if strings.Contains(out, "WRITE") || strings.Contains(out, "GETATTR") {
+		t.Errorf("unexpected idle op in\n%s", out)
+	}
+
+	if out := ni.InfoPrint(1); !strings.HasSuffix(out, "1 more mounts\n") {
+		t.Errorf("expected the rest to be counted, got\n%s", out)
+	}
+}
+
+func TestNfsStatsChanging(t *testing.T) {
+	// older kernels, statvers=1.0 without the errors field and no age line
+	const older = `device filer:/x mounted on /x with fstype nfs statvers=1.0
+	per-op statistics
+	        READ: %d %d 0 0 0 0 %d %d
+`
+	remounted := strings.Replace(mountstats(10, 10, 0, 300), "age:\t1000", "age:\t5", 1)
+	tests := []struct {
+		name   string
+		first  string
+		second string
+		want   []string
+	}{
+		{name: "older format", first: fmt.Sprintf(older, 10, 10, 10, 10), second: fmt.Sprintf(older, 20, 20, 30, 40),
+			want: []string{"filer:/x on /x ops/s: 10.0 rtt: 2.0ms exe: 3.0ms retrans: 0\n",
+				"  READ ops/s: 10.0 kB/s: 0.0 rtt: 2.0ms exe: 3.0ms queue: 0.0ms retrans: 0\n"}},
+		// /home was unmounted and mounted again, the counters are smaller
+		// but READ still went up
+		{name: "remounted", first: mountstats(1, 1, 0, 100), second: remounted,
+			want: []string{"filer2:/export/data on /data ops/s: 200.0 rtt: 1.0ms exe: 1.0ms retrans: 0\n",
+				"  READ ops/s: 200.0 kB/s: 0.0 rtt: 1.0ms exe: 1.0ms queue: 0.0ms retrans: 0\n"}},
+		{name: "unmounted", first: mountstats(1, 1, 0, 100),
+			second: "device proc mounted on /proc with fstype proc\n", want: []string{"no nfs mounts\n"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ni, err := getNfsStats(new(NfsInfo), fstest.MapFS{"proc/self/mountstats": {Data: []byte(tc.first)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ni, err = getNfsStats(ni, fstest.MapFS{"proc/self/mountstats": {Data: []byte(tc.second)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ni.oldTime = ni.newTime.Add(-time.Second)
+			ni.estimate()
+			if out := ni.InfoPrint(5); out != strings.Join(tc.want, "") {
+				t.Errorf("got\n%s\nexpected\n%s", out, strings.Join(tc.want, ""))
+			}
+		})
+	}
+}
+
+// A second export mounted over /home, and the first one mounted again on
+// top, keep their own counters
+func TestNfsStatsStacked(t *testing.T) {
+	stacked := func(reads1, reads2, reads3 int) string {
+		mount := func(device string, reads int) string {
+			return fmt.Sprintf("device %s mounted on /home with fstype nfs statvers=1.1\n"+
+				"\tage:\t100\n\tper-op statistics\n\t        READ: %d %d 0 0 0 0 %d %d 0\n",
+				device, reads, reads, reads, reads)
+		}
+		return mount("filer1:/home", reads1) + mount("filer2:/home", reads2) + mount("filer1:/home", reads3)
+	}
+	ni, err := getNfsStats(new(NfsInfo), fstest.MapFS{"proc/self/mountstats": {Data: []byte(stacked(1000, 10, 0))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ni.new) != 3 {
+		t.Fatalf("expected 3 mounts, got %d", len(ni.new))
+	}
+	ni, err = getNfsStats(ni, fstest.MapFS{"proc/self/mountstats": {Data: []byte(stacked(1000, 30, 5))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni.oldTime = ni.newTime.Add(-time.Second)
+	ni.estimate()
+	out := ni.InfoPrint(5)
+	for _, want := range []string{
+		"filer1:/home on /home ops/s: 0.0",
+		"filer1:/home on /home ops/s: 5.0",
+		"filer2:/home on /home ops/s: 20.0",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestNfsStatsNoMounts(t *testing.T) {
+	ni, err := getNfsStats(new(NfsInfo), fstest.MapFS{
+		"proc/self/mountstats": {Data: []byte("device proc mounted on /proc with fstype proc\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := ni.InfoPrint(5); out != "no nfs mounts\n" {
+		t.Errorf("wrong output %q", out)
+	}
+}
+
+func TestParseMountstatsErrors(t *testing.T) {
+	for _, bad := range []string{
+		"device filer:/x mounted on\n",
+		"device filer:/x mounted on /x with fstype nfs\n\tper-op statistics\n\tREAD: 1 2 3\n",
+		"device filer:/x mounted on /x with fstype nfs\n\tper-op statistics\n\tREAD: 1 2 3 4 5 6 7 x\n",
+	} {
+		_, err := parseMountstats(strings.NewReader(bad))
+		var fe *status.FormatError
+		if !errors.As(err, &fe) {
+			t.Errorf("%q: expected a format error, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package numa
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/cpu"
+	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+const nodePath = "sys/devices/system/node"
+
+type nodeStat struct {
+	id   int
+	cpus []int
+
+	// from nodeN/meminfo, in kB
+	memTotal int
+	memFree  int
+	memUsed  int
+
+	// from nodeN/numastat, these are page counts since boot
+	numaHit       int // allocated here and intended for here
+	numaMiss      int // allocated here but intended for another node
+	numaForeign   int // intended for here but allocated on another node
+	interleaveHit int // interleave policy allocations that landed here
+	localNode     int // allocated here by a process running here
+	otherNode     int // allocated here by a process running on another node
+}
+
+// Per-second rates between two samples
+type nodeRates struct {
+	numaMiss      float64
+	numaForeign   float64
+	interleaveHit float64
+}
+
+type NumaInfo struct {
+	old     []*nodeStat
+	new     []*nodeStat
+	oldTime time.Time
+	newTime time.Time
+}
+
+// Parse the 'Node N Key: value kB' lines of a node's meminfo
+func parseNodeMeminfo(ns *nodeStat, b []byte) error {
+	scanner := bufio.NewScanner(strings.NewReader(string(b)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		key := strings.TrimSuffix(fields[2], ":")
+		var dest *int
+		switch key {
+		case "MemTotal":
+			dest = &ns.memTotal
+		case "MemFree":
+			dest = &ns.memFree
+		case "MemUsed":
+			dest = &ns.memUsed
+		default:
+			continue
+		}
+		v, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return fmt.Errorf("node%d meminfo %s: %w", ns.id, key, err)
+		}
+		*dest = v
+	}
+	return scanner.Err()
+}
+
+// Parse the 'key value' lines of a node's numastat
+func parseNumastat(ns *nodeStat, b []byte) error {
+	stats := map[string]*int{
+		"numa_hit":       &ns.numaHit,
+		"numa_miss":      &ns.numaMiss,
+		"numa_foreign":   &ns.numaForeign,
+		"interleave_hit": &ns.interleaveHit,
+		"local_node":     &ns.localNode,
+		"other_node":     &ns.otherNode,
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(b)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		dest, ok := stats[fields[0]]
+		if !ok {
+			continue
+		}
+		v, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fmt.Errorf("node%d numastat %s: %w", ns.id, fields[0], err)
+		}
+		*dest = v
+	}
+	return scanner.Err()
+}
+
+// Read a node's cpulist, meminfo and numastat, false if it's gone
+func readNode(fsys fs.FS, d string, ns *nodeStat) (bool, error) {
+	read := func(name string) ([]byte, bool, error) {
+		b, err := fs.ReadFile(fsys, path.Join(d, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, false, nil
+		}
+		return b, err == nil, err
+	}
+
+	b, ok, err := read("cpulist")
+	if !ok {
+		return false, err
+	}
+	ns.cpus, err = cpu.ParseCpuList(string(b))
+	if err != nil {
+		return false, status.Errorf(path.Join(d, "cpulist"), "%w", err)
+	}
+
+	if b, ok, err = read("meminfo"); !ok {
+		return false, err
+	}
+	if err = parseNodeMeminfo(ns, b); err != nil {
+		return false, status.Errorf(path.Join(d, "meminfo"), "%w", err)
+	}
+
+	if b, ok, err = read("numastat"); !ok {
+		return false, err
+	}
+	if err = parseNumastat(ns, b); err != nil {
+		return false, status.Errorf(path.Join(d, "numastat"), "%w", err)
+	}
+	return true, nil
+}
+
+func getNodes(fsys fs.FS) ([]*nodeStat, error) {
+	dirs, err := fs.Glob(fsys, path.Join(nodePath, "node[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*nodeStat
+	for _, d := range dirs {
+		ns := new(nodeStat)
+		ns.id, err = strconv.Atoi(strings.TrimPrefix(path.Base(d), "node"))
+		if err != nil {
+			continue
+		}
+
+		// a node taken offline since the glob is left out
+		ok, err := readNode(fsys, d, ns)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		nodes = append(nodes, ns)
+	}
+
+	// Glob is lexical so node10 would come before node2
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes, nil
+}
+
+// Get a NumaInfo and update it with new stats
+func NumaStats(ni *NumaInfo) (*NumaInfo, error) {
+	nodes, err := getNodes(rootfs.FS)
+	if err != nil {
+		return nil, err
+	}
+	ni.old = ni.new
+	ni.oldTime = ni.newTime
+	ni.new = nodes
+	ni.newTime = time.Now()
+	return ni, nil
+}
+
+// Rates for node i, nil until the node is in two samples
+func (ni *NumaInfo) rates(i int) *nodeRates {
+	elapsed := ni.newTime.Sub(ni.oldTime).Seconds()
+	if elapsed <= 0 {
+		return nil
+	}
+	cur := ni.new[i]
+	var prev *nodeStat
+	for _, p := range ni.old {
+		if p.id == cur.id {
+			prev = p
+		}
+	}
+	if prev == nil {
+		return nil
+	}
+	return &nodeRates{
+		numaMiss:      float64(cur.numaMiss-prev.numaMiss) / elapsed,
+		numaForeign:   float64(cur.numaForeign-prev.numaForeign) / elapsed,
+		interleaveHit: float64(cur.interleaveHit-prev.interleaveHit) / elapsed,
+	}
+}
+
+// Average and hottest cpu utilization for the cpus on a node
+func nodeBusy(ns *nodeStat, ci *cpu.CpuInfo) (avg float32, hot string, hotBusy float32, ok bool) {
+	var total float32
+	var n int
+	for _, c := range ns.cpus {
+		nr := fmt.Sprintf("cpu%d", c)
+		b, found := ci.Busy(nr)
+		if !found {
+			continue
+		}
+		total += b
+		n++
+		if hot == "" || b > hotBusy {
+			hot = nr
+			hotBusy = b
+		}
+	}
+	if n == 0 {
+		return 0, "", 0, false
+	}
+	return total / float32(n), hot, hotBusy, true
+}
+
+func (ni *NumaInfo) nodeLine(i int, ci *cpu.CpuInfo) string {
+	ns := ni.new[i]
+	s := fmt.Sprintf("node%d free/used/tot: %d/%d/%d", ns.id,
+		memory.Scaled(ns.memFree), memory.Scaled(ns.memUsed), memory.Scaled(ns.memTotal))
+	if r := ni.rates(i); r != nil {
+		s += fmt.Sprintf("\tmiss/s: %.0f foreign/s: %.0f interleave/s: %.0f",
+			r.numaMiss, r.numaForeign, r.interleaveHit)
+	}
+	if ci != nil {
+		if avg, hot, hotBusy, ok := nodeBusy(ns, ci); ok {
+			s += fmt.Sprintf("\tcpus: %d busy: %.2f hot: %s %.2f",
+				len(ns.cpus), avg, hot, hotBusy)
+		}
+	}
+	return s
+}
+
+// Show memory and allocation rates per node with the utilization of the cpus
+// belonging to each. The cpu info may be nil.
+func (ni *NumaInfo) InfoPrint(ci *cpu.CpuInfo) string {
+	if len(ni.new) == 0 {
+		return ""
+	}
+	// Nothing can be imbalanced on a single node, keep it short
+	if len(ni.new) == 1 {
+		return fmt.Sprintf("single %s", ni.nodeLine(0, ci))
+	}
+
+	var sb strings.Builder
+	for i := range ni.new {
+		sb.WriteString(ni.nodeLine(i, ci))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
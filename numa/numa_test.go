@@ -0,0 +1,168 @@
+package numa
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/status"
+)
+
+func nodeFiles(miss string) fstest.MapFS {
+	return fstest.MapFS{
+		"sys/devices/system/node/node0/cpulist": {Data: []byte("0-1\n")},
+		"sys/devices/system/node/node0/meminfo": {Data: []byte(
+			`Node 0 MemTotal:        4194304 kB
+Node 0 MemFree:         1048576 kB
+Node 0 MemUsed:         3145728 kB
+Node 0 Active:           367104 kB
+`)},
+		"sys/devices/system/node/node0/numastat": {Data: []byte(
+			"numa_hit 1000\nnuma_miss 0\nnuma_foreign " + miss + "\ninterleave_hit 10\nlocal_node 1000\nother_node 0\n")},
+		"sys/devices/system/node/node10/cpulist": {Data: []byte("2-3\n")},
+		"sys/devices/system/node/node10/meminfo": {Data: []byte(
+			`Node 10 MemTotal:        4194304 kB
+Node 10 MemFree:         2097152 kB
+Node 10 MemUsed:         2097152 kB
+`)},
+		"sys/devices/system/node/node10/numastat": {Data: []byte(
+			"numa_hit 500\nnuma_miss " + miss + "\nnuma_foreign 0\ninterleave_hit 10\nlocal_node 400\nother_node 100\n")},
+		"sys/devices/system/node/online": {Data: []byte("0,10\n")},
+	}
+}
+
+func TestGetNodes(t *testing.T) {
+	nodes, err := getNodes(nodeFiles("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got %d", len(nodes))
+	}
+	if nodes[0].id != 0 || nodes[1].id != 10 {
+		t.Errorf("nodes not in numeric order %d %d", nodes[0].id, nodes[1].id)
+	}
+	n := nodes[1]
+	if n.memTotal != 4194304 || n.memFree != 2097152 || n.memUsed != 2097152 {
+		t.Errorf("wrong meminfo %+v", n)
+	}
+	if n.numaHit != 500 || n.otherNode != 100 || n.interleaveHit != 10 {
+		t.Errorf("wrong numastat %+v", n)
+	}
+	if len(n.cpus) != 2 || n.cpus[0] != 2 || n.cpus[1] != 3 {
+		t.Errorf("wrong cpus %v", n.cpus)
+	}
+}
+
+func TestGetNodesChanging(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(fstest.MapFS)
+		nodes  int
+		bad    bool
+	}{
+		// offlined between the glob and reading it
+		{"node gone", func(f fstest.MapFS) { delete(f, "sys/devices/system/node/node10/meminfo") }, 1, false},
+		// memory only, like CXL
+		{"no cpus", func(f fstest.MapFS) {
+			f["sys/devices/system/node/node10/cpulist"] = &fstest.MapFile{Data: []byte("\n")}
+		}, 2, false},
+		{"bad numastat", func(f fstest.MapFS) {
+			f["sys/devices/system/node/node10/numastat"] = &fstest.MapFile{Data: []byte("numa_miss lots\n")}
+		}, 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			files := nodeFiles("0")
+			tc.change(files)
+			nodes, err := getNodes(files)
+			var fe *status.FormatError
+			if tc.bad {
+				if !errors.As(err, &fe) {
+					t.Errorf("expected a format error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nodes) != tc.nodes {
+				t.Errorf("expected %d nodes, got %d", tc.nodes, len(nodes))
+			}
+		})
+	}
+}
+
+// Rates are between the same node, not the same position
+func TestRatesNodeGone(t *testing.T) {
+	ni := new(NumaInfo)
+	var err error
+	ni.old, err = getNodes(nodeFiles("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := nodeFiles("200")
+	delete(files, "sys/devices/system/node/node0/numastat")
+	ni.new, err = getNodes(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni.newTime = time.Now()
+	ni.oldTime = ni.newTime.Add(-2 * time.Second)
+
+	if r := ni.rates(0); r == nil || r.numaMiss != 100 {
+		t.Errorf("node10 compared against the wrong node %+v", r)
+	}
+}
+
+func TestRates(t *testing.T) {
+	ni := new(NumaInfo)
+	var err error
+	ni.old, err = getNodes(nodeFiles("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni.new, err = getNodes(nodeFiles("200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni.newTime = time.Now()
+	ni.oldTime = ni.newTime.Add(-2 * time.Second)
+
+	r := ni.rates(1)
+	if r.numaMiss != 100 || r.numaForeign != 0 {
+		t.Errorf("wrong rates %+v", r)
+	}
+	r = ni.rates(0)
+	if r.numaForeign != 100 || r.numaMiss != 0 {
+		t.Errorf("wrong rates %+v", r)
+	}
+
+	s := ni.InfoPrint(nil)
+	if strings.Count(s, "\n") != 2 || !strings.Contains(s, "node10 ") {
+		t.Errorf("expected a line per node: %q", s)
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	files := nodeFiles("0")
+	for k := range files {
+		if strings.Contains(k, "node10") {
+			delete(files, k)
+		}
+	}
+	ni := new(NumaInfo)
+	var err error
+	ni.new, err = getNodes(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory.SetScale(1024 * 1024)
+	s := ni.InfoPrint(nil)
+	if !strings.HasPrefix(s, "single node0 free/used/tot: 1024/3072/4096") || strings.Contains(s, "\n") {
+		t.Errorf("expected a one line summary, got %q", s)
+	}
+}
@@ -0,0 +1,404 @@
+package oom
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bioe007/synopsys/cgroup"
+	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+// How many kills to remember
+const maxKills = 10
+
+// Samples to wait for the victim line after an oom-kill line before giving
+// up on it, it's normally in the same read
+const pendingSamples = 3
+
+const timeFormat = "2006-01-02 15:04:05"
+
+// The victim line, older kernels don't have shmem-rss and prefix it with
+// 'Kill process ... or sacrifice child' on the line before
+var killedRe = regexp.MustCompile(`Killed process (\d+) \((.*)\) total-vm:\d+kB, anon-rss:(\d+)kB, file-rss:(\d+)kB(?:, shmem-rss:(\d+)kB)?`)
+
+// A kill, either read from the kernel log or inferred from a counter going
+// up. Counter kills only have a count and maybe the cgroup.
+type kill struct {
+	time    time.Time
+	pid     int
+	comm    string
+	rss     int    // kB
+	cgroup  string // of the victim
+	trigger string // memory cgroup that hit its limit, or global
+	count   int
+	source  string
+	// still in the kernel log from before starting, not a new kill
+	history bool
+	// the sample an oom-kill line was read in, while waiting for its victim
+	seen int
+}
+
+// Where kernel log records come from, /dev/kmsg unless testing
+type recordReader interface {
+	records() ([]string, error)
+	close() error
+}
+
+type kmsg struct {
+	fd int
+}
+
+// Open /dev/kmsg non-blocking so reads stop when caught up. This needs root,
+// or CAP_SYSLOG, when dmesg_restrict is set.
+func openKmsg() (*kmsg, error) {
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: "/dev/kmsg", Err: err}
+	}
+	return &kmsg{fd: fd}, nil
+}
+
+// Every read returns a single record. The first call returns everything still
+// in the ring buffer.
+func (k *kmsg) records() ([]string, error) {
+	var recs []string
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(k.fd, buf)
+		switch {
+		case err == syscall.EAGAIN:
+			return recs, nil
+		// records were overwritten before being read, carry on from the next
+		case err == syscall.EPIPE || err == syscall.EINTR:
+			continue
+		case err != nil:
+			return recs, err
+		case n == 0:
+			return recs, nil
+		}
+		recs = append(recs, string(buf[:n]))
+	}
+}
+
+func (k *kmsg) close() error {
+	return syscall.Close(k.fd)
+}
+
+type OomInfo struct {
+	log    recordReader
+	logErr error // why the kernel log can't be read
+
+	started  bool
+	samples  int
+	bootTime time.Time
+	vmstat   int  // oom_kill from /proc/vmstat
+	noVmstat bool // before 4.13
+	total    int  // kills since starting
+	cgroups  map[string]int
+	// kernel log kills per cgroup that memory.events hasn't shown yet, so
+	// the same kill isn't counted from both
+	logged map[string]int
+	// the oom-kill: line comes before the victim, keyed by pid
+	pending map[int]*kill
+
+	kills []*kill // oldest first
+}
+
+// Parse a /dev/kmsg record 'priority,sequence,usec,flags;message' into the
+// time since boot and the first line of the message
+func parseRecord(rec string) (time.Duration, string, bool) {
+	header, msg, found := strings.Cut(rec, ";")
+	if !found {
+		return 0, "", false
+	}
+	fields := strings.Split(header, ",")
+	if len(fields) < 4 {
+		return 0, "", false
+	}
+	usec, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return 0, "", false
+	}
+	// continuation lines of dictionary values start with a space
+	msg, _, _ = strings.Cut(msg, "\n")
+	return time.Duration(usec) * time.Microsecond, msg, true
+}
+
+// 'oom-kill:constraint=CONSTRAINT_MEMCG,...,oom_memcg=/a,task_memcg=/a/b,task=x,pid=1,uid=0'
+func parseOomKill(msg string) *kill {
+	k := &kill{trigger: "global"}
+	for _, kv := range strings.Split(strings.TrimPrefix(msg, "oom-kill:"), ",") {
+		key, v, _ := strings.Cut(kv, "=")
+		switch key {
+		case "oom_memcg":
+			k.trigger = v
+		case "task_memcg":
+			k.cgroup = v
+		case "pid":
+			k.pid, _ = strconv.Atoi(v)
+		}
+	}
+	return k
+}
+
+// Turn the kernel log records into kills, returns how many there were
+func (oi *OomInfo) readLog(recs []string) int {
+	found := 0
+	for _, rec := range recs {
+		since, msg, ok := parseRecord(rec)
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(msg, "oom-kill:") {
+			k := parseOomKill(msg)
+			k.seen = oi.samples
+			oi.pending[k.pid] = k
+			continue
+		}
+		m := killedRe.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+		pid, _ := strconv.Atoi(m[1])
+		k, ok := oi.pending[pid]
+		if ok {
+			delete(oi.pending, pid)
+		} else {
+			k = &kill{pid: pid}
+		}
+		k.time = oi.bootTime.Add(since)
+		k.comm = m[2]
+		for _, rss := range m[3:] {
+			v, _ := strconv.Atoi(rss)
+			k.rss += v
+		}
+		k.count = 1
+		k.source = "kmsg"
+		k.history = !oi.started
+		oi.add(k)
+		if !k.history && k.cgroup != "" && oi.cgroups != nil {
+			oi.logged[k.cgroup]++
+		}
+		found++
+	}
+	// the victim line was dropped or rate limited
+	for pid, k := range oi.pending {
+		if oi.samples-k.seen >= pendingSamples {
+			delete(oi.pending, pid)
+		}
+	}
+	return found
+}
+
+func (oi *OomInfo) add(k *kill) {
+	oi.kills = append(oi.kills, k)
+	if len(oi.kills) > maxKills {
+		oi.kills = oi.kills[len(oi.kills)-maxKills:]
+	}
+}
+
+func readVmstatOom(fsys fs.FS) (int, bool, error) {
+	f, err := fsys.Open("proc/vmstat")
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, found := strings.CutPrefix(scanner.Text(), "oom_kill "); found {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, false, status.Errorf("proc/vmstat", "oom_kill: %w", err)
+			}
+			return n, true, nil
+		}
+	}
+	return 0, false, scanner.Err()
+}
+
+// Boot time from /proc/uptime, to put kernel log times on the clock
+func readBootTime(fsys fs.FS) (time.Time, error) {
+	b, err := fs.ReadFile(fsys, "proc/uptime")
+	if err != nil {
+		return time.Time{}, err
+	}
+	up, _, _ := strings.Cut(string(b), " ")
+	secs, err := strconv.ParseFloat(up, 64)
+	if err != nil {
+		return time.Time{}, status.Errorf("proc/uptime", "%w", err)
+	}
+	return time.Now().Add(-time.Duration(secs * float64(time.Second))), nil
+}
+
+// Find which cgroups had kills since the last look that the kernel log
+// didn't have
+func (oi *OomInfo) readCgroups(kills map[string]int, now time.Time) int {
+	found := 0
+	for cg, n := range kills {
+		prev, seen := oi.cgroups[cg]
+		// counts from before starting are history the kernel log would
+		// have had details for, so only new cgroups count from zero
+		if !seen && !oi.started {
+			continue
+		}
+		if n <= prev {
+			continue
+		}
+		extra := n - prev
+		matched := min(extra, oi.logged[cg])
+		oi.logged[cg] -= matched
+		extra -= matched
+		if extra > 0 {
+			oi.add(&kill{time: now, cgroup: cg, count: extra, source: "memory.events"})
+			found += extra
+		}
+	}
+	for cg := range oi.logged {
+		if _, ok := kills[cg]; !ok || oi.logged[cg] == 0 {
+			delete(oi.logged, cg)
+		}
+	}
+	oi.cgroups = kills
+	return found
+}
+
+// Get an OomInfo and check for new kills. The kernel log is preferred since
+// it has the victim, the memory.events of each cgroup at least give where
+// when the log can't be read or dropped the line. Anything left over from the
+// vmstat counter is still recorded as a kill.
+func OomStats(oi *OomInfo) (*OomInfo, error) {
+	if oi.log == nil && oi.logErr == nil {
+		k, err := openKmsg()
+		if err != nil {
+			oi.logErr = err
+		} else {
+			oi.log = k
+		}
+	}
+	return getOomStats(oi, rootfs.FS, cgroup.OomKills)
+}
+
+func getOomStats(oi *OomInfo, fsys fs.FS, cgroupKills func() (map[string]int, error)) (*OomInfo, error) {
+	now := time.Now()
+	if !oi.started {
+		var err error
+		oi.bootTime, err = readBootTime(fsys)
+		if err != nil {
+			return nil, err
+		}
+		oi.pending = make(map[int]*kill)
+		oi.logged = make(map[string]int)
+	}
+	oi.samples++
+
+	vm, ok, err := readVmstatOom(fsys)
+	if err != nil {
+		return nil, err
+	}
+	delta := vm - oi.vmstat
+
+	// only walk the cgroups when there's a reason to, and before anything
+	// changes so a failure doesn't lose the kills the counter went up by.
+	// They're read before the kernel log, so a kill in between is in the
+	// log first and matched against memory.events next time.
+	var cgKills map[string]int
+	if !oi.started || delta > 0 || !ok {
+		cgKills, err = cgroupKills()
+		if err != nil && !errors.Is(err, cgroup.ErrNoCgroupV2) {
+			return nil, err
+		}
+	}
+	oi.noVmstat = !ok
+	oi.vmstat = vm
+
+	found := 0
+	if oi.log != nil {
+		recs, err := oi.log.records()
+		if err != nil {
+			// not opened again, so it's only ever the one fd
+			oi.log.close()
+			oi.logErr = err
+			oi.log = nil
+		}
+		found = oi.readLog(recs)
+	}
+	if cgKills != nil {
+		found += oi.readCgroups(cgKills, now)
+	}
+
+	if oi.started {
+		if delta > 0 {
+			oi.total += delta
+		} else {
+			oi.total += found
+		}
+		// outside of a container, or host wide when in one
+		if delta > found {
+			oi.add(&kill{time: now, count: delta - found, source: "vmstat"})
+		}
+	}
+	oi.started = true
+	return oi, nil
+}
+
+func (k *kill) String() string {
+	s := k.time.Format(timeFormat)
+	if k.source != "kmsg" {
+		s += fmt.Sprintf(" oom_kill +%d", k.count)
+		if k.cgroup != "" {
+			s += " cgroup:" + k.cgroup
+		}
+		if k.source == "vmstat" {
+			s += " (no details, outside this cgroup or kernel log unreadable)"
+		}
+		return s
+	}
+	s += fmt.Sprintf(" pid:%d %s rss:%d", k.pid, k.comm, memory.Scaled(k.rss))
+	if k.cgroup != "" {
+		s += " cgroup:" + k.cgroup
+	}
+	if k.trigger != "" && k.trigger != k.cgroup {
+		s += " limit:" + k.trigger
+	}
+	if k.history {
+		s += " (before starting)"
+	}
+	return s
+}
+
+// Show the kills since starting and the most recent ones, newest first
+func (oi *OomInfo) InfoPrint() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("kills: %d", oi.total))
+	if !oi.noVmstat {
+		sb.WriteString(fmt.Sprintf(" since boot: %d", oi.vmstat))
+	}
+	if oi.logErr != nil {
+		sb.WriteString("\tkernel log unavailable: " + status.Reason(oi.logErr))
+	}
+	sb.WriteString("\n")
+	for i := len(oi.kills) - 1; i >= 0; i-- {
+		sb.WriteString(oi.kills[i].String() + "\n")
+	}
+	return sb.String()
+}
+
+// Whether there has been a kill since starting, worth keeping on screen.
+// Ones from before are only shown with the rest of the panel.
+func (oi *OomInfo) HasKills() bool {
+	for _, k := range oi.kills {
+		if !k.history {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+package oom
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bioe007/synopsys/memory"
+)
+
+type fakeLog struct {
+	batches [][]string
+	err     error
+	closed  bool
+}
+
+func (f *fakeLog) close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *fakeLog) records() ([]string, error) {
+	if len(f.batches) == 0 {
+		return nil, f.err
+	}
+	recs := f.batches[0]
+	f.batches = f.batches[1:]
+	return recs, nil
+}
+
+func oomFiles(kills string) fstest.MapFS {
+	return fstest.MapFS{
+		"proc/uptime": {Data: []byte("1000.00 900.00\n")},
+		"proc/vmstat": {Data: []byte("nr_free_pages 1000\noom_kill " + kills + "\nnuma_hit 1\n")},
+	}
+}
+
+// Returns each of counts in turn, then the last one again
+func cgroupCounts(counts ...map[string]int) func() (map[string]int, error) {
+	return func() (map[string]int, error) {
+		c := counts[0]
+		if len(counts) > 1 {
+			counts = counts[1:]
+		}
+		return c, nil
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	since, msg, ok := parseRecord("3,1234,5000000,-;Out of memory: Killed process 1\n SUBSYSTEM=x\n")
+	if !ok || since.Seconds() != 5 || msg != "Out of memory: Killed process 1" {
+		t.Errorf("got %v %q %v", since, msg, ok)
+	}
+	if _, _, ok := parseRecord("no header"); ok {
+		t.Error("bad record parsed")
+	}
+}
+
+func TestKernelLog(t *testing.T) {
+	memory.SetScale(1024)
+	log := &fakeLog{batches: [][]string{
+		// history from before starting
+		{
+			"6,1,100000000,-;oom-kill:constraint=CONSTRAINT_NONE,nodemask=(null),cpuset=/,mems_allowed=0,global_oom,task_memcg=/user.slice,task=stress,pid=500,uid=0",
+			"3,2,100000001,-;Out of memory: Killed process 500 (stress) total-vm:1000kB, anon-rss:800kB, file-rss:100kB, shmem-rss:0kB, UID:0 pgtables:10kB oom_score_adj:0",
+			"6,3,100000002,-;some other message",
+		},
+		{
+			"6,4,900000000,-;oom-kill:constraint=CONSTRAINT_MEMCG,nodemask=(null),cpuset=/,mems_allowed=0,oom_memcg=/system.slice/db.service,task_memcg=/system.slice/db.service/worker,task=db (w),pid=600,uid=999",
+			"3,5,900000001,-;Memory cgroup out of memory: Killed process 600 (db (w)) total-vm:5000kB, anon-rss:4000kB, file-rss:0kB, shmem-rss:96kB, UID:999 pgtables:20kB oom_score_adj:0",
+		},
+	}}
+	// memory.events has the same kill, it's only listed once
+	cgroupKills := cgroupCounts(
+		map[string]int{"/user.slice": 1, "/system.slice/db.service/worker": 0},
+		map[string]int{"/user.slice": 1, "/system.slice/db.service/worker": 1},
+	)
+	oi := &OomInfo{log: log}
+	oi, err := getOomStats(oi, oomFiles("3"), cgroupKills)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oi.kills) != 1 || oi.total != 0 || oi.HasKills() {
+		t.Fatalf("history should be listed but not counted %+v", oi)
+	}
+	if k := oi.kills[0]; k.pid != 500 || k.rss != 900 || k.trigger != "global" || k.cgroup != "/user.slice" {
+		t.Errorf("wrong kill %+v", k)
+	}
+
+	oi, err = getOomStats(oi, oomFiles("4"), cgroupKills)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oi.total != 1 || !oi.HasKills() {
+		t.Errorf("expected one new kill %d", oi.total)
+	}
+	lines := strings.Split(oi.InfoPrint(), "\n")
+	if len(lines) != 4 || lines[0] != "kills: 1 since boot: 4" {
+		t.Fatalf("got %q", lines)
+	}
+	if !strings.HasSuffix(lines[1], " pid:600 db (w) rss:4096 cgroup:/system.slice/db.service/worker limit:/system.slice/db.service") {
+		t.Errorf("newest should be first %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], " pid:500 stress rss:900 cgroup:/user.slice limit:global (before starting)") {
+		t.Errorf("got %q", lines[2])
+	}
+	if len(oi.pending) != 0 {
+		t.Errorf("matched oom-kill lines should not be left pending %v", oi.pending)
+	}
+}
+
+func TestCgroupFallback(t *testing.T) {
+	calls := 0
+	counts := []map[string]int{
+		{"/a": 2, "/b": 0},
+		{"/a": 3, "/b": 0, "/c": 1},
+	}
+	cgroupKills := func() (map[string]int, error) {
+		calls++
+		return counts[calls-1], nil
+	}
+	oi := &OomInfo{logErr: errors.New("operation not permitted")}
+	oi, err := getOomStats(oi, oomFiles("10"), cgroupKills)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oi.HasKills() {
+		t.Errorf("counts before starting are not kills %v", oi.kills)
+	}
+
+	// nothing changed, so the cgroups aren't walked
+	oi, err = getOomStats(oi, oomFiles("10"), cgroupKills)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("cgroups walked without a kill")
+	}
+
+	// two in the cgroups and one elsewhere
+	oi, err = getOomStats(oi, oomFiles("13"), cgroupKills)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oi.total != 3 || len(oi.kills) != 3 {
+		t.Fatalf("expected 3 kills %d %v", oi.total, oi.kills)
+	}
+	s := oi.InfoPrint()
+	if !strings.HasPrefix(s, "kills: 3 since boot: 13\tkernel log unavailable: operation not permitted\n") {
+		t.Errorf("got %q", s)
+	}
+	for _, want := range []string{"oom_kill +1 cgroup:/a", "oom_kill +1 cgroup:/c", "oom_kill +1 (no details"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("missing %q in %q", want, s)
+		}
+	}
+}
+
+func TestRollingList(t *testing.T) {
+	oi := new(OomInfo)
+	for i := 0; i < maxKills+5; i++ {
+		oi.add(&kill{pid: i})
+	}
+	if len(oi.kills) != maxKills || oi.kills[0].pid != 5 {
+		t.Errorf("oldest should be dropped %d %d", len(oi.kills), oi.kills[0].pid)
+	}
+}
+
+// When the cgroups can't be walked the vmstat count isn't used up, the kills
+// are still found on the next good sample
+func TestCgroupFailThenSucceed(t *testing.T) {
+	fail := true
+	cgroupKills := func() (map[string]int, error) {
+		if fail {
+			return nil, errors.New("cgroup went away")
+		}
+		return map[string]int{"/a": 1}, nil
+	}
+	oi := &OomInfo{logErr: errors.New("operation not permitted")}
+	oi, err := getOomStats(oi, oomFiles("5"), func() (map[string]int, error) {
+		return map[string]int{"/a": 0}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getOomStats(oi, oomFiles("6"), cgroupKills); err == nil {
+		t.Fatal("expected the cgroup error")
+	}
+	fail = false
+	oi, err = getOomStats(oi, oomFiles("6"), cgroupKills)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oi.total != 1 || len(oi.kills) != 1 || oi.kills[0].cgroup != "/a" {
+		t.Errorf("kill lost after a failed sample %d %v", oi.total, oi.kills)
+	}
+}
+
+// A log that stops working is closed and the panel says why
+func TestKernelLogError(t *testing.T) {
+	log := &fakeLog{err: &fs.PathError{Op: "read", Path: "/dev/kmsg", Err: fs.ErrPermission}}
+	oi, err := getOomStats(&OomInfo{log: log}, oomFiles("0"), func() (map[string]int, error) {
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !log.closed || oi.log != nil {
+		t.Error("failed log should be closed and dropped")
+	}
+	if s := oi.InfoPrint(); s != "kills: 0 since boot: 0\tkernel log unavailable: permission denied /dev/kmsg\n" {
+		t.Errorf("got %q", s)
+	}
+}
+
+// With the kernel log readable, a kill whose victim line never arrived is
+// still found from memory.events, and the oom-kill line isn't kept forever
+func TestKernelLogDropped(t *testing.T) {
+	log := &fakeLog{batches: [][]string{
+		{},
+		{"6,4,900000000,-;oom-kill:constraint=CONSTRAINT_MEMCG,nodemask=(null),cpuset=/,mems_allowed=0,oom_memcg=/a,task_memcg=/a,task=x,pid=600,uid=0"},
+	}}
+	cgroupKills := cgroupCounts(map[string]int{"/a": 0}, map[string]int{"/a": 1})
+	oi, err := getOomStats(&OomInfo{log: log}, oomFiles("0"), cgroupKills)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oi, err = getOomStats(oi, oomFiles("1"), cgroupKills)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oi.total != 1 || len(oi.kills) != 1 || oi.kills[0].source != "memory.events" || oi.kills[0].cgroup != "/a" {
+		t.Fatalf("expected the kill from memory.events %d %+v", oi.total, oi.kills)
+	}
+	for i := 0; i < pendingSamples; i++ {
+		if oi, err = getOomStats(oi, oomFiles("1"), cgroupKills); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(oi.pending) != 0 {
+		t.Errorf("unmatched oom-kill lines should be dropped %v", oi.pending)
+	}
+}
+
+// A kill after memory.events is read but before the kernel log is, is only
+// counted once when memory.events catches up. Another in /b with no log line
+// makes the cgroups get walked again.
+func TestKernelLogBeforeEvents(t *testing.T) {
+	log := &fakeLog{batches: [][]string{
+		{},
+		{
+			"6,4,900000000,-;oom-kill:constraint=CONSTRAINT_MEMCG,nodemask=(null),cpuset=/,mems_allowed=0,oom_memcg=/a,task_memcg=/a,task=x,pid=600,uid=0",
+			"3,5,900000001,-;Memory cgroup out of memory: Killed process 600 (x) total-vm:5000kB, anon-rss:4000kB, file-rss:0kB, shmem-rss:0kB, UID:0 pgtables:20kB oom_score_adj:0",
+		},
+	}}
+	cgroupKills := cgroupCounts(
+		map[string]int{"/a": 0, "/b": 0},
+		map[string]int{"/a": 0, "/b": 0},
+		map[string]int{"/a": 1, "/b": 1},
+	)
+	oi, err := getOomStats(&OomInfo{log: log}, oomFiles("0"), cgroupKills)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vm := range []string{"1", "2"} {
+		if oi, err = getOomStats(oi, oomFiles(vm), cgroupKills); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if oi.total != 2 || len(oi.kills) != 2 || oi.kills[0].source != "kmsg" || oi.kills[1].cgroup != "/b" {
+		t.Errorf("expected the kernel log kill and /b %d %+v", oi.total, oi.kills)
+	}
+}
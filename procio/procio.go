@@ -0,0 +1,225 @@
+package procio
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/container"
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+// The counters from /proc/[pid]/io. The bytes are what reached the block
+// layer, page cache hits and writes not flushed yet aren't in them.
+type ioStat struct {
+	comm            string
+	syscr           int
+	syscw           int
+	readBytes       int
+	writeBytes      int
+	cancelledWrites int // bytes written then truncated before reaching disk
+}
+
+// Per second over the last interval
+type ioRate struct {
+	pid         int
+	comm        string
+	syscr       float64
+	syscw       float64
+	readKB      float64
+	writeKB     float64
+	cancelledKB float64
+	container   *container.Container
+}
+
+type ioHeap []*ioRate
+
+func (h ioHeap) Len() int { return len(h) }
+func (h ioHeap) Less(i, j int) bool {
+	return h[i].readKB+h[i].writeKB > h[j].readKB+h[j].writeKB
+}
+func (h ioHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *ioHeap) Push(x any)   { *h = append(*h, x.(*ioRate)) }
+func (h *ioHeap) Pop() any {
+	old := *h
+	n := len(old)
+	if n == 0 {
+		return nil
+	}
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+type ProcIoInfo struct {
+	// Labels processes with their container, nil to skip
+	Resolver *container.Resolver
+
+	old     map[int]*ioStat
+	new     map[int]*ioStat
+	oldTime time.Time
+	newTime time.Time
+
+	procs   *ioHeap
+	readKB  float64 // every process, not only the ones shown
+	writeKB float64
+	// processes whose io couldn't be read, only root can read other users'
+	unreadable int
+}
+
+func parseIo(p string, b []byte) (*ioStat, error) {
+	st := new(ioStat)
+	dest := map[string]*int{
+		"syscr":                 &st.syscr,
+		"syscw":                 &st.syscw,
+		"read_bytes":            &st.readBytes,
+		"write_bytes":           &st.writeBytes,
+		"cancelled_write_bytes": &st.cancelledWrites,
+	}
+	found := 0
+	for _, line := range strings.Split(string(b), "\n") {
+		key, v, ok := strings.Cut(line, ":")
+		d, want := dest[key]
+		if !ok || !want {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, status.Errorf(p, "%s: %w", key, err)
+		}
+		*d = n
+		found++
+	}
+	if found != len(dest) {
+		return nil, status.Errorf(p, "expected %d counters, got %d", len(dest), found)
+	}
+	return st, nil
+}
+
+// Read the io of every process. /proc/[pid]/io already covers every thread
+// in the group, including ones that have exited, so threads aren't read.
+func (pi *ProcIoInfo) readProcesses(fsys fs.FS) (map[int]*ioStat, error) {
+	entries, err := fs.ReadDir(fsys, "proc")
+	if err != nil {
+		return nil, err
+	}
+	procs := make(map[int]*ioStat)
+	pi.unreadable = 0
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		dir := path.Join("proc", e.Name())
+		p := path.Join(dir, "io")
+		b, err := fs.ReadFile(fsys, p)
+		// isn't ours, only root can read it
+		if errors.Is(err, fs.ErrPermission) {
+			pi.unreadable++
+			continue
+		}
+		// exited since listing /proc, that's ENOENT, ESRCH or an empty read
+		if err != nil || len(b) == 0 {
+			continue
+		}
+		st, err := parseIo(p, b)
+		if err != nil {
+			return nil, err
+		}
+		comm, _ := fs.ReadFile(fsys, path.Join(dir, "comm"))
+		st.comm = strings.TrimSpace(string(comm))
+		procs[pid] = st
+	}
+	return procs, nil
+}
+
+// Get a ProcIoInfo with the io of each process since the last one
+func ProcIoStats(pi *ProcIoInfo) (*ProcIoInfo, error) {
+	return getProcIoStats(pi, rootfs.FS)
+}
+
+func getProcIoStats(pi *ProcIoInfo, fsys fs.FS) (*ProcIoInfo, error) {
+	procs, err := pi.readProcesses(fsys)
+	if err != nil {
+		return nil, err
+	}
+	pi.old = pi.new
+	pi.new = procs
+	pi.oldTime = pi.newTime
+	pi.newTime = time.Now()
+	pi.estimate()
+	return pi, nil
+}
+
+func (pi *ProcIoInfo) estimate() {
+	pi.procs = new(ioHeap)
+	heap.Init(pi.procs)
+	pi.readKB, pi.writeKB = 0, 0
+	if pi.old == nil {
+		return
+	}
+	elapsed := pi.newTime.Sub(pi.oldTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	for pid, c := range pi.new {
+		p, ok := pi.old[pid]
+		// a reused pid starts again from zero
+		if !ok || c.comm != p.comm || c.readBytes < p.readBytes || c.writeBytes < p.writeBytes {
+			continue
+		}
+		r := &ioRate{
+			pid:         pid,
+			comm:        c.comm,
+			syscr:       float64(c.syscr-p.syscr) / elapsed,
+			syscw:       float64(c.syscw-p.syscw) / elapsed,
+			readKB:      float64(c.readBytes-p.readBytes) / 1024 / elapsed,
+			writeKB:     float64(c.writeBytes-p.writeBytes) / 1024 / elapsed,
+			cancelledKB: float64(c.cancelledWrites-p.cancelledWrites) / 1024 / elapsed,
+		}
+		pi.readKB += r.readKB
+		pi.writeKB += r.writeKB
+		if r.readKB > 0 || r.writeKB > 0 || r.cancelledKB > 0 {
+			heap.Push(pi.procs, r)
+		}
+	}
+}
+
+func (r *ioRate) String() string {
+	s := fmt.Sprintf("%s[%d] rKB/s: %.0f wKB/s: %.0f cancelledKB/s: %.0f syscr/s: %.0f syscw/s: %.0f",
+		r.comm, r.pid, r.readKB, r.writeKB, r.cancelledKB, r.syscr, r.syscw)
+	if r.container != nil {
+		s += " (" + r.container.String() + ")"
+	}
+	return s
+}
+
+// The total over every process readable, then the num_procs doing the most
+// disk io
+func (pi *ProcIoInfo) InfoPrint(num_procs int) string {
+	if len(pi.new) == 0 && pi.unreadable == 0 {
+		return "not available, needs CONFIG_TASK_IO_ACCOUNTING\n"
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("total rKB/s: %.0f wKB/s: %.0f", pi.readKB, pi.writeKB))
+	if pi.unreadable > 0 {
+		sb.WriteString(fmt.Sprintf("\t(%d processes not readable, run as root)", pi.unreadable))
+	}
+	sb.WriteString("\n")
+	limit := min(pi.procs.Len(), num_procs)
+	for i := 0; i < limit; i++ {
+		r := heap.Pop(pi.procs).(*ioRate)
+		// only the ones shown are worth the extra reads
+		if pi.Resolver != nil {
+			r.container = pi.Resolver.Resolve(r.pid)
+		}
+		sb.WriteString(r.String() + "\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,124 @@
+package procio
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bioe007/synopsys/status"
+)
+
+func ioFile(syscr, syscw, read, write, cancelled int) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(fmt.Sprintf(`rchar: 123456
+wchar: 654321
+syscr: %d
+syscw: %d
+read_bytes: %d
+write_bytes: %d
+cancelled_write_bytes: %d
+`, syscr, syscw, read, write, cancelled))}
+}
+
+// pid 10 writes, 20 reads, 30 is idle and 40 belongs to someone else
+func procFiles(step int) fstest.MapFS {
+	return fstest.MapFS{
+		"proc/10/comm": {Data: []byte("postgres\n")},
+		"proc/10/io":   ioFile(0, step*100, 0, step*4096*1024, step*1024),
+		"proc/20/comm": {Data: []byte("backup\n")},
+		"proc/20/io":   ioFile(step*50, 0, step*1024*1024, 0, 0),
+		"proc/30/comm": {Data: []byte("sleep\n")},
+		"proc/30/io":   ioFile(1, 1, 0, 0, 0),
+		"proc/40/comm": {Data: []byte("sshd\n")},
+		"proc/40/io":   ioFile(0, 0, 0, 0, 0),
+		"proc/self/io": ioFile(0, 0, 0, 0, 0),
+	}
+}
+
+// Like /proc when not root, other users' io files can't be read. Reading one
+// of a process that has just exited gives ESRCH.
+type deniedFS struct {
+	fstest.MapFS
+	denied string
+	exited string
+}
+
+func (d deniedFS) ReadFile(name string) ([]byte, error) {
+	switch name {
+	case d.denied:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	case d.exited:
+		return nil, &fs.PathError{Op: "read", Path: name, Err: syscall.ESRCH}
+	}
+	return d.MapFS.ReadFile(name)
+}
+
+func TestProcIoStats(t *testing.T) {
+	pi, err := getProcIoStats(new(ProcIoInfo), deniedFS{MapFS: procFiles(1), denied: "proc/40/io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pi.new) != 3 || pi.unreadable != 1 {
+		t.Fatalf("wrong sample %d procs %d unreadable", len(pi.new), pi.unreadable)
+	}
+
+	pi, err = getProcIoStats(pi, deniedFS{MapFS: procFiles(2), denied: "proc/40/io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi.oldTime = pi.newTime.Add(-time.Second)
+	pi.estimate()
+
+	out := pi.InfoPrint(5)
+	want := "total rKB/s: 1024 wKB/s: 4096\t(1 processes not readable, run as root)\n" +
+		"postgres[10] rKB/s: 0 wKB/s: 4096 cancelledKB/s: 1 syscr/s: 0 syscw/s: 100\n" +
+		"backup[20] rKB/s: 1024 wKB/s: 0 cancelledKB/s: 0 syscr/s: 50 syscw/s: 0\n"
+	if out != want {
+		t.Errorf("got\n%s\nexpected\n%s", out, want)
+	}
+}
+
+// A new process with a reused pid doesn't show the old one's counters
+func TestProcIoStatsPidReused(t *testing.T) {
+	pi, err := getProcIoStats(new(ProcIoInfo), procFiles(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := procFiles(3)
+	fsys["proc/10/comm"] = &fstest.MapFile{Data: []byte("bash\n")}
+	pi, err = getProcIoStats(pi, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := pi.InfoPrint(5); strings.Contains(out, "[10]") {
+		t.Errorf("unexpected pid 10 in\n%s", out)
+	}
+}
+
+// Processes exiting between listing /proc and reading their io are skipped,
+// they aren't unreadable and don't fail the section
+func TestProcIoStatsExited(t *testing.T) {
+	fsys := procFiles(1)
+	fsys["proc/30/io"] = &fstest.MapFile{}
+	pi, err := getProcIoStats(new(ProcIoInfo), deniedFS{MapFS: fsys, exited: "proc/20/io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pi.new) != 2 || pi.unreadable != 0 {
+		t.Errorf("wrong sample %d procs %d unreadable", len(pi.new), pi.unreadable)
+	}
+}
+
+func TestProcIoStatsBadCounter(t *testing.T) {
+	fsys := procFiles(1)
+	fsys["proc/10/io"] = &fstest.MapFile{Data: []byte("read_bytes: lots\n")}
+	_, err := getProcIoStats(new(ProcIoInfo), fsys)
+	var fe *status.FormatError
+	if !errors.As(err, &fe) {
+		t.Errorf("expected a format error, got %v", err)
+	}
+}
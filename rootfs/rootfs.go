@@ -0,0 +1,11 @@
+package rootfs
+
+import (
+	"io/fs"
+	"os"
+)
+
+// What every collector reads /proc and /sys from. fs.FS paths have no
+// leading slash, e.g. "proc/stat". Tests pass their own fs.FS to the
+// unexported get functions rather than replacing this.
+var FS fs.FS = os.DirFS("/")
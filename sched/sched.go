@@ -0,0 +1,306 @@
+package sched
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bioe007/synopsys/container"
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+const schedstatPath = "proc/schedstat"
+
+// Time on the cpu and waiting on the run queue, in ns, and how many
+// timeslices that was over
+type runStat struct {
+	run    int
+	wait   int
+	slices int
+}
+
+func (r *runStat) add(o *runStat) {
+	r.run += o.run
+	r.wait += o.wait
+	r.slices += o.slices
+}
+
+// Shares of the interval and the average wait before each timeslice. wait
+// can be over 1, it's the sum of every task that was waiting.
+type runRate struct {
+	name  string
+	run   float64
+	wait  float64
+	delay float64 // ms per timeslice
+	// for processes
+	pid       int
+	container *container.Container
+}
+
+func rate(name string, cur, prev *runStat, elapsed float64) *runRate {
+	r := &runRate{
+		name: name,
+		run:  float64(cur.run-prev.run) / elapsed,
+		wait: float64(cur.wait-prev.wait) / elapsed,
+	}
+	if slices := cur.slices - prev.slices; slices > 0 {
+		r.delay = float64(cur.wait-prev.wait) / float64(slices) / 1e6
+	}
+	return r
+}
+
+type rateHeap []*runRate
+
+func (h rateHeap) Len() int { return len(h) }
+func (h rateHeap) Less(i, j int) bool {
+	return h[i].run > h[j].run
+}
+func (h rateHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *rateHeap) Push(x any)   { *h = append(*h, x.(*runRate)) }
+func (h *rateHeap) Pop() any {
+	old := *h
+	n := len(old)
+	if n == 0 {
+		return nil
+	}
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+type process struct {
+	comm string
+	runStat
+}
+
+type sample struct {
+	cpus  map[string]*runStat // nil without /proc/schedstat
+	procs map[int]*process
+}
+
+type SchedInfo struct {
+	// Labels processes with their container, nil to skip
+	Resolver *container.Resolver
+
+	old     *sample
+	new     *sample
+	oldTime time.Time
+	newTime time.Time
+
+	all   *runRate
+	cpus  []*runRate // most waiting first
+	procs *rateHeap
+}
+
+func parseRunStat(p string, fields []string) (*runStat, error) {
+	var vals [3]int
+	for i := range vals {
+		v, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return nil, status.Errorf(p, "%w", err)
+		}
+		vals[i] = v
+	}
+	return &runStat{run: vals[0], wait: vals[1], slices: vals[2]}, nil
+}
+
+// The cpuN lines of /proc/schedstat end with the time running, time waiting
+// and timeslices, version 14 and earlier have more fields before them. It
+// needs CONFIG_SCHEDSTATS, a missing file is nil.
+func readCpus(fsys fs.FS) (map[string]*runStat, error) {
+	f, err := fsys.Open(schedstatPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cpus := make(map[string]*runStat)
+	scanner := bufio.NewScanner(f)
+	for linenum := 1; scanner.Scan(); linenum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if len(fields) < 10 {
+			return nil, status.Errorf(schedstatPath, "line %d: expected 10 fields, got %d", linenum, len(fields))
+		}
+		rs, err := parseRunStat(schedstatPath, fields[len(fields)-3:])
+		if err != nil {
+			return nil, err
+		}
+		cpus[fields[0]] = rs
+	}
+	return cpus, scanner.Err()
+}
+
+// /proc/[pid]/schedstat is only the thread group leader, every thread is
+// added up so busy thread pools aren't missed
+func readProcess(fsys fs.FS, pid string) (*process, error) {
+	dir := path.Join("proc", pid)
+	tasks, err := fs.ReadDir(fsys, path.Join(dir, "task"))
+	if err != nil {
+		return nil, err
+	}
+	p := new(process)
+	for _, t := range tasks {
+		statPath := path.Join(dir, "task", t.Name(), "schedstat")
+		b, err := fs.ReadFile(fsys, statPath)
+		if err != nil {
+			// the thread exited
+			continue
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) != 3 {
+			return nil, status.Errorf(statPath, "expected 3 fields, got %d", len(fields))
+		}
+		rs, err := parseRunStat(statPath, fields)
+		if err != nil {
+			return nil, err
+		}
+		p.add(rs)
+	}
+	comm, _ := fs.ReadFile(fsys, path.Join(dir, "comm"))
+	p.comm = strings.TrimSpace(string(comm))
+	return p, nil
+}
+
+func readProcesses(fsys fs.FS) (map[int]*process, error) {
+	entries, err := fs.ReadDir(fsys, "proc")
+	if err != nil {
+		return nil, err
+	}
+	procs := make(map[int]*process)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		p, err := readProcess(fsys, e.Name())
+		var fe *status.FormatError
+		if errors.As(err, &fe) {
+			return nil, err
+		}
+		// exited since listing /proc
+		if err != nil {
+			continue
+		}
+		procs[pid] = p
+	}
+	return procs, nil
+}
+
+// Get a SchedInfo with the run queue latency since the last one
+func SchedStats(si *SchedInfo) (*SchedInfo, error) {
+	return getSchedStats(si, rootfs.FS)
+}
+
+func getSchedStats(si *SchedInfo, fsys fs.FS) (*SchedInfo, error) {
+	s := new(sample)
+	var err error
+	if s.cpus, err = readCpus(fsys); err != nil {
+		return nil, err
+	}
+	if s.procs, err = readProcesses(fsys); err != nil {
+		return nil, err
+	}
+	si.old = si.new
+	si.new = s
+	si.oldTime = si.newTime
+	si.newTime = time.Now()
+	si.estimate()
+	return si, nil
+}
+
+func (si *SchedInfo) estimate() {
+	si.all, si.cpus = nil, nil
+	si.procs = new(rateHeap)
+	heap.Init(si.procs)
+	if si.old == nil {
+		return
+	}
+	elapsed := float64(si.newTime.Sub(si.oldTime).Nanoseconds())
+	if elapsed <= 0 {
+		return
+	}
+
+	if si.new.cpus != nil && si.old.cpus != nil {
+		var cur, prev runStat
+		for name, c := range si.new.cpus {
+			p, ok := si.old.cpus[name]
+			if !ok {
+				continue
+			}
+			cur.add(c)
+			prev.add(p)
+			si.cpus = append(si.cpus, rate(name, c, p, elapsed))
+		}
+		si.all = rate("all", &cur, &prev, elapsed)
+		sort.Slice(si.cpus, func(i, j int) bool {
+			if si.cpus[i].wait != si.cpus[j].wait {
+				return si.cpus[i].wait > si.cpus[j].wait
+			}
+			return si.cpus[i].name < si.cpus[j].name
+		})
+	}
+
+	for pid, c := range si.new.procs {
+		p, ok := si.old.procs[pid]
+		// threads exiting take their time with them, and a reused pid
+		// starts again from zero
+		if !ok || c.comm != p.comm || c.run < p.run {
+			continue
+		}
+		r := rate(c.comm, &c.runStat, &p.runStat, elapsed)
+		r.pid = pid
+		heap.Push(si.procs, r)
+	}
+}
+
+func (r *runRate) String() string {
+	s := fmt.Sprintf("%s run: %.0f%% wait: %.0f%% delay: %.2fms/slice", r.name, r.run*100, r.wait*100, r.delay)
+	if r.pid > 0 {
+		s = fmt.Sprintf("%s[%d] cpu: %.0f%% wait: %.0f%% delay: %.2fms/slice", r.name, r.pid, r.run*100, r.wait*100, r.delay)
+	}
+	if r.container != nil {
+		s += " (" + r.container.String() + ")"
+	}
+	return s
+}
+
+// The whole box and the num_cpus cpus waiting the most, then the num_procs
+// processes using the most cpu and how long they wait for it
+func (si *SchedInfo) InfoPrint(num_cpus, num_procs int) string {
+	var sb strings.Builder
+	switch {
+	case si.new.cpus == nil:
+		sb.WriteString("per cpu: not available, needs CONFIG_SCHEDSTATS\n")
+	case si.all != nil:
+		sb.WriteString(si.all.String() + "\n")
+		for i, c := range si.cpus {
+			if i >= num_cpus {
+				break
+			}
+			sb.WriteString(c.String() + "\n")
+		}
+	}
+	limit := min(si.procs.Len(), num_procs)
+	for i := 0; i < limit; i++ {
+		r := heap.Pop(si.procs).(*runRate)
+		// only the ones shown are worth the extra reads
+		if si.Resolver != nil {
+			r.container = si.Resolver.Resolve(r.pid)
+		}
+		sb.WriteString(r.String() + "\n")
+	}
+	return sb.String()
+}
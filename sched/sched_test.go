@@ -0,0 +1,133 @@
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bioe007/synopsys/status"
+)
+
+// cpu0 is idle, cpu1 has work waiting. pid 10 is one busy thread, pid 20 two
+// threads that wait a lot.
+func schedFiles(step int) fstest.MapFS {
+	ms := int(time.Millisecond)
+	cpuLine := func(name string, run, wait, slices int) string {
+		return fmt.Sprintf("%s 0 0 100 50 20 10 %d %d %d\n", name, run, wait, slices)
+	}
+	return fstest.MapFS{
+		"proc/schedstat": {Data: []byte("version 15\ntimestamp 4295000000\n" +
+			cpuLine("cpu0", step*100*ms, 0, step*10) +
+			"domain0 00000003 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n" +
+			cpuLine("cpu1", step*900*ms, step*500*ms, step*100))},
+		"proc/10/comm":              {Data: []byte("busy\n")},
+		"proc/10/task/10/schedstat": {Data: []byte(fmt.Sprintf("%d %d %d\n", step*800*ms, step*10*ms, step*10))},
+		"proc/20/comm":              {Data: []byte("pool\n")},
+		"proc/20/task/20/schedstat": {Data: []byte(fmt.Sprintf("%d %d %d\n", step*100*ms, step*200*ms, step*20))},
+		"proc/20/task/21/schedstat": {Data: []byte(fmt.Sprintf("%d %d %d\n", step*100*ms, step*200*ms, step*20))},
+		// not a pid
+		"proc/self/task/1/schedstat": {Data: []byte("0 0 0\n")},
+	}
+}
+
+func TestSchedStats(t *testing.T) {
+	si, err := getSchedStats(new(SchedInfo), schedFiles(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(si.new.cpus) != 2 || len(si.new.procs) != 2 {
+		t.Fatalf("wrong sample %d cpus %d procs", len(si.new.cpus), len(si.new.procs))
+	}
+	if pool := si.new.procs[20]; pool.comm != "pool" || pool.slices != 40 {
+		t.Errorf("threads not added up %+v", pool)
+	}
+
+	si, err = getSchedStats(si, schedFiles(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	si.oldTime = si.newTime.Add(-time.Second)
+	si.estimate()
+
+	out := si.InfoPrint(1, 5)
+	want := "all run: 100% wait: 50% delay: 4.55ms/slice\n" +
+		"cpu1 run: 90% wait: 50% delay: 5.00ms/slice\n" +
+		"busy[10] cpu: 80% wait: 1% delay: 1.00ms/slice\n" +
+		"pool[20] cpu: 20% wait: 40% delay: 10.00ms/slice\n"
+	if out != want {
+		t.Errorf("got\n%s\nexpected\n%s", out, want)
+	}
+}
+
+func TestSchedStatsNoSchedstat(t *testing.T) {
+	fsys := schedFiles(1)
+	delete(fsys, "proc/schedstat")
+	si, err := getSchedStats(new(SchedInfo), fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	si, err = getSchedStats(si, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := si.InfoPrint(8, 0); out != "per cpu: not available, needs CONFIG_SCHEDSTATS\n" {
+		t.Errorf("wrong output %q", out)
+	}
+}
+
+func TestSchedStatsChanging(t *testing.T) {
+	ms := int(time.Millisecond)
+	// version 14, before 2.6.25, has three more yield counters and
+	// sched_switch before the same last three
+	v14 := func(step int) fstest.MapFS {
+		return fstest.MapFS{"proc/schedstat": {Data: []byte(fmt.Sprintf(
+			"version 14\ntimestamp 4295000000\ncpu0 0 0 0 0 0 100 50 20 10 %d %d %d\n",
+			step*500*ms, step*100*ms, step*10))}}
+	}
+	reused := schedFiles(2)
+	reused["proc/10/comm"] = &fstest.MapFile{Data: []byte("bash\n")}
+	// the new pid 10 has used more than the old one had, only comm tells them apart
+	reused["proc/10/task/10/schedstat"] = &fstest.MapFile{Data: []byte(fmt.Sprintf("%d 0 1\n", 900*ms))}
+	tests := []struct {
+		name   string
+		first  fstest.MapFS
+		second fstest.MapFS
+		want   string
+	}{
+		{name: "version 14", first: v14(1), second: v14(2),
+			want: "all run: 50% wait: 10% delay: 10.00ms/slice\ncpu0 run: 50% wait: 10% delay: 10.00ms/slice\n"},
+		{name: "pid reused", first: schedFiles(1), second: reused,
+			want: "all run: 100% wait: 50% delay: 4.55ms/slice\n" +
+				"cpu1 run: 90% wait: 50% delay: 5.00ms/slice\n" +
+				"pool[20] cpu: 20% wait: 40% delay: 10.00ms/slice\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			si, err := getSchedStats(new(SchedInfo), tc.first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			si, err = getSchedStats(si, tc.second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			si.oldTime = si.newTime.Add(-time.Second)
+			si.estimate()
+			if out := si.InfoPrint(1, 5); out != tc.want {
+				t.Errorf("got\n%s\nexpected\n%s", out, tc.want)
+			}
+		})
+	}
+}
+
+func TestSchedStatsBadLine(t *testing.T) {
+	fsys := schedFiles(1)
+	fsys["proc/schedstat"] = &fstest.MapFile{Data: []byte("version 15\ncpu0 1 2 3\n")}
+	_, err := getSchedStats(new(SchedInfo), fsys)
+	var fe *status.FormatError
+	if !errors.As(err, &fe) {
+		t.Errorf("expected a format error, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package sensors
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+const (
+	hwmonPath   = "sys/class/hwmon"
+	thermalPath = "sys/class/thermal"
+	// Within this many degrees of critical is worth shouting about
+	nearCrit = 10
+)
+
+// Temperatures are millidegrees celsius, like sysfs has them
+type temp struct {
+	label string
+	input int
+	crit  int // 0 when the chip doesn't say
+}
+
+type fan struct {
+	label string
+	rpm   int
+	alarm bool
+}
+
+// A hwmon chip or a thermal zone
+type chip struct {
+	name  string
+	temps []*temp
+	fans  []*fan
+}
+
+type SensorInfo struct {
+	chips []*chip
+}
+
+func readInt(fsys fs.FS, p string) (int, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(b))
+	// a device being unbound can read as empty before its files go away
+	if s == "" {
+		return 0, fs.ErrNotExist
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, status.Errorf(p, "%w", err)
+	}
+	return v, nil
+}
+
+func readString(fsys fs.FS, p string) string {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Sort sensor files by their number so temp10 comes after temp2
+func sensorNumber(name, prefix string) int {
+	n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), "_input"))
+	return n
+}
+
+// Read the tempN_* and fanN_* files of a hwmon device. Some drivers put them
+// in a device/ subdirectory instead.
+func readHwmon(fsys fs.FS, dir string) (*chip, error) {
+	c := &chip{name: readString(fsys, path.Join(dir, "name"))}
+	if c.name == "" {
+		c.name = readString(fsys, path.Join(dir, "device", "name"))
+	}
+	if c.name == "" {
+		c.name = path.Base(dir)
+	}
+	for _, d := range []string{dir, path.Join(dir, "device")} {
+		for _, kind := range []string{"temp", "fan"} {
+			inputs, err := fs.Glob(fsys, path.Join(d, kind+"[0-9]*_input"))
+			if err != nil {
+				return nil, err
+			}
+			sort.Slice(inputs, func(i, j int) bool {
+				return sensorNumber(path.Base(inputs[i]), kind) < sensorNumber(path.Base(inputs[j]), kind)
+			})
+			for _, in := range inputs {
+				base := strings.TrimSuffix(in, "_input")
+				v, err := readInt(fsys, in)
+				// unreadable sensors, e.g. a disk that's spun down, return
+				// errors rather than a value
+				if err != nil {
+					var fe *status.FormatError
+					if errors.As(err, &fe) {
+						return nil, err
+					}
+					continue
+				}
+				label := readString(fsys, base+"_label")
+				if label == "" {
+					label = path.Base(base)
+				}
+				if kind == "temp" {
+					crit, _ := readInt(fsys, base+"_crit")
+					c.temps = append(c.temps, &temp{label: label, input: v, crit: crit})
+				} else {
+					alarm, _ := readInt(fsys, base+"_alarm")
+					c.fans = append(c.fans, &fan{label: label, rpm: v, alarm: alarm != 0})
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+// A thermal zone has one temperature, critical is whichever trip point has
+// the type critical
+func readThermalZone(fsys fs.FS, dir string) (*chip, error) {
+	v, err := readInt(fsys, path.Join(dir, "temp"))
+	if err != nil {
+		return nil, err
+	}
+	t := &temp{label: path.Base(dir), input: v}
+	trips, err := fs.Glob(fsys, path.Join(dir, "trip_point_[0-9]*_type"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tp := range trips {
+		if readString(fsys, tp) == "critical" {
+			t.crit, _ = readInt(fsys, strings.TrimSuffix(tp, "_type")+"_temp")
+		}
+	}
+	name := readString(fsys, path.Join(dir, "type"))
+	if name == "" {
+		name = path.Base(dir)
+	}
+	return &chip{name: name, temps: []*temp{t}}, nil
+}
+
+// Read every entry matching pattern with read. Missing directories, like in
+// most VMs, aren't an error and neither is a sensor that can't be read right
+// now, only one that reads as something other than a number.
+func readAll(fsys fs.FS, pattern string, read func(fs.FS, string) (*chip, error)) ([]*chip, error) {
+	dirs, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	var chips []*chip
+	for _, d := range dirs {
+		c, err := read(fsys, d)
+		var fe *status.FormatError
+		if errors.As(err, &fe) {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+		if len(c.temps) > 0 || len(c.fans) > 0 {
+			chips = append(chips, c)
+		}
+	}
+	return chips, nil
+}
+
+// Get the current sensor readings. Nothing here is a counter so there is no
+// previous sample to compare against.
+func SensorStats() (*SensorInfo, error) {
+	return getSensorStats(rootfs.FS)
+}
+
+func getSensorStats(fsys fs.FS) (*SensorInfo, error) {
+	si := new(SensorInfo)
+	hwmon, err := readAll(fsys, path.Join(hwmonPath, "hwmon[0-9]*"), readHwmon)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := readAll(fsys, path.Join(thermalPath, "thermal_zone[0-9]*"), readThermalZone)
+	if err != nil {
+		return nil, err
+	}
+	si.chips = append(hwmon, zones...)
+	return si, nil
+}
+
+func (t *temp) nearCrit() bool {
+	return t.crit > 0 && t.input >= t.crit-nearCrit*1000
+}
+
+// The hottest sensor on the chip, or the one closest to critical if any are
+func (c *chip) hottest() *temp {
+	var hot *temp
+	for _, t := range c.temps {
+		switch {
+		case hot == nil:
+			hot = t
+		case t.nearCrit() != hot.nearCrit():
+			if t.nearCrit() {
+				hot = t
+			}
+		case t.input > hot.input:
+			hot = t
+		}
+	}
+	return hot
+}
+
+func celsius(milli int) string {
+	return fmt.Sprintf("%.0fC", float64(milli)/1000)
+}
+
+func (c *chip) String() string {
+	var sb strings.Builder
+	sb.WriteString(c.name)
+	if hot := c.hottest(); hot != nil {
+		sb.WriteString(fmt.Sprintf(" max: %s (%s)", celsius(hot.input), hot.label))
+		if hot.crit > 0 {
+			sb.WriteString(" crit: " + celsius(hot.crit))
+		}
+		if hot.nearCrit() {
+			sb.WriteString(" NEAR CRITICAL")
+		}
+	}
+	for _, f := range c.fans {
+		sb.WriteString(fmt.Sprintf(" %s: %drpm", f.label, f.rpm))
+		if f.alarm {
+			sb.WriteString(" ALARM")
+		}
+	}
+	return sb.String()
+}
+
+// One line per chip with its hottest sensor and fans
+func (si *SensorInfo) InfoPrint() string {
+	if len(si.chips) == 0 {
+		return "none found\n"
+	}
+	var sb strings.Builder
+	for _, c := range si.chips {
+		sb.WriteString(c.String() + "\n")
+	}
+	return sb.String()
+}
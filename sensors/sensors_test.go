@@ -0,0 +1,159 @@
+package sensors
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bioe007/synopsys/status"
+)
+
+func sensorFiles() fstest.MapFS {
+	return fstest.MapFS{
+		"sys/class/hwmon/hwmon0/name":        {Data: []byte("coretemp\n")},
+		"sys/class/hwmon/hwmon0/temp1_input": {Data: []byte("62000\n")},
+		"sys/class/hwmon/hwmon0/temp1_label": {Data: []byte("Package id 0\n")},
+		"sys/class/hwmon/hwmon0/temp1_crit":  {Data: []byte("100000\n")},
+		"sys/class/hwmon/hwmon0/temp2_input": {Data: []byte("58000\n")},
+		"sys/class/hwmon/hwmon0/temp2_label": {Data: []byte("Core 0\n")},
+		"sys/class/hwmon/hwmon0/temp2_crit":  {Data: []byte("100000\n")},
+		// temp10 sorts after temp2 and is within 10C of crit
+		"sys/class/hwmon/hwmon0/temp10_input":       {Data: []byte("93000\n")},
+		"sys/class/hwmon/hwmon0/temp10_label":       {Data: []byte("Core 8\n")},
+		"sys/class/hwmon/hwmon0/temp10_crit":        {Data: []byte("100000\n")},
+		"sys/class/hwmon/hwmon1/name":               {Data: []byte("nct6775\n")},
+		"sys/class/hwmon/hwmon1/device/fan1_input":  {Data: []byte("1200\n")},
+		"sys/class/hwmon/hwmon1/device/fan2_input":  {Data: []byte("0\n")},
+		"sys/class/hwmon/hwmon1/device/fan2_alarm":  {Data: []byte("1\n")},
+		"sys/class/hwmon/hwmon1/device/temp1_input": {Data: []byte("41000\n")},
+		// nothing readable, shouldn't show up
+		"sys/class/hwmon/hwmon2/name":                       {Data: []byte("acpitz\n")},
+		"sys/class/thermal/thermal_zone0/type":              {Data: []byte("x86_pkg_temp\n")},
+		"sys/class/thermal/thermal_zone0/temp":              {Data: []byte("55000\n")},
+		"sys/class/thermal/thermal_zone0/trip_point_0_type": {Data: []byte("passive\n")},
+		"sys/class/thermal/thermal_zone0/trip_point_0_temp": {Data: []byte("85000\n")},
+		"sys/class/thermal/thermal_zone0/trip_point_1_type": {Data: []byte("critical\n")},
+		"sys/class/thermal/thermal_zone0/trip_point_1_temp": {Data: []byte("105000\n")},
+	}
+}
+
+func TestSensorStats(t *testing.T) {
+	si, err := getSensorStats(sensorFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(si.chips) != 3 {
+		t.Fatalf("expected 3 chips, got %d", len(si.chips))
+	}
+	core := si.chips[0]
+	if core.name != "coretemp" || len(core.temps) != 3 || core.temps[2].label != "Core 8" {
+		t.Errorf("wrong coretemp %+v", core)
+	}
+	fans := si.chips[1].fans
+	if len(fans) != 2 || fans[0].rpm != 1200 || fans[0].alarm || !fans[1].alarm {
+		t.Errorf("wrong fans %+v %+v", fans[0], fans[1])
+	}
+	zone := si.chips[2]
+	if zone.name != "x86_pkg_temp" || zone.temps[0].crit != 105000 {
+		t.Errorf("wrong thermal zone %+v", zone.temps[0])
+	}
+
+	out := si.InfoPrint()
+	for _, want := range []string{
+		"coretemp max: 93C (Core 8) crit: 100C NEAR CRITICAL\n",
+		"nct6775 max: 41C (temp1) fan1: 1200rpm fan2: 0rpm ALARM\n",
+		"x86_pkg_temp max: 55C (thermal_zone0) crit: 105C\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
+
+// A hot sensor not near crit loses to a cooler one that is
+func TestHottestNearCrit(t *testing.T) {
+	c := &chip{temps: []*temp{
+		{label: "a", input: 95000, crit: 120000},
+		{label: "b", input: 85000, crit: 90000},
+	}}
+	if hot := c.hottest(); hot.label != "b" {
+		t.Errorf("expected b, got %s", hot.label)
+	}
+}
+
+// Reading a file in errs gives its error, like a sensor that went away after
+// the glob or a disk that's spun down
+type errFS struct {
+	fstest.MapFS
+	errs map[string]error
+}
+
+func (e errFS) Open(name string) (fs.File, error) {
+	if err, ok := e.errs[name]; ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return e.MapFS.Open(name)
+}
+
+func (e errFS) ReadFile(name string) ([]byte, error) {
+	if err, ok := e.errs[name]; ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return e.MapFS.ReadFile(name)
+}
+
+func TestSensorStatsChanging(t *testing.T) {
+	// before 2.6.36 most drivers only had their files under device/
+	older := fstest.MapFS{
+		"sys/class/hwmon/hwmon0/device/name":        {Data: []byte("w83627hf\n")},
+		"sys/class/hwmon/hwmon0/device/temp1_input": {Data: []byte("45000\n")},
+		"sys/class/hwmon/hwmon0/device/fan1_input":  {Data: []byte("900\n")},
+	}
+	emptied := sensorFiles()
+	emptied["sys/class/thermal/thermal_zone0/temp"] = &fstest.MapFile{}
+	tests := []struct {
+		name string
+		fsys fs.FS
+		want string
+	}{
+		{name: "none", fsys: fstest.MapFS{}, want: "none found\n"},
+		{name: "older layout", fsys: older, want: "w83627hf max: 45C (temp1) fan1: 900rpm\n"},
+		{name: "gone after glob", fsys: errFS{sensorFiles(), map[string]error{
+			"sys/class/hwmon/hwmon0/temp10_input":  fs.ErrNotExist,
+			"sys/class/thermal/thermal_zone0/temp": fs.ErrNotExist,
+		}}, want: "coretemp max: 62C (Package id 0) crit: 100C\n" +
+			"nct6775 max: 41C (temp1) fan1: 1200rpm fan2: 0rpm ALARM\n"},
+		{name: "io error", fsys: errFS{sensorFiles(), map[string]error{
+			"sys/class/hwmon/hwmon1/device/temp1_input": syscall.EIO,
+			"sys/class/hwmon/hwmon1/device/fan1_input":  syscall.EIO,
+			"sys/class/hwmon/hwmon1/device/fan2_input":  syscall.ENODATA,
+		}}, want: "coretemp max: 93C (Core 8) crit: 100C NEAR CRITICAL\n" +
+			"x86_pkg_temp max: 55C (thermal_zone0) crit: 105C\n"},
+		{name: "empty read", fsys: emptied, want: "coretemp max: 93C (Core 8) crit: 100C NEAR CRITICAL\n" +
+			"nct6775 max: 41C (temp1) fan1: 1200rpm fan2: 0rpm ALARM\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			si, err := getSensorStats(tc.fsys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out := si.InfoPrint(); out != tc.want {
+				t.Errorf("got\n%s\nexpected\n%s", out, tc.want)
+			}
+		})
+	}
+}
+
+func TestSensorStatsBadValue(t *testing.T) {
+	fsys := sensorFiles()
+	fsys["sys/class/hwmon/hwmon0/temp1_input"] = &fstest.MapFile{Data: []byte("hot\n")}
+	_, err := getSensorStats(fsys)
+	var fe *status.FormatError
+	if !errors.As(err, &fe) {
+		t.Errorf("expected a format error, got %v", err)
+	}
+}
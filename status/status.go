@@ -0,0 +1,42 @@
+package status
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// A file didn't have the content expected, e.g. a kernel changed a format or
+// a field is missing. Files that can't be read are *fs.PathError instead.
+type FormatError struct {
+	File string
+	Err  error
+}
+
+func (e *FormatError) Error() string {
+	return e.File + ": " + e.Err.Error()
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// Make a FormatError for file with a message like fmt.Errorf
+func Errorf(file string, format string, a ...any) error {
+	return &FormatError{File: file, Err: fmt.Errorf(format, a...)}
+}
+
+// A short reason a section is unavailable, for showing in its place
+func Reason(err error) string {
+	var pe *fs.PathError
+	var fe *FormatError
+	switch {
+	case errors.As(err, &pe) && errors.Is(err, fs.ErrNotExist):
+		return "not found " + pe.Path
+	case errors.As(err, &pe) && errors.Is(err, fs.ErrPermission):
+		return "permission denied " + pe.Path
+	case errors.As(err, &fe):
+		return "unexpected format " + fe.Error()
+	}
+	return err.Error()
+}
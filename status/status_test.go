@@ -0,0 +1,33 @@
+package status
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReason(t *testing.T) {
+	_, notFound := fs.ReadFile(fstest.MapFS{}, "sys/block")
+	_, atoi := strconv.Atoi("x")
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{notFound, "not found sys/block"},
+		{&fs.PathError{Op: "open", Path: "/dev/kmsg", Err: os.ErrPermission}, "permission denied /dev/kmsg"},
+		{Errorf("proc/loadavg", "%d fields", 3), "unexpected format proc/loadavg: 3 fields"},
+		{Errorf("proc/meminfo", "MemTotal: %w", atoi), `unexpected format proc/meminfo: MemTotal: strconv.Atoi: parsing "x": invalid syntax`},
+		{errors.New("cgroup v2 is not mounted"), "cgroup v2 is not mounted"},
+	}
+	for _, tt := range tests {
+		if got := Reason(tt.err); got != tt.want {
+			t.Errorf("got %q want %q", got, tt.want)
+		}
+	}
+	if !errors.Is(Errorf("f", "x: %w", fs.ErrClosed), fs.ErrClosed) {
+		t.Error("wrapped error lost")
+	}
+}
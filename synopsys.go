@@ -6,14 +6,31 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/bioe007/synopsys/burst"
+	"github.com/bioe007/synopsys/cgroup"
+	"github.com/bioe007/synopsys/container"
 	"github.com/bioe007/synopsys/cpu"
 	"github.com/bioe007/synopsys/disk"
+	"github.com/bioe007/synopsys/hugepages"
+	"github.com/bioe007/synopsys/hwerr"
+	"github.com/bioe007/synopsys/limits"
 	"github.com/bioe007/synopsys/load"
 	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/network"
+	"github.com/bioe007/synopsys/nfs"
+	"github.com/bioe007/synopsys/numa"
+	"github.com/bioe007/synopsys/oom"
+	"github.com/bioe007/synopsys/procio"
+	"github.com/bioe007/synopsys/sched"
+	"github.com/bioe007/synopsys/sensors"
+	"github.com/bioe007/synopsys/status"
 	"github.com/bioe007/synopsys/uptime"
+	"github.com/bioe007/synopsys/zmem"
 )
 
 var scaleMap = map[rune]int{
@@ -31,92 +48,449 @@ const usage = `Usage:
     synopsys [options]
 
 Options:
-    -i, --interval  [integer]   Duration in seconds between updates, default 1.
+    -i, --interval  [duration]  Time between updates, either seconds or a Go
+                                duration like 250ms or 2s. Default 1s.
+    -b, --burst     [duration]  Also sample cpu and disks this often, e.g.
+                                100ms, and show the max and p99 of each
+                                interval so short spikes aren't averaged away.
+    -n, --count     [integer]   Exit after this many updates, like vmstat.
+                                Default 0 runs until interrupted.
+    --once                      Take two samples an interval apart, print one
+                                complete report and exit.
+    --strict                    Exit on the first thing that can't be read,
+                                otherwise that section shows why and the rest
+                                carry on.
     -c, --cpu       [integer]   Max number of CPU you want to see output.
                                 Default 8.
     -d, --disks     [integer]   Max number of disks you want to see output.
                                 Default 8.
+    -I, --interfaces [integer]  Max number of network interfaces you want to
+                                see output. Default 4.
     -m, --memscale  [kKmMgGtT]  Units of memory to display, in kilo/Kibi etc.
                                 Default is megabytes.
     -D, --disk-only             Show only disk activity
+    --disk-detail               Show the scheduler, queue settings, error
+                                count and nvme state and temperature of each
+                                disk shown
+    -N, --numa                  Show memory and cpu use per NUMA node
+    -g, --cgroup                Show limits and usage of the cgroup synopsys
+                                runs in, needs cgroup v2.
+    --cgroup-top    [path]      Rank the child cgroups of path by cpu, memory
+                                and io, e.g. /system.slice
+    -s, --sockets               Show socket states, accept queues and the
+                                remote hosts with the most connections
+    -r, --remotes   [integer]   Max number of remote hosts to show. Default 5.
+    -U, --drops                 Show udp errors, udp socket drops and softnet
+                                backlog drops per second
+    -C, --conntrack             Show conntrack table use and drops
+    --conntrack-warn [integer]  Warn when the conntrack table is this percent
+                                full. Default 80.
+    -L, --limits                Show open files, inodes, pids and threads vs
+                                their kernel limits and the processes with the
+                                most open files
+    -F, --fds       [integer]   Max number of processes by open files to show.
+                                Default 5.
+    --limits-warn   [integer]   Warn when a kernel or per process limit is
+                                this percent used. Default 80.
+    -O, --oom                   Always show the OOM kill panel, it's shown
+                                without this once there has been a kill.
+    -T, --sensors               Show the hottest temperature of each hwmon
+                                chip and thermal zone against its critical
+                                limit, and fan speeds
+    -H, --hwerrors              Always show the hardware errors panel, memory
+                                pages the kernel poisoned, EDAC and PCIe AER
+                                counts. It's shown without this once anything
+                                has reported an error.
+    --nfs                       Show ops/s, rtt, execute time, retransmits
+                                and timeouts of nfs mounts per operation,
+                                worst mounts first
+    --nfs-mounts    [integer]   Max number of nfs mounts to show. Default 5.
+    -Z, --zram                  Show zram devices, zswap and KSM, original vs
+                                compressed size, pool limits and the memory
+                                KSM saves
+    -P, --hugepages             Show hugetlb pools, THP use and settings and
+                                the rate of THP allocations and fallbacks
+    -Q, --runqueue              Show time running vs waiting on the run queue
+                                and the average wait per timeslice, per cpu
+                                and for the processes using the most cpu
+    --runqueue-procs [integer]  Max number of processes by cpu to show.
+                                Default 5.
+    -o, --iotop                 Show the processes reading and writing the
+                                most to disk, like iotop. Other users'
+                                processes need root.
+    --iotop-procs   [integer]   Max number of processes by io to show.
+                                Default 5.
 `
 
+// Update a collector. Collectors read everything before changing their state,
+// so when one fails the previous state is kept whole and the next good sample
+// is compared against the last good one.
+func update[T any](state T, collect func(T) (T, error)) (T, error) {
+	next, err := collect(state)
+	if err != nil {
+		return state, err
+	}
+	return next, nil
+}
+
+// The output of a section, or why it's unavailable, without a trailing newline
+func section(err error, info func() string) string {
+	if err != nil {
+		return "unavailable: " + status.Reason(err)
+	}
+	return strings.TrimSuffix(info(), "\n")
+}
+
+// An interval given as seconds, like -i used to take, or a Go duration
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(s string) error {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		*d = duration(secs * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s\n", usage)
 	}
 
 	var (
-		num_disks, num_cpu, num_seconds int
-		mem_scale                       string
-		disk_only                       bool
+		num_disks, num_cpu               int
+		every, burst_every               duration
+		num_remotes, conntrack_warn      int
+		num_ifaces, num_fds, limits_warn int
+		mem_scale, cgroup_top            string
+		disk_only, show_numa             bool
+		show_cgroup, show_sockets        bool
+		show_drops, show_conntrack       bool
+		show_limits, show_oom            bool
+		show_sensors, show_hwerrors      bool
+		disk_detail, show_nfs            bool
+		num_mounts                       int
+		show_zmem, show_huge, show_runq  bool
+		num_runq_procs, num_io_procs     int
+		show_iotop                       bool
+		num_count                        int
+		once, strict                     bool
 	)
-	flag.IntVar(&num_seconds, "interval", 1,
-		"The number of seconds to wait between updates.")
-	flag.IntVar(&num_seconds, "i", 1,
-		"The number of seconds to wait between updates.")
+	every = duration(time.Second)
+	flag.Var(&every, "interval", "The time to wait between updates.")
+	flag.Var(&every, "i", "The time to wait between updates.")
+	flag.Var(&burst_every, "burst", "How often to sample for the max and p99")
+	flag.Var(&burst_every, "b", "How often to sample for the max and p99")
+	flag.IntVar(&num_count, "count", 0, "How many updates before exiting")
+	flag.IntVar(&num_count, "n", 0, "How many updates before exiting")
+	flag.BoolVar(&once, "once", false, "Print a single report and exit")
+	flag.BoolVar(&strict, "strict", false, "Exit when anything can't be read")
 	flag.IntVar(&num_cpu, "cpu", 8, "How many 'hot' CPU to display")
 	flag.IntVar(&num_cpu, "c", 8, "How many 'hot' CPU to display")
 	flag.IntVar(&num_disks, "disks", 8, "How many 'hot' CPU to display")
 	flag.IntVar(&num_disks, "d", 8, "How many 'hot' CPU to display")
+	flag.IntVar(&num_ifaces, "interfaces", 4, "How many busy network interfaces to display")
+	flag.IntVar(&num_ifaces, "I", 4, "How many busy network interfaces to display")
 	flag.StringVar(&mem_scale, "memory", "m", "Choose how to scale memory")
 	flag.StringVar(&mem_scale, "m", "m", "Choose how to scale memory")
 	flag.BoolVar(&disk_only, "D", false, "Only show disk activity")
+	flag.BoolVar(&disk_detail, "disk-detail", false, "Show disk queue settings and errors")
+	flag.BoolVar(&show_numa, "numa", false, "Show per NUMA node stats")
+	flag.BoolVar(&show_numa, "N", false, "Show per NUMA node stats")
+	flag.BoolVar(&show_cgroup, "cgroup", false, "Show stats for the current cgroup")
+	flag.BoolVar(&show_cgroup, "g", false, "Show stats for the current cgroup")
+	flag.StringVar(&cgroup_top, "cgroup-top", "", "Rank the children of this cgroup")
+	flag.BoolVar(&show_sockets, "sockets", false, "Show socket summary")
+	flag.BoolVar(&show_sockets, "s", false, "Show socket summary")
+	flag.IntVar(&num_remotes, "remotes", 5, "How many remote hosts to display")
+	flag.IntVar(&num_remotes, "r", 5, "How many remote hosts to display")
+	flag.BoolVar(&show_drops, "drops", false, "Show udp and softnet drops")
+	flag.BoolVar(&show_drops, "U", false, "Show udp and softnet drops")
+	flag.BoolVar(&show_conntrack, "conntrack", false, "Show conntrack table use")
+	flag.BoolVar(&show_conntrack, "C", false, "Show conntrack table use")
+	flag.IntVar(&conntrack_warn, "conntrack-warn", 80, "Percent of the conntrack table to warn at")
+	flag.BoolVar(&show_limits, "limits", false, "Show kernel table limits")
+	flag.BoolVar(&show_limits, "L", false, "Show kernel table limits")
+	flag.IntVar(&num_fds, "fds", 5, "How many processes by open files to display")
+	flag.IntVar(&num_fds, "F", 5, "How many processes by open files to display")
+	flag.IntVar(&limits_warn, "limits-warn", 80, "Percent of a limit to warn at")
+	flag.BoolVar(&show_oom, "oom", false, "Always show OOM kills")
+	flag.BoolVar(&show_oom, "O", false, "Always show OOM kills")
+	flag.BoolVar(&show_sensors, "sensors", false, "Show temperatures and fans")
+	flag.BoolVar(&show_sensors, "T", false, "Show temperatures and fans")
+	flag.BoolVar(&show_hwerrors, "hwerrors", false, "Always show hardware errors")
+	flag.BoolVar(&show_hwerrors, "H", false, "Always show hardware errors")
+	flag.BoolVar(&show_nfs, "nfs", false, "Show nfs client stats")
+	flag.IntVar(&num_mounts, "nfs-mounts", 5, "How many nfs mounts to display")
+	flag.BoolVar(&show_zmem, "zram", false, "Show zram, zswap and ksm")
+	flag.BoolVar(&show_zmem, "Z", false, "Show zram, zswap and ksm")
+	flag.BoolVar(&show_huge, "hugepages", false, "Show hugepages and THP")
+	flag.BoolVar(&show_huge, "P", false, "Show hugepages and THP")
+	flag.BoolVar(&show_runq, "runqueue", false, "Show run queue latency")
+	flag.BoolVar(&show_runq, "Q", false, "Show run queue latency")
+	flag.IntVar(&num_runq_procs, "runqueue-procs", 5, "How many processes by cpu to display")
+	flag.BoolVar(&show_iotop, "iotop", false, "Show processes by disk io")
+	flag.BoolVar(&show_iotop, "o", false, "Show processes by disk io")
+	flag.IntVar(&num_io_procs, "iotop-procs", 5, "How many processes by io to display")
 	flag.Parse()
 
-	// TODO - parse this as an arg
 	ms := []rune(mem_scale)
+	if len(ms) == 0 || scaleMap[ms[0]] == 0 {
+		log.Fatalf("Unknown memory scale %q, use one of kKmMgGtT", mem_scale)
+	}
 	memory.SetScale(scaleMap[ms[0]])
 
-	ticker := time.NewTicker(time.Duration(num_seconds) * time.Second)
-	var err error
+	if num_count < 0 {
+		log.Fatalf("Count must not be negative, got %d", num_count)
+	}
+
+	// Without --strict a collector that fails shows why in place of its
+	// section and the rest carry on
+	check := func(name string, err error) error {
+		if err != nil && strict {
+			log.Fatalf("%s: %v", name, err)
+		}
+		return err
+	}
+
+	if every <= 0 {
+		log.Fatalf("Interval must be more than zero, got %s", every.String())
+	}
+	if burst_every < 0 || burst_every >= every {
+		log.Fatalf("Burst sampling must be more often than the interval, got %s", burst_every.String())
+	}
+
+	var bursts *burst.Sampler
+	if burst_every > 0 {
+		bursts = burst.NewSampler()
+		go func() {
+			t := time.NewTicker(time.Duration(burst_every))
+			for ; ; <-t.C {
+				bursts.Sample()
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(time.Duration(every))
+	done := make(chan bool, 1)
 	go func() {
 		c := new(cpu.CpuInfo)
-		disks := new(disk.DiskInfo)
+		disks := &disk.DiskInfo{Detail: disk_detail}
+		nodes := new(numa.NumaInfo)
+		cg := &cgroup.CgroupInfo{TopParent: cgroup_top}
+		drops := new(network.DropInfo)
+		ct := &network.ConntrackInfo{WarnPercent: conntrack_warn}
+		ifaces := new(network.NetInfo)
+		resolver := container.NewResolver()
+		lim := &limits.LimitsInfo{
+			WarnPercent: limits_warn,
+			Resolver:    resolver,
+		}
+		ooms := new(oom.OomInfo)
+		hw := new(hwerr.HwErrInfo)
+		mounts := new(nfs.NfsInfo)
+		zm := new(zmem.ZmemInfo)
+		huge := new(hugepages.HugeInfo)
+		runq := &sched.SchedInfo{Resolver: resolver}
+		iotop := &procio.ProcIoInfo{Resolver: resolver}
+		samples := 0
+		var last time.Time
 		for ; ; <-ticker.C {
-			c, err = cpu.CPUStats(c)
-			if err != nil {
-				log.Fatal(err)
+			samples++
+			resolver.Expire()
+			// The ticker drops ticks when the box is too busy to keep up,
+			// show how long it really was
+			now := time.Now()
+			interval := "-"
+			if !last.IsZero() {
+				interval = now.Sub(last).Round(time.Millisecond).String()
 			}
+			last = now
+			var cpuErr, memErr, loadErr, diskErr, netErr, upErr error
+			var numaErr, cgErr, dropErr, ctErr, limErr, oomErr, sockErr error
+			var sensorErr, hwErr, nfsErr, zmemErr, hugeErr, runqErr error
+			var iotopErr error
 
-			m, err := memory.Getmeminfo()
-			if err != nil {
-				log.Fatal(err)
+			c, cpuErr = update(c, cpu.CPUStats)
+			check("cpu", cpuErr)
+
+			m, memErr := memory.Getmeminfo()
+			check("memory", memErr)
+
+			ld, loadErr := load.LoadAvg()
+			check("load average", loadErr)
+
+			disks, diskErr = update(disks, disk.DiskStats)
+			check("disks", diskErr)
+
+			ifaces, netErr = update(ifaces, network.NetStats)
+			check("network", netErr)
+
+			ut, upErr := uptime.Read_uptime()
+			check("uptime", upErr)
+
+			if show_numa {
+				nodes, numaErr = update(nodes, numa.NumaStats)
+				check("numa", numaErr)
+			}
+
+			if show_cgroup || cgroup_top != "" {
+				cg, cgErr = update(cg, cgroup.CgroupStats)
+				check("cgroup", cgErr)
+			}
+
+			if show_drops {
+				drops, dropErr = update(drops, network.DropStats)
+				check("drops", dropErr)
+			}
+
+			if show_conntrack {
+				ct, ctErr = update(ct, network.ConntrackStats)
+				check("conntrack", ctErr)
+			}
+
+			if show_limits {
+				// the task counts come from the load average
+				if limErr = loadErr; limErr == nil {
+					lim, limErr = update(lim, func(li *limits.LimitsInfo) (*limits.LimitsInfo, error) {
+						return limits.LimitStats(li, ld)
+					})
+				}
+				check("limits", limErr)
+			}
+
+			if show_nfs {
+				mounts, nfsErr = update(mounts, nfs.NfsStats)
+				check("nfs", nfsErr)
 			}
 
-			ld, err := load.LoadAvg()
-			if err != nil {
-				log.Fatal("Load average failure", err)
+			if show_zmem {
+				zm, zmemErr = update(zm, func(zi *zmem.ZmemInfo) (*zmem.ZmemInfo, error) {
+					return zmem.ZmemStats(zi, m)
+				})
+				check("zram", zmemErr)
 			}
 
-			disks, err := disk.DiskStats(disks)
-			if err != nil {
-				log.Fatal("disk average failure", err)
+			if show_huge {
+				huge, hugeErr = update(huge, func(hi *hugepages.HugeInfo) (*hugepages.HugeInfo, error) {
+					return hugepages.HugeStats(hi, m)
+				})
+				check("hugepages", hugeErr)
 			}
 
-			ut, err := uptime.Read_uptime()
-			if err != nil {
-				log.Fatal("Unable to read uptime")
+			if show_runq {
+				runq, runqErr = update(runq, sched.SchedStats)
+				check("run queue", runqErr)
+			}
+
+			if show_iotop {
+				iotop, iotopErr = update(iotop, procio.ProcIoStats)
+				check("iotop", iotopErr)
+			}
+
+			// always watched so a kill is noticed without asking
+			ooms, oomErr = update(ooms, oom.OomStats)
+			check("oom", oomErr)
+
+			// also always watched, a failing dimm shouldn't need asking about
+			hw, hwErr = update(hw, func(hi *hwerr.HwErrInfo) (*hwerr.HwErrInfo, error) {
+				return hwerr.HwErrStats(hi, m)
+			})
+			check("hardware errors", hwErr)
+
+			// The first sample is only there so the second has something to
+			// compare against, printing it would show empty cpu and disk use
+			if once && samples == 1 {
+				continue
 			}
 			if !disk_only {
 				fmt.Printf(
-					"up:%s %s cpu:%s\nmem: %s\ndisks:%s\n",
-					ut.HoursMinutes(),
-					ld.InfoPrint(),
+					"up:%s int:%s %s cpu:%s\nmem: %s\ndisks:%s\nnet:%s\n",
+					section(upErr, ut.HoursMinutes),
+					interval,
+					section(loadErr, ld.InfoPrint),
 					// TODO - accept as parameter
-					c.InfoPrint(num_cpu),
-					m.InfoPrint(),
-					disks.InfoPrint(num_disks),
+					section(cpuErr, func() string { return c.InfoPrint(num_cpu) }),
+					section(memErr, m.InfoPrint),
+					section(diskErr, func() string { return disks.InfoPrint(num_disks) }),
+					section(netErr, func() string { return ifaces.InfoPrint(num_ifaces) }),
 				)
+				if show_numa {
+					fmt.Printf("numa: %s\n", section(numaErr, func() string { return nodes.InfoPrint(c) }))
+				}
+				if show_cgroup {
+					fmt.Printf("cgroup: %s\n", section(cgErr, cg.InfoPrint))
+				}
+				if cgroup_top != "" && cgErr != nil {
+					fmt.Printf("cgroup top: %s\n", section(cgErr, cg.TopPrint))
+				} else if cgroup_top != "" {
+					fmt.Print(cg.TopPrint())
+				}
+				if show_sockets {
+					socks, err := network.SocketStats()
+					sockErr = check("sockets", err)
+					fmt.Printf("sockets:\n%s\n", section(sockErr, func() string { return socks.InfoPrint(num_remotes) }))
+				}
+				if show_drops {
+					fmt.Printf("drops:\n%s\n", section(dropErr, drops.InfoPrint))
+				}
+				if show_conntrack {
+					fmt.Printf("conntrack: %s\n", section(ctErr, ct.InfoPrint))
+				}
+				if show_limits {
+					fmt.Printf("limits: %s\n", section(limErr, func() string { return lim.InfoPrint(num_fds) }))
+				}
+				if show_nfs {
+					fmt.Printf("nfs:\n%s\n", section(nfsErr, func() string { return mounts.InfoPrint(num_mounts) }))
+				}
+				if show_zmem {
+					fmt.Printf("compressed:\n%s\n", section(zmemErr, zm.InfoPrint))
+				}
+				if show_huge {
+					fmt.Printf("hugepages:\n%s\n", section(hugeErr, huge.InfoPrint))
+				}
+				if show_runq {
+					fmt.Printf("run queue:\n%s\n", section(runqErr, func() string { return runq.InfoPrint(num_cpu, num_runq_procs) }))
+				}
+				if show_iotop {
+					fmt.Printf("iotop: %s\n", section(iotopErr, func() string { return iotop.InfoPrint(num_io_procs) }))
+				}
+				if show_sensors {
+					temps, err := sensors.SensorStats()
+					sensorErr = check("sensors", err)
+					fmt.Printf("sensors:\n%s\n", section(sensorErr, temps.InfoPrint))
+				}
+				if show_oom || ooms.HasKills() || oomErr != nil {
+					fmt.Printf("oom: %s\n", section(oomErr, ooms.InfoPrint))
+				}
+				if show_hwerrors || hw.HasErrors() || hwErr != nil {
+					fmt.Printf("hardware errors: %s\n", section(hwErr, hw.InfoPrint))
+				}
 			} else {
-				fmt.Printf("disks:\n%s\n", disks.InfoPrint(num_disks))
+				fmt.Printf("disks: int:%s\n%s\n", interval, section(diskErr, func() string { return disks.InfoPrint(num_disks) }))
+			}
+			if bursts != nil {
+				fmt.Printf("burst: %s\n", bursts.InfoPrint())
+			}
+
+			if once || (num_count > 0 && samples >= num_count) {
+				done <- true
+				return
 			}
 		}
 	}()
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	done := make(chan bool, 1)
 
 	// Wait until getting SIGINT or SIGTERM
 	go func() {
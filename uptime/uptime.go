@@ -2,16 +2,19 @@ package uptime
 
 import (
 	"fmt"
-	"os"
+	"io/fs"
 	"strconv"
 	"strings"
+
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
 )
 
 // example
 // 221671.25 3315800.64
 
 const (
-	uptimePath     = "/proc/uptime"
+	uptimePath     = "proc/uptime"
 	secondsPerMin  = 60
 	secondsPerHour = 3600
 )
@@ -33,11 +36,18 @@ func (ut *Uptime) HoursMinutes() string {
 }
 
 func Read_uptime() (*Uptime, error) {
-	ufile, err := os.ReadFile(uptimePath)
+	return readUptime(rootfs.FS)
+}
+
+func readUptime(fsys fs.FS) (*Uptime, error) {
+	ufile, err := fs.ReadFile(fsys, uptimePath)
 	if err != nil {
 		return nil, err
 	}
 	sp := strings.Split(strings.TrimSuffix(string(ufile), "\n"), " ")
+	if len(sp) != 2 {
+		return nil, status.Errorf(uptimePath, "%d fields", len(sp))
+	}
 
 	ut := new(Uptime)
 	ut.UptimeSeconds, err = strconv.ParseFloat(sp[0], 64)
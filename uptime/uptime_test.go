@@ -0,0 +1,19 @@
+package uptime
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestReadUptime(t *testing.T) {
+	ut, err := readUptime(fstest.MapFS{"proc/uptime": {Data: []byte("221671.25 3315800.64\n")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ut.HoursMinutes(); s != "61:34:31" {
+		t.Errorf("got %q", s)
+	}
+	if _, err := readUptime(fstest.MapFS{"proc/uptime": {Data: []byte("221671.25\n")}}); err == nil {
+		t.Error("expected an error with one field")
+	}
+}
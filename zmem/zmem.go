@@ -0,0 +1,364 @@
+package zmem
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/rootfs"
+	"github.com/bioe007/synopsys/status"
+)
+
+const (
+	zswapDebugPath  = "sys/kernel/debug/zswap"
+	zswapParamsPath = "sys/module/zswap/parameters"
+	ksmPath         = "sys/kernel/mm/ksm"
+)
+
+var pageSize = os.Getpagesize()
+
+// From mm_stat and io_stat, sizes in bytes
+type zram struct {
+	name         string
+	disksize     int
+	origSize     int // data stored, before compression
+	comprSize    int
+	memUsed      int // compressed plus allocator overhead
+	memLimit     int // 0 for none
+	samePages    int // pages of one repeated value, not stored at all
+	hugePages    int // incompressible, -1 before 5.1
+	failedReads  int
+	failedWrites int
+}
+
+type zswap struct {
+	available bool
+	enabled   bool
+	maxPool   int // percent of memory
+	debug     bool
+	// sizes in kB, from debugfs when readable or meminfo
+	pool      int
+	stored    int
+	limitHit  int
+	rejects   int
+	writeback int
+}
+
+type ksm struct {
+	available bool
+	run       int
+	shared    int // pages
+	sharing   int // mappings of the shared pages
+	unshared  int
+	fullScans int
+	profit    int // bytes, -1 before 6.1
+}
+
+type sample struct {
+	memTotal int // kB, 0 when meminfo couldn't be read
+	zrams    []*zram
+	zswap    zswap
+	ksm      ksm
+}
+
+type ZmemInfo struct {
+	old *sample
+	new *sample
+}
+
+// Read whitespace separated numbers, a missing file is nil
+func readInts(fsys fs.FS, p string) ([]int, error) {
+	b, err := fs.ReadFile(fsys, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var vals []int
+	for _, f := range strings.Fields(string(b)) {
+		v, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, status.Errorf(p, "%w", err)
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+// A single number, -1 when the file is missing
+func readInt(fsys fs.FS, p string) (int, error) {
+	vals, err := readInts(fsys, p)
+	if err != nil || len(vals) == 0 {
+		return -1, err
+	}
+	return vals[0], nil
+}
+
+// Before mm_stat each value had its own file, and 4.1 to 5.0 have no
+// huge_pages column
+func readMmStat(fsys fs.FS, dir string) ([]int, error) {
+	p := path.Join(dir, "mm_stat")
+	mm, err := readInts(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	if mm == nil {
+		mm = make([]int, 7)
+		for i, name := range map[int]string{
+			0: "orig_data_size", 1: "compr_data_size", 2: "mem_used_total", 3: "mem_limit", 5: "zero_pages",
+		} {
+			if mm[i], err = readInt(fsys, path.Join(dir, name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(mm) < 7 {
+		return nil, status.Errorf(p, "expected at least 7 fields, got %d", len(mm))
+	}
+	if len(mm) == 7 {
+		mm = append(mm, -1)
+	}
+	return mm, nil
+}
+
+// zram devices that have been set up
+func readZrams(fsys fs.FS) ([]*zram, error) {
+	dirs, err := fs.Glob(fsys, "sys/block/zram[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var zrams []*zram
+	for _, dir := range dirs {
+		z := &zram{name: path.Base(dir)}
+		if z.disksize, err = readInt(fsys, path.Join(dir, "disksize")); err != nil {
+			return nil, err
+		}
+		if z.disksize <= 0 {
+			continue
+		}
+		mm, err := readMmStat(fsys, dir)
+		if err != nil {
+			return nil, err
+		}
+		z.origSize, z.comprSize, z.memUsed, z.memLimit = mm[0], mm[1], mm[2], mm[3]
+		z.samePages, z.hugePages = mm[5], mm[7]
+		io, err := readInts(fsys, path.Join(dir, "io_stat"))
+		if err != nil {
+			return nil, err
+		}
+		if len(io) >= 2 {
+			z.failedReads, z.failedWrites = io[0], io[1]
+		}
+		zrams = append(zrams, z)
+	}
+	return zrams, nil
+}
+
+// The debugfs stats need root, without them meminfo still has the sizes
+func readZswap(fsys fs.FS, m *memory.Meminfo) (zswap, error) {
+	var z zswap
+	enabled, err := fs.ReadFile(fsys, path.Join(zswapParamsPath, "enabled"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return z, nil
+	}
+	if err != nil {
+		return z, err
+	}
+	z.available = true
+	z.enabled = strings.TrimSpace(string(enabled)) == "Y"
+	if z.maxPool, err = readInt(fsys, path.Join(zswapParamsPath, "max_pool_percent")); err != nil {
+		return z, err
+	}
+
+	if m != nil {
+		z.pool, z.stored = m.Zswap, m.Zswapped
+	}
+	pool, err := readInt(fsys, path.Join(zswapDebugPath, "pool_total_size"))
+	if err != nil || pool < 0 {
+		// not root, or debugfs isn't mounted
+		var fe *status.FormatError
+		if errors.As(err, &fe) {
+			return z, err
+		}
+		return z, nil
+	}
+	z.debug = true
+	z.pool = pool / 1024
+	stored, err := readInt(fsys, path.Join(zswapDebugPath, "stored_pages"))
+	if err != nil {
+		return z, err
+	}
+	z.stored = stored * pageSize / 1024
+	if z.limitHit, err = readInt(fsys, path.Join(zswapDebugPath, "pool_limit_hit")); err != nil {
+		return z, err
+	}
+	if z.writeback, err = readInt(fsys, path.Join(zswapDebugPath, "written_back_pages")); err != nil {
+		return z, err
+	}
+	rejects, err := fs.Glob(fsys, path.Join(zswapDebugPath, "reject_*"))
+	if err != nil {
+		return z, err
+	}
+	for _, p := range rejects {
+		v, err := readInt(fsys, p)
+		if err != nil {
+			return z, err
+		}
+		z.rejects += max(v, 0)
+	}
+	return z, nil
+}
+
+func readKsm(fsys fs.FS) (ksm, error) {
+	k := ksm{}
+	dest := map[string]*int{
+		"run":            &k.run,
+		"pages_shared":   &k.shared,
+		"pages_sharing":  &k.sharing,
+		"pages_unshared": &k.unshared,
+		"full_scans":     &k.fullScans,
+		"general_profit": &k.profit,
+	}
+	for name, d := range dest {
+		v, err := readInt(fsys, path.Join(ksmPath, name))
+		if err != nil {
+			return k, err
+		}
+		*d = v
+	}
+	k.available = k.run >= 0
+	return k, nil
+}
+
+// Get a ZmemInfo with the current zram, zswap and ksm state. The zswap sizes
+// fall back to meminfo when debugfs can't be read, m can be nil.
+func ZmemStats(zi *ZmemInfo, m *memory.Meminfo) (*ZmemInfo, error) {
+	return getZmemStats(zi, m, rootfs.FS)
+}
+
+func getZmemStats(zi *ZmemInfo, m *memory.Meminfo, fsys fs.FS) (*ZmemInfo, error) {
+	s := new(sample)
+	if m != nil {
+		s.memTotal = m.MemTotal
+	}
+	var err error
+	if s.zrams, err = readZrams(fsys); err != nil {
+		return nil, err
+	}
+	if s.zswap, err = readZswap(fsys, m); err != nil {
+		return nil, err
+	}
+	if s.ksm, err = readKsm(fsys); err != nil {
+		return nil, err
+	}
+	zi.old = zi.new
+	zi.new = s
+	return zi, nil
+}
+
+func ratio(orig, compr int) float64 {
+	if compr <= 0 {
+		return 0
+	}
+	return float64(orig) / float64(compr)
+}
+
+// Counters go up, show how much since the last sample
+func delta(cur, prev int, hasPrev bool) string {
+	if !hasPrev || cur <= prev {
+		return strconv.Itoa(cur)
+	}
+	return fmt.Sprintf("%d (+%d)", cur, cur-prev)
+}
+
+func (z *zram) String() string {
+	s := fmt.Sprintf("%s orig: %d compr: %d ratio: %.1f used: %d",
+		z.name, memory.Scaled(z.origSize/1024), memory.Scaled(z.comprSize/1024),
+		ratio(z.origSize, z.comprSize), memory.Scaled(z.memUsed/1024))
+	if z.memLimit > 0 {
+		s += fmt.Sprintf(" limit: %d (%.0f%%)", memory.Scaled(z.memLimit/1024),
+			100*float64(z.memUsed)/float64(z.memLimit))
+	}
+	s += fmt.Sprintf(" same: %d", z.samePages)
+	if z.hugePages >= 0 {
+		s += fmt.Sprintf(" huge: %d", z.hugePages)
+	}
+	if z.failedReads > 0 || z.failedWrites > 0 {
+		s += fmt.Sprintf(" FAILED reads: %d writes: %d", z.failedReads, z.failedWrites)
+	}
+	return s
+}
+
+func (zi *ZmemInfo) zswapString() string {
+	z, prev := zi.new.zswap, zswap{}
+	hasPrev := zi.old != nil
+	if hasPrev {
+		prev = zi.old.zswap
+	}
+	if !z.available {
+		return "zswap: not available"
+	}
+	if !z.enabled && z.pool == 0 {
+		return "zswap: off"
+	}
+	s := fmt.Sprintf("zswap: stored: %d pool: %d ratio: %.1f",
+		memory.Scaled(z.stored), memory.Scaled(z.pool), ratio(z.stored, z.pool))
+	if zi.new.memTotal > 0 && z.maxPool > 0 {
+		limit := zi.new.memTotal * z.maxPool / 100
+		s += fmt.Sprintf(" limit: %d%% (%.0f%% used)", z.maxPool, 100*float64(z.pool)/float64(limit))
+	}
+	if !z.enabled {
+		s += " disabled"
+	}
+	if z.debug {
+		s += " limit_hit: " + delta(z.limitHit, prev.limitHit, hasPrev)
+		s += " written_back: " + delta(z.writeback, prev.writeback, hasPrev)
+		s += " rejects: " + delta(z.rejects, prev.rejects, hasPrev)
+	}
+	return s
+}
+
+func (zi *ZmemInfo) ksmString() string {
+	k := zi.new.ksm
+	if !k.available {
+		return "ksm: not available"
+	}
+	if k.run != 1 && k.shared == 0 {
+		return "ksm: off"
+	}
+	// pages_sharing only counts the mappings past the first, the ones saved
+	s := fmt.Sprintf("ksm: shared: %d sharing: %d unshared: %d saved: %d",
+		k.shared, k.sharing, k.unshared, memory.Scaled(k.sharing*pageSize/1024))
+	if k.profit >= 0 {
+		s += fmt.Sprintf(" profit: %d", memory.Scaled(k.profit/1024))
+	}
+	var prev ksm
+	if zi.old != nil {
+		prev = zi.old.ksm
+	}
+	s += " full_scans: " + delta(k.fullScans, prev.fullScans, zi.old != nil)
+	if k.run != 1 {
+		s += " stopped"
+	}
+	return s
+}
+
+// A line per zram device, then zswap and ksm
+func (zi *ZmemInfo) InfoPrint() string {
+	var sb strings.Builder
+	for _, z := range zi.new.zrams {
+		sb.WriteString(z.String() + "\n")
+	}
+	if len(zi.new.zrams) == 0 {
+		sb.WriteString("zram: none\n")
+	}
+	sb.WriteString(zi.zswapString() + "\n")
+	sb.WriteString(zi.ksmString() + "\n")
+	return sb.String()
+}
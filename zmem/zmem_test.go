@@ -0,0 +1,137 @@
+package zmem
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bioe007/synopsys/memory"
+	"github.com/bioe007/synopsys/status"
+)
+
+func zmemFiles(limitHit, fullScans int) fstest.MapFS {
+	return fstest.MapFS{
+		// 400MB stored in 100MB, 110MB used of a 220MB limit
+		"sys/block/zram0/disksize": {Data: []byte("8589934592\n")},
+		"sys/block/zram0/mm_stat": {Data: []byte(
+			"419430400 104857600 115343360 230686720 120000000 2048 0 12 4\n")},
+		"sys/block/zram0/io_stat": {Data: []byte("0 3 0 100\n")},
+		// not set up
+		"sys/block/zram1/disksize": {Data: []byte("0\n")},
+		"sys/block/zram1/mm_stat":  {Data: []byte("0 0 0 0 0 0 0 0 0\n")},
+
+		"sys/module/zswap/parameters/enabled":          {Data: []byte("Y\n")},
+		"sys/module/zswap/parameters/max_pool_percent": {Data: []byte("20\n")},
+		"sys/kernel/debug/zswap/pool_total_size":       {Data: []byte("52428800\n")},
+		"sys/kernel/debug/zswap/stored_pages":          {Data: []byte(fmt.Sprintf("%d\n", 204800*1024/pageSize))},
+		"sys/kernel/debug/zswap/pool_limit_hit":        {Data: []byte(fmt.Sprintf("%d\n", limitHit))},
+		"sys/kernel/debug/zswap/written_back_pages":    {Data: []byte("7\n")},
+		"sys/kernel/debug/zswap/reject_compress_poor":  {Data: []byte("2\n")},
+		"sys/kernel/debug/zswap/reject_alloc_fail":     {Data: []byte("1\n")},
+
+		"sys/kernel/mm/ksm/run":            {Data: []byte("1\n")},
+		"sys/kernel/mm/ksm/pages_shared":   {Data: []byte("100\n")},
+		"sys/kernel/mm/ksm/pages_sharing":  {Data: []byte(fmt.Sprintf("%d\n", 1024*1024/pageSize))},
+		"sys/kernel/mm/ksm/pages_unshared": {Data: []byte("5000\n")},
+		"sys/kernel/mm/ksm/full_scans":     {Data: []byte(fmt.Sprintf("%d\n", fullScans))},
+	}
+}
+
+func TestZmemStats(t *testing.T) {
+	memory.SetScale(1024 * 1024)
+	m := &memory.Meminfo{MemTotal: 1024 * 1024, Zswap: 1, Zswapped: 2}
+	zi, err := getZmemStats(new(ZmemInfo), m, zmemFiles(3, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zi.new.zrams) != 1 {
+		t.Fatalf("expected only zram0, got %d", len(zi.new.zrams))
+	}
+	zi, err = getZmemStats(zi, m, zmemFiles(5, 11))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := zi.InfoPrint()
+	for _, want := range []string{
+		"zram0 orig: 400 compr: 100 ratio: 4.0 used: 110 limit: 220 (50%) same: 2048 huge: 12 FAILED reads: 0 writes: 3\n",
+		"zswap: stored: 200 pool: 50 ratio: 4.0 limit: 20% (24% used) limit_hit: 5 (+2) written_back: 7 rejects: 3\n",
+		"ksm: shared: 100 sharing: ",
+		" saved: 1 full_scans: 11 (+1)\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
+
+// Without root the zswap sizes come from meminfo
+func TestZswapMeminfo(t *testing.T) {
+	memory.SetScale(1024 * 1024)
+	fsys := zmemFiles(0, 0)
+	for name := range fsys {
+		if strings.HasPrefix(name, zswapDebugPath) {
+			delete(fsys, name)
+		}
+	}
+	m := &memory.Meminfo{MemTotal: 1024 * 1024, Zswap: 10 * 1024, Zswapped: 30 * 1024}
+	zi, err := getZmemStats(new(ZmemInfo), m, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := zi.zswapString(); s != "zswap: stored: 30 pool: 10 ratio: 3.0 limit: 20% (5% used)" {
+		t.Errorf("wrong zswap %q", s)
+	}
+}
+
+func TestZramFormats(t *testing.T) {
+	memory.SetScale(1024 * 1024)
+	const mb = 1024 * 1024
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+		want  string
+	}{
+		{name: "none", files: fstest.MapFS{}, want: "zram: none\n"},
+		{name: "5.1 and later", files: fstest.MapFS{
+			"sys/block/zram0/mm_stat": {Data: []byte(fmt.Sprintf("%d %d %d 0 0 7 0 3 3\n", 40*mb, 10*mb, 11*mb))},
+		}, want: "zram0 orig: 40 compr: 10 ratio: 4.0 used: 11 same: 7 huge: 3\n"},
+		// no huge_pages column
+		{name: "4.1 to 5.0", files: fstest.MapFS{
+			"sys/block/zram0/mm_stat": {Data: []byte(fmt.Sprintf("%d %d %d 0 0 7 0\n", 40*mb, 10*mb, 11*mb))},
+		}, want: "zram0 orig: 40 compr: 10 ratio: 4.0 used: 11 same: 7\n"},
+		// a file per value, no mm_stat or io_stat
+		{name: "before 4.1", files: fstest.MapFS{
+			"sys/block/zram0/orig_data_size":  {Data: []byte(fmt.Sprintf("%d\n", 40*mb))},
+			"sys/block/zram0/compr_data_size": {Data: []byte(fmt.Sprintf("%d\n", 10*mb))},
+			"sys/block/zram0/mem_used_total":  {Data: []byte(fmt.Sprintf("%d\n", 11*mb))},
+			"sys/block/zram0/zero_pages":      {Data: []byte("7\n")},
+		}, want: "zram0 orig: 40 compr: 10 ratio: 4.0 used: 11 same: 7\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.files) > 0 {
+				tc.files["sys/block/zram0/disksize"] = &fstest.MapFile{Data: []byte("8589934592\n")}
+			}
+			zi, err := getZmemStats(new(ZmemInfo), nil, tc.files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.want + "zswap: not available\nksm: not available\n"
+			if out := zi.InfoPrint(); out != want {
+				t.Errorf("got %q, expected %q", out, want)
+			}
+		})
+	}
+}
+
+func TestZmemStatsBadMmStat(t *testing.T) {
+	fsys := zmemFiles(0, 0)
+	fsys["sys/block/zram0/mm_stat"] = &fstest.MapFile{Data: []byte("1 2 3\n")}
+	_, err := getZmemStats(new(ZmemInfo), nil, fsys)
+	var fe *status.FormatError
+	if !errors.As(err, &fe) {
+		t.Errorf("expected a format error, got %v", err)
+	}
+}